@@ -0,0 +1,41 @@
+package blob
+
+import (
+	"errors"
+
+	"github.com/gocql/gocql"
+)
+
+// CassandraStore keeps objects in the blobs table. It suits small objects such as avatars.
+type CassandraStore struct {
+	session *gocql.Session
+}
+
+func NewCassandraStore(session *gocql.Session) *CassandraStore {
+	return &CassandraStore{session: session}
+}
+
+func (s *CassandraStore) Put(key string, obj *Object) error {
+	return s.session.Query(
+		"INSERT INTO blobs (key, data, content_type, etag, updated_at) VALUES (?, ?, ?, ?, ?)",
+		key, obj.Data, obj.ContentType, obj.ETag, obj.UpdatedAt,
+	).Exec()
+}
+
+func (s *CassandraStore) Get(key string) (*Object, error) {
+	var obj Object
+	err := s.session.Query(
+		"SELECT data, content_type, etag, updated_at FROM blobs WHERE key = ?", key,
+	).Scan(&obj.Data, &obj.ContentType, &obj.ETag, &obj.UpdatedAt)
+	if errors.Is(err, gocql.ErrNotFound) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &obj, nil
+}
+
+func (s *CassandraStore) Delete(key string) error {
+	return s.session.Query("DELETE FROM blobs WHERE key = ?", key).Exec()
+}
@@ -0,0 +1,109 @@
+package blob
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// FileStore keeps each object as a file next to a small JSON metadata file.
+type FileStore struct {
+	root string
+}
+
+func NewFileStore(root string) *FileStore {
+	return &FileStore{root: root}
+}
+
+type fileMeta struct {
+	ContentType string `json:"content_type"`
+	ETag        string `json:"etag"`
+	UpdatedAt   string `json:"updated_at"`
+}
+
+func (s *FileStore) path(key string) (string, error) {
+	clean := filepath.Clean("/" + key)
+	if clean == "/" || strings.Contains(key, "..") {
+		return "", fmt.Errorf("invalid blob key %q", key)
+	}
+	return filepath.Join(s.root, clean), nil
+}
+
+func (s *FileStore) Put(key string, obj *Object) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0o750); err != nil {
+		return err
+	}
+	meta, err := json.Marshal(fileMeta{
+		ContentType: obj.ContentType,
+		ETag:        obj.ETag,
+		UpdatedAt:   obj.UpdatedAt.UTC().Format(time.RFC3339Nano),
+	})
+	if err != nil {
+		return err
+	}
+	// Write to temporary files and rename so readers never see a partial object.
+	if err := writeFileAtomic(p, obj.Data); err != nil {
+		return err
+	}
+	return writeFileAtomic(p+".meta", meta)
+}
+
+func (s *FileStore) Get(key string) (*Object, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	obj := &Object{Data: data}
+	if raw, err := os.ReadFile(p + ".meta"); err == nil {
+		var meta fileMeta
+		if err := json.Unmarshal(raw, &meta); err == nil {
+			obj.ContentType, obj.ETag = meta.ContentType, meta.ETag
+			obj.UpdatedAt, _ = time.Parse(time.RFC3339Nano, meta.UpdatedAt)
+		}
+	}
+	return obj, nil
+}
+
+func (s *FileStore) Delete(key string) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	for _, f := range []string{p, p + ".meta"} {
+		if err := os.Remove(f); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,41 @@
+package blob
+
+import (
+	"errors"
+	"log"
+	"time"
+
+	"go-keycloack/config"
+)
+
+// ErrNotFound is returned when no object is stored under a key.
+var ErrNotFound = errors.New("blob not found")
+
+// Object is a stored blob with the metadata needed to serve it.
+type Object struct {
+	Data        []byte
+	ContentType string
+	ETag        string
+	UpdatedAt   time.Time
+}
+
+// Store keeps binary objects under string keys such as "avatars/<user id>/128.png".
+type Store interface {
+	Put(key string, obj *Object) error
+	Get(key string) (*Object, error)
+	Delete(key string) error
+}
+
+// NewStoreFromEnv returns the store selected by BLOB_STORE: "cassandra" (default) or "filesystem",
+// which keeps files under BLOB_DIR.
+func NewStoreFromEnv() Store {
+	switch backend := config.GetString("BLOB_STORE", "cassandra"); backend {
+	case "cassandra":
+		return NewCassandraStore(config.Session)
+	case "filesystem":
+		return NewFileStore(config.GetString("BLOB_DIR", "./data/blobs"))
+	default:
+		log.Fatalf("Unknown BLOB_STORE %q", backend)
+		return nil
+	}
+}
@@ -0,0 +1,71 @@
+package challenge
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// HostedCaptcha verifies tokens with a hosted CAPTCHA provider. reCAPTCHA, hCaptcha and
+// Turnstile all accept the same siteverify form (secret, response, remoteip) and answer with
+// {"success": bool}, so only the URL and keys differ.
+type HostedCaptcha struct {
+	Provider  string
+	SiteKey   string
+	Secret    string
+	VerifyURL string
+	Client    *http.Client
+}
+
+func NewHostedCaptcha(provider, siteKey, secret, verifyURL string) *HostedCaptcha {
+	return &HostedCaptcha{
+		Provider:  provider,
+		SiteKey:   siteKey,
+		Secret:    secret,
+		VerifyURL: verifyURL,
+		Client:    &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Issue returns what the client needs to render the widget; the provider issues the puzzle.
+func (h *HostedCaptcha) Issue(context.Context) (*Challenge, error) {
+	return &Challenge{Type: "captcha", Provider: h.Provider, SiteKey: h.SiteKey}, nil
+}
+
+func (h *HostedCaptcha) Verify(ctx context.Context, response, remoteIP string) error {
+	if response == "" {
+		return ErrInvalid
+	}
+	form := url.Values{"secret": {h.Secret}, "response": {response}}
+	if remoteIP != "" {
+		form.Set("remoteip", remoteIP)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.VerifyURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := h.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s siteverify returned %s", h.Provider, resp.Status)
+	}
+	var result struct {
+		Success    bool     `json:"success"`
+		ErrorCodes []string `json:"error-codes"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return err
+	}
+	if !result.Success {
+		return fmt.Errorf("%w: %s", ErrInvalid, strings.Join(result.ErrorCodes, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package challenge
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/bits"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ProofOfWork is a hashcash-style verifier that needs no outside service. Issued tokens are kept
+// in Valkey until they are used or expire, so each can be redeemed once on any instance.
+type ProofOfWork struct {
+	client     *redis.Client
+	difficulty int
+	ttl        time.Duration
+}
+
+// NewProofOfWork requires difficulty leading zero bits; each extra bit doubles the expected work.
+func NewProofOfWork(client *redis.Client, difficulty int, ttl time.Duration) *ProofOfWork {
+	return &ProofOfWork{client: client, difficulty: difficulty, ttl: ttl}
+}
+
+func powKey(token string) string {
+	return "pow:challenge:" + token
+}
+
+func (p *ProofOfWork) Issue(ctx context.Context) (*Challenge, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+	token := hex.EncodeToString(buf)
+	expiresAt := time.Now().Add(p.ttl).UTC()
+	if err := p.client.Set(ctx, powKey(token), p.difficulty, p.ttl).Err(); err != nil {
+		return nil, err
+	}
+	return &Challenge{
+		Type:       "pow",
+		Algorithm:  "sha256",
+		Token:      token,
+		Difficulty: p.difficulty,
+		ExpiresAt:  &expiresAt,
+	}, nil
+}
+
+func (p *ProofOfWork) Verify(ctx context.Context, response, _ string) error {
+	token, nonce, ok := strings.Cut(response, ":")
+	if !ok || token == "" || nonce == "" || len(nonce) > 64 {
+		return ErrInvalid
+	}
+	// GETDEL makes every token single-use, even when two instances race
+	difficulty, err := p.client.GetDel(ctx, powKey(token)).Int()
+	if errors.Is(err, redis.Nil) {
+		return fmt.Errorf("%w: unknown or expired token", ErrInvalid)
+	}
+	if err != nil {
+		return err
+	}
+	if leadingZeroBits(sha256.Sum256([]byte(token+":"+nonce))) < difficulty {
+		return fmt.Errorf("%w: insufficient work", ErrInvalid)
+	}
+	return nil
+}
+
+// Solve finds a nonce for a proof-of-work challenge. It is what a client has to do, and is
+// useful for tests and command-line tools.
+func Solve(token string, difficulty int) string {
+	for nonce := uint64(0); ; nonce++ {
+		candidate := fmt.Sprintf("%x", nonce)
+		if leadingZeroBits(sha256.Sum256([]byte(token+":"+candidate))) >= difficulty {
+			return token + ":" + candidate
+		}
+	}
+}
+
+func leadingZeroBits(sum [sha256.Size]byte) int {
+	n := 0
+	for _, b := range sum {
+		if b != 0 {
+			return n + bits.LeadingZeros8(b)
+		}
+		n += 8
+	}
+	return n
+}
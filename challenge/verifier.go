@@ -0,0 +1,35 @@
+// Package challenge implements the proof-of-work and CAPTCHA challenges that /login demands once
+// a username or IP has failed too often.
+package challenge
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrInvalid is returned for responses that do not solve a challenge.
+var ErrInvalid = errors.New("invalid challenge response")
+
+// Challenge is what a client is given to solve. Which fields are set depends on the verifier.
+type Challenge struct {
+	Type string `json:"type"`
+	// Proof of work: find a nonce so that sha256(Token + ":" + nonce) starts with Difficulty
+	// zero bits, and answer with Token + ":" + nonce.
+	Algorithm  string     `json:"algorithm,omitempty"`
+	Token      string     `json:"token,omitempty"`
+	Difficulty int        `json:"difficulty,omitempty"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	// Hosted CAPTCHA: render the provider's widget with SiteKey and answer with its token.
+	Provider string `json:"provider,omitempty"`
+	SiteKey  string `json:"site_key,omitempty"`
+}
+
+// Verifier issues challenges and checks the answers to them.
+type Verifier interface {
+	// Issue returns a new challenge for a client.
+	Issue(ctx context.Context) (*Challenge, error)
+	// Verify checks a client's response. It returns ErrInvalid, possibly wrapped, when the
+	// response is wrong, expired or already used.
+	Verify(ctx context.Context, response, remoteIP string) error
+}
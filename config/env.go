@@ -0,0 +1,60 @@
+package config
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GetString returns the environment variable or def when it is unset.
+func GetString(key, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
+
+// GetInt returns the environment variable parsed as an int, or def when it is unset or invalid.
+func GetInt(key string, def int) int {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		log.Printf("Invalid value for %s (%q), using default %d", key, v, def)
+		return def
+	}
+	return n
+}
+
+// GetDuration returns the environment variable parsed as a time.Duration, or def when it is unset or invalid.
+func GetDuration(key string, def time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Printf("Invalid value for %s (%q), using default %s", key, v, def)
+		return def
+	}
+	return d
+}
+
+// GetList returns the comma-separated environment variable as a trimmed slice, or def when it is unset.
+func GetList(key string, def []string) []string {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	var out []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
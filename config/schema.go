@@ -0,0 +1,136 @@
+package config
+
+import (
+	"log"
+	"strings"
+)
+
+// schemaStatements are applied in order at startup. Cassandra has no
+// "ADD COLUMN IF NOT EXISTS", so errors for columns that already exist are ignored.
+var schemaStatements = []string{
+	`CREATE TABLE IF NOT EXISTS users (
+		id uuid PRIMARY KEY,
+		username text,
+		email text,
+		firstname text,
+		lastname text
+	)`,
+	`CREATE INDEX IF NOT EXISTS ON users (username)`,
+	`ALTER TABLE users ADD keycloak_id text`,
+	`CREATE INDEX IF NOT EXISTS ON users (keycloak_id)`,
+	`ALTER TABLE users ADD deleted_at timestamp`,
+	`ALTER TABLE users ADD deleted_by text`,
+	`ALTER TABLE users ADD attributes map<text, text>`,
+	`ALTER TABLE users ADD email_index text`,
+	`CREATE INDEX IF NOT EXISTS ON users (email_index)`,
+	`ALTER TABLE users ADD last_login_at timestamp`,
+	`ALTER TABLE users ADD login_count int`,
+	`CREATE TABLE IF NOT EXISTS user_login_history (
+		user_id uuid,
+		attempted_at timeuuid,
+		username text,
+		success boolean,
+		ip text,
+		user_agent text,
+		session_id text,
+		PRIMARY KEY ((user_id), attempted_at)
+	) WITH CLUSTERING ORDER BY (attempted_at DESC)`,
+	`CREATE TABLE IF NOT EXISTS user_audit (
+		user_id uuid,
+		event_id timeuuid,
+		action text,
+		actor text,
+		changes text,
+		ip text,
+		user_agent text,
+		request_id text,
+		PRIMARY KEY ((user_id), event_id)
+	) WITH CLUSTERING ORDER BY (event_id DESC)`,
+	`CREATE TABLE IF NOT EXISTS user_preferences (
+		user_id uuid,
+		namespace text,
+		key text,
+		value text,
+		PRIMARY KEY ((user_id), namespace, key)
+	)`,
+	`CREATE TABLE IF NOT EXISTS user_preference_namespaces (
+		user_id uuid,
+		namespace text,
+		PRIMARY KEY ((user_id), namespace)
+	)`,
+	`CREATE TABLE IF NOT EXISTS blobs (
+		key text PRIMARY KEY,
+		data blob,
+		content_type text,
+		etag text,
+		updated_at timestamp
+	)`,
+	`CREATE TABLE IF NOT EXISTS erasure_jobs (
+		id uuid PRIMARY KEY,
+		user_id uuid,
+		username text,
+		keycloak_id text,
+		status text,
+		completed_steps map<text, timestamp>,
+		requested_by text,
+		created_at timestamp,
+		updated_at timestamp,
+		error text,
+		tombstone_hash text
+	)`,
+	`CREATE TABLE IF NOT EXISTS erasure_tombstones (
+		chain text,
+		erased_at timeuuid,
+		user_id uuid,
+		subject_hash text,
+		steps list<text>,
+		prev_hash text,
+		hash text,
+		PRIMARY KEY ((chain), erased_at)
+	) WITH CLUSTERING ORDER BY (erased_at DESC)`,
+	`CREATE TABLE IF NOT EXISTS erasure_chain_head (
+		chain text PRIMARY KEY,
+		hash text
+	)`,
+	`CREATE TABLE IF NOT EXISTS issued_credentials (
+		user_id uuid,
+		issued_at timeuuid,
+		issuer_id uuid,
+		issuer_did text,
+		credential_issuer text,
+		credential_configuration_id text,
+		credential_data text,
+		PRIMARY KEY ((user_id), issued_at)
+	) WITH CLUSTERING ORDER BY (issued_at DESC)`,
+	`CREATE TABLE IF NOT EXISTS issuers (
+		id uuid PRIMARY KEY,
+		name text,
+		did text,
+		key_ref text,
+		key_material text,
+		credential_types set<text>,
+		owner text,
+		status text,
+		created_at timestamp,
+		updated_at timestamp
+	)`,
+	`CREATE INDEX IF NOT EXISTS ON issuers (owner)`,
+}
+
+// EnsureSchema creates the tables, columns and indexes the services rely on.
+func EnsureSchema() {
+	for _, stmt := range schemaStatements {
+		if err := Session.Query(stmt).Exec(); err != nil {
+			if isAlreadyExists(err) {
+				continue
+			}
+			log.Fatalf("Failed to apply schema statement %q: %v", stmt, err)
+		}
+	}
+	log.Println("Cassandra schema is up to date")
+}
+
+func isAlreadyExists(err error) bool {
+	msg := strings.ToLower(err.Error())
+	return strings.Contains(msg, "already exist") || strings.Contains(msg, "conflicts with an existing column")
+}
@@ -0,0 +1,31 @@
+package config
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Valkey is the shared Valkey (Redis-compatible) client.
+var Valkey *redis.Client
+
+func InitValkey() {
+	Valkey = redis.NewClient(&redis.Options{
+		Addr:     GetString("VALKEY_HOST", "localhost") + ":" + GetString("VALKEY_PORT", "6379"),
+		Password: GetString("VALKEY_PASSWORD", ""),
+		DB:       0,
+		// Fail fast during an outage; the rate limiter falls back to its failure mode
+		DialTimeout: GetDuration("VALKEY_DIAL_TIMEOUT", time.Second),
+		ReadTimeout: GetDuration("VALKEY_READ_TIMEOUT", time.Second),
+	})
+
+	ctx := context.Background()
+	info, err := Valkey.Info(ctx, "server").Result()
+	if err != nil {
+		fmt.Printf("Failed to connect to Valkey: %v\n", err)
+	} else {
+		fmt.Printf("Connected to Valkey. Server info:\n%s\n", info)
+	}
+}
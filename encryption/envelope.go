@@ -0,0 +1,165 @@
+package encryption
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"go-keycloack/config"
+)
+
+// valuePrefix marks an encrypted value. Encrypted values have the form
+// enc:v1:<master key id>:<wrapped data key>:<nonce || ciphertext>, both parts base64.
+const valuePrefix = "enc:v1:"
+
+// FieldEncryptor encrypts configured fields with per-value AES-GCM data keys wrapped by a master
+// key, and derives keyed blind indexes for equality lookups on encrypted fields.
+type FieldEncryptor struct {
+	provider KeyProvider
+	indexKey []byte
+	fields   map[string]bool
+}
+
+// Default is the encryptor used by the services. It is nil, and encryption is disabled, until
+// Init loads a keyfile.
+var Default *FieldEncryptor
+
+// NewFieldEncryptor returns an encryptor for the given fields.
+func NewFieldEncryptor(provider KeyProvider, indexKey []byte, fields []string) *FieldEncryptor {
+	e := &FieldEncryptor{provider: provider, indexKey: indexKey, fields: map[string]bool{}}
+	for _, f := range fields {
+		e.fields[f] = true
+	}
+	return e
+}
+
+// Init configures Default from PII_KEYFILE and PII_ENCRYPTED_FIELDS. Without a keyfile, values
+// are stored in plaintext.
+func Init() {
+	path := config.GetString("PII_KEYFILE", "")
+	if path == "" {
+		log.Println("PII_KEYFILE is not set; PII fields are stored unencrypted")
+		return
+	}
+	provider, indexKey, err := LoadKeyfile(path)
+	if err != nil {
+		log.Fatalf("Failed to load PII keyfile: %v", err)
+	}
+	fields := config.GetList("PII_ENCRYPTED_FIELDS", []string{"email", "firstname", "lastname"})
+	Default = NewFieldEncryptor(provider, indexKey, fields)
+	log.Printf("PII encryption enabled for %s with master key %s", strings.Join(fields, ", "), provider.ActiveKeyID())
+}
+
+// ActiveKeyID is the master key that new values are wrapped with.
+func (e *FieldEncryptor) ActiveKeyID() string {
+	return e.provider.ActiveKeyID()
+}
+
+// Encrypts reports whether the field is configured for encryption.
+func (e *FieldEncryptor) Encrypts(field string) bool {
+	return e != nil && e.fields[field]
+}
+
+// Encrypt returns the stored form of a field value. Fields that are not configured, and empty
+// values, are returned unchanged.
+func (e *FieldEncryptor) Encrypt(field, plaintext string) (string, error) {
+	if !e.Encrypts(field) || plaintext == "" {
+		return plaintext, nil
+	}
+	return e.Seal(field, plaintext)
+}
+
+// Seal encrypts a value regardless of the field configuration. field is bound to the ciphertext
+// so that a value cannot be moved to another column.
+func (e *FieldEncryptor) Seal(field, plaintext string) (string, error) {
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", err
+	}
+	ciphertext, err := seal(dataKey, []byte(plaintext), []byte(field))
+	if err != nil {
+		return "", err
+	}
+	keyID, wrapped, err := e.provider.WrapKey(dataKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to wrap data key: %w", err)
+	}
+	return valuePrefix + keyID + ":" +
+		base64.RawStdEncoding.EncodeToString(wrapped) + ":" +
+		base64.RawStdEncoding.EncodeToString(ciphertext), nil
+}
+
+// Decrypt returns the plaintext of a stored value. Values that were written before encryption
+// was enabled are returned unchanged.
+func (e *FieldEncryptor) Decrypt(field, stored string) (string, error) {
+	if !IsEncrypted(stored) {
+		return stored, nil
+	}
+	if e == nil {
+		return "", errors.New("encrypted value found but PII encryption is not configured")
+	}
+	keyID, wrapped, ciphertext, err := parseValue(stored)
+	if err != nil {
+		return "", err
+	}
+	dataKey, err := e.provider.UnwrapKey(keyID, wrapped)
+	if err != nil {
+		return "", fmt.Errorf("failed to unwrap data key: %w", err)
+	}
+	plaintext, err := open(dataKey, ciphertext, []byte(field))
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt %s: %w", field, err)
+	}
+	return string(plaintext), nil
+}
+
+// NeedsRotation reports whether a stored value should be rewritten: it is a configured field
+// still in plaintext, or it was wrapped with a master key that is no longer active.
+func (e *FieldEncryptor) NeedsRotation(field, stored string) bool {
+	if e == nil || stored == "" {
+		return false
+	}
+	if !IsEncrypted(stored) {
+		return e.Encrypts(field)
+	}
+	keyID, _, _, err := parseValue(stored)
+	return err == nil && keyID != e.provider.ActiveKeyID()
+}
+
+// BlindIndex returns a keyed hash of the normalised value for equality lookups on an encrypted
+// field. It returns "" when the field is not encrypted.
+func (e *FieldEncryptor) BlindIndex(field, value string) string {
+	if !e.Encrypts(field) || value == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, e.indexKey)
+	mac.Write([]byte(field + "|" + strings.ToLower(strings.TrimSpace(value))))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// IsEncrypted reports whether a stored value is in the encrypted format.
+func IsEncrypted(stored string) bool {
+	return strings.HasPrefix(stored, valuePrefix)
+}
+
+func parseValue(stored string) (string, []byte, []byte, error) {
+	parts := strings.Split(strings.TrimPrefix(stored, valuePrefix), ":")
+	if len(parts) != 3 {
+		return "", nil, nil, errors.New("malformed encrypted value")
+	}
+	wrapped, err := base64.RawStdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", nil, nil, errors.New("malformed wrapped key")
+	}
+	ciphertext, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", nil, nil, errors.New("malformed ciphertext")
+	}
+	return parts[0], wrapped, ciphertext, nil
+}
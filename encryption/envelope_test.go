@@ -0,0 +1,206 @@
+package encryption
+
+import (
+	"bytes"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, 32)
+}
+
+func testEncryptor(active string, fields ...string) *FieldEncryptor {
+	provider := &LocalKeyProvider{active: active, keys: map[string][]byte{"old": testKey(1), "new": testKey(2)}}
+	return NewFieldEncryptor(provider, testKey(3), fields)
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	e := testEncryptor("new", "email")
+	tests := []struct {
+		name      string
+		field     string
+		plaintext string
+		encrypted bool
+	}{
+		{"configured field", "email", "alice@example.com", true},
+		{"unconfigured field", "firstname", "Alice", false},
+		{"empty value", "email", "", false},
+		{"unicode", "email", "zoë@exämple.org", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stored, err := e.Encrypt(tt.field, tt.plaintext)
+			if err != nil {
+				t.Fatalf("Encrypt() error = %v", err)
+			}
+			if IsEncrypted(stored) != tt.encrypted {
+				t.Fatalf("Encrypt() = %q, encrypted = %v, want %v", stored, IsEncrypted(stored), tt.encrypted)
+			}
+			if tt.encrypted && strings.Contains(stored, tt.plaintext) {
+				t.Fatalf("Encrypt() leaks the plaintext: %q", stored)
+			}
+			got, err := e.Decrypt(tt.field, stored)
+			if err != nil {
+				t.Fatalf("Decrypt() error = %v", err)
+			}
+			if got != tt.plaintext {
+				t.Errorf("Decrypt() = %q, want %q", got, tt.plaintext)
+			}
+		})
+	}
+}
+
+func TestSealUsesFreshDataKeys(t *testing.T) {
+	e := testEncryptor("new")
+	a, err := e.Seal("email", "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := e.Seal("email", "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a == b {
+		t.Error("Seal() produced the same ciphertext twice")
+	}
+}
+
+func TestDecryptRejects(t *testing.T) {
+	e := testEncryptor("new", "email")
+	stored, err := e.Seal("email", "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(strings.TrimPrefix(stored, valuePrefix), ":")
+	flipped, _ := base64.RawStdEncoding.DecodeString(parts[2])
+	flipped[len(flipped)-1] ^= 1
+
+	tests := []struct {
+		name   string
+		e      *FieldEncryptor
+		field  string
+		stored string
+	}{
+		{"other field", e, "firstname", stored},
+		{"tampered ciphertext", e, "email", valuePrefix + parts[0] + ":" + parts[1] + ":" + base64.RawStdEncoding.EncodeToString(flipped)},
+		{"unknown master key", e, "email", valuePrefix + "gone:" + parts[1] + ":" + parts[2]},
+		{"wrong master key id", e, "email", valuePrefix + "old:" + parts[1] + ":" + parts[2]},
+		{"malformed value", e, "email", valuePrefix + "new:abc"},
+		{"malformed base64", e, "email", valuePrefix + "new:!!:" + parts[2]},
+		{"encryption disabled", nil, "email", stored},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, err := tt.e.Decrypt(tt.field, tt.stored); err == nil {
+				t.Errorf("Decrypt() = %q, want an error", got)
+			}
+		})
+	}
+}
+
+func TestDecryptAfterRotation(t *testing.T) {
+	stored, err := testEncryptor("old", "email").Encrypt("email", "alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotated := testEncryptor("new", "email")
+	if !rotated.NeedsRotation("email", stored) {
+		t.Error("NeedsRotation() = false for a value wrapped with a retired key")
+	}
+	got, err := rotated.Decrypt("email", stored)
+	if err != nil || got != "alice@example.com" {
+		t.Errorf("Decrypt() = %q, %v", got, err)
+	}
+}
+
+func TestNeedsRotation(t *testing.T) {
+	e := testEncryptor("new", "email")
+	current, _ := e.Seal("email", "alice@example.com")
+	tests := []struct {
+		name   string
+		e      *FieldEncryptor
+		field  string
+		stored string
+		want   bool
+	}{
+		{"current key", e, "email", current, false},
+		{"plaintext in configured field", e, "email", "alice@example.com", true},
+		{"plaintext in unconfigured field", e, "firstname", "Alice", false},
+		{"empty value", e, "email", "", false},
+		{"encryption disabled", nil, "email", "alice@example.com", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.e.NeedsRotation(tt.field, tt.stored); got != tt.want {
+				t.Errorf("NeedsRotation() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBlindIndex(t *testing.T) {
+	e := testEncryptor("new", "email", "firstname")
+	base := e.BlindIndex("email", "alice@example.com")
+	if len(base) != 64 {
+		t.Fatalf("BlindIndex() = %q, want a hex SHA-256", base)
+	}
+	other := NewFieldEncryptor(e.provider, testKey(4), []string{"email"})
+	tests := []struct {
+		name  string
+		got   string
+		equal bool
+	}{
+		{"deterministic", e.BlindIndex("email", "alice@example.com"), true},
+		{"case and whitespace insensitive", e.BlindIndex("email", "  Alice@Example.COM "), true},
+		{"different value", e.BlindIndex("email", "bob@example.com"), false},
+		{"different field", e.BlindIndex("firstname", "alice@example.com"), false},
+		{"different index key", other.BlindIndex("email", "alice@example.com"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if (tt.got == base) != tt.equal {
+				t.Errorf("BlindIndex() = %q, equal to base = %v, want %v", tt.got, tt.got == base, tt.equal)
+			}
+		})
+	}
+	if got := e.BlindIndex("lastname", "alice"); got != "" {
+		t.Errorf("BlindIndex() on an unencrypted field = %q, want empty", got)
+	}
+	var disabled *FieldEncryptor
+	if got := disabled.BlindIndex("email", "alice@example.com"); got != "" {
+		t.Errorf("BlindIndex() without encryption = %q, want empty", got)
+	}
+}
+
+func TestLoadKeyfile(t *testing.T) {
+	key := base64.StdEncoding.EncodeToString(testKey(1))
+	short := base64.StdEncoding.EncodeToString([]byte("short"))
+	tests := []struct {
+		name    string
+		content string
+		wantErr bool
+	}{
+		{"valid", `{"active":"k1","keys":{"k1":"` + key + `"},"blind_index_key":"` + key + `"}`, false},
+		{"missing active key", `{"active":"k2","keys":{"k1":"` + key + `"},"blind_index_key":"` + key + `"}`, true},
+		{"short master key", `{"active":"k1","keys":{"k1":"` + short + `"},"blind_index_key":"` + key + `"}`, true},
+		{"colon in key id", `{"active":"k:1","keys":{"k:1":"` + key + `"},"blind_index_key":"` + key + `"}`, true},
+		{"missing blind index key", `{"active":"k1","keys":{"k1":"` + key + `"}}`, true},
+		{"invalid JSON", `{`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "keys.json")
+			if err := os.WriteFile(path, []byte(tt.content), 0o600); err != nil {
+				t.Fatal(err)
+			}
+			_, _, err := LoadKeyfile(path)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("LoadKeyfile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,136 @@
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// KeyProvider wraps and unwraps data keys with a master key. The local keyfile provider is the
+// only built-in implementation; a KMS client can satisfy the same interface.
+type KeyProvider interface {
+	// ActiveKeyID is the master key used to wrap new data keys.
+	ActiveKeyID() string
+	// WrapKey encrypts a data key with the active master key.
+	WrapKey(dataKey []byte) (keyID string, wrapped []byte, err error)
+	// UnwrapKey decrypts a data key with the master key it was wrapped with.
+	UnwrapKey(keyID string, wrapped []byte) ([]byte, error)
+}
+
+// keyfile is the on-disk format read by LoadKeyfile. Keys are base64-encoded 32-byte AES keys.
+// Retired master keys stay in "keys" until every value wrapped with them has been rotated.
+type keyfile struct {
+	Active        string            `json:"active"`
+	Keys          map[string]string `json:"keys"`
+	BlindIndexKey string            `json:"blind_index_key"`
+}
+
+// LocalKeyProvider wraps data keys with AES-GCM master keys held in memory.
+type LocalKeyProvider struct {
+	active string
+	keys   map[string][]byte
+}
+
+// LoadKeyfile reads master keys and the blind index key from a JSON keyfile.
+func LoadKeyfile(path string) (*LocalKeyProvider, []byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read keyfile: %w", err)
+	}
+	var kf keyfile
+	if err := json.Unmarshal(data, &kf); err != nil {
+		return nil, nil, fmt.Errorf("failed to parse keyfile: %w", err)
+	}
+
+	provider := &LocalKeyProvider{active: kf.Active, keys: map[string][]byte{}}
+	for id, encoded := range kf.Keys {
+		if id == "" || strings.Contains(id, ":") {
+			return nil, nil, fmt.Errorf("invalid key id %q", id)
+		}
+		key, err := decodeKey(encoded)
+		if err != nil {
+			return nil, nil, fmt.Errorf("key %q: %w", id, err)
+		}
+		provider.keys[id] = key
+	}
+	if _, ok := provider.keys[kf.Active]; !ok {
+		return nil, nil, fmt.Errorf("active key %q is not in the keyfile", kf.Active)
+	}
+
+	indexKey, err := decodeKey(kf.BlindIndexKey)
+	if err != nil {
+		return nil, nil, fmt.Errorf("blind_index_key: %w", err)
+	}
+	return provider, indexKey, nil
+}
+
+func decodeKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != 32 {
+		return nil, errors.New("key must be 32 bytes")
+	}
+	return key, nil
+}
+
+func (p *LocalKeyProvider) ActiveKeyID() string {
+	return p.active
+}
+
+func (p *LocalKeyProvider) WrapKey(dataKey []byte) (string, []byte, error) {
+	wrapped, err := seal(p.keys[p.active], dataKey, []byte(p.active))
+	if err != nil {
+		return "", nil, err
+	}
+	return p.active, wrapped, nil
+}
+
+func (p *LocalKeyProvider) UnwrapKey(keyID string, wrapped []byte) ([]byte, error) {
+	key, ok := p.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("unknown master key %q", keyID)
+	}
+	return open(key, wrapped, []byte(keyID))
+}
+
+// seal encrypts plaintext with AES-GCM and returns nonce || ciphertext.
+func seal(key, plaintext, additionalData []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+// open reverses seal.
+func open(key, sealed, additionalData []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ciphertext, additionalData)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
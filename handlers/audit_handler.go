@@ -0,0 +1,71 @@
+package handlers
+
+import (
+	"log"
+	"time"
+
+	"go-keycloack/models"
+	"go-keycloack/services"
+	"go-keycloack/utils"
+
+	"github.com/gocql/gocql"
+	"github.com/gofiber/fiber/v2"
+)
+
+// recordAudit writes an audit entry for the current request. Failures are logged rather than
+// returned so that auditing never blocks the change itself.
+func recordAudit(c *fiber.Ctx, action string, userID gocql.UUID, actor string, changes map[string]models.FieldChange) {
+	if actor == "" {
+		actor = utils.Actor(c)
+	}
+	requestID, _ := c.Locals("requestid").(string)
+	entry := &models.AuditEntry{
+		UserID:    userID,
+		Action:    action,
+		Actor:     actor,
+		Changes:   changes,
+		IP:        utils.ClientIP(c),
+		UserAgent: c.Get(fiber.HeaderUserAgent),
+		RequestID: requestID,
+	}
+	if err := services.RecordAudit(entry); err != nil {
+		log.Printf("Failed to record %s audit entry for user %s: %v", action, userID, err)
+	}
+}
+
+// HandleGetUserAudit returns a page of the user's audit trail, newest first.
+// Query parameters: from, to (RFC 3339), limit and page_token.
+func (h *UserHandler) HandleGetUserAudit(c *fiber.Ctx) error {
+	id, err := gocql.ParseUUID(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid UUID"})
+	}
+
+	from := time.Unix(0, 0).UTC()
+	to := time.Now().UTC()
+	if v := c.Query("from"); v != "" {
+		if from, err = time.Parse(time.RFC3339, v); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid from timestamp, expected RFC 3339"})
+		}
+	}
+	if v := c.Query("to"); v != "" {
+		if to, err = time.Parse(time.RFC3339, v); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid to timestamp, expected RFC 3339"})
+		}
+	}
+
+	limit, pageState, err := parsePaging(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	entries, next, err := services.ListAudit(id, from, to, limit, pageState)
+	if err != nil {
+		log.Printf("Failed to fetch audit trail for user %s: %v", id, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch audit trail"})
+	}
+	return c.JSON(fiber.Map{
+		"entries":         entries,
+		"next_page_token": encodePageToken(next),
+	})
+}
@@ -0,0 +1,97 @@
+package handlers
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"go-keycloack/services"
+
+	"github.com/gocql/gocql"
+	"github.com/gofiber/fiber/v2"
+)
+
+// HandlePutMyAvatar replaces the caller's avatar. The image is sent either as the raw request body
+// or as the "avatar" field of a multipart form.
+func (h *UserHandler) HandlePutMyAvatar(c *fiber.Ctx) error {
+	user, err := currentUser(c)
+	if err != nil || user == nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "User not found"})
+	}
+
+	data := c.Body()
+	if file, err := c.FormFile("avatar"); err == nil {
+		if file.Size > int64(services.AvatarMaxBytes()) {
+			return c.Status(fiber.StatusRequestEntityTooLarge).JSON(fiber.Map{"error": "Avatar is too large"})
+		}
+		f, err := file.Open()
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Failed to read upload"})
+		}
+		defer f.Close()
+		if data, err = io.ReadAll(f); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Failed to read upload"})
+		}
+	}
+	if len(data) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "No image uploaded"})
+	}
+	if len(data) > services.AvatarMaxBytes() {
+		return c.Status(fiber.StatusRequestEntityTooLarge).JSON(fiber.Map{"error": "Avatar is too large"})
+	}
+
+	if err := services.SaveAvatar(user.ID, data); err != nil {
+		if errors.Is(err, services.ErrInvalidAvatar) {
+			return c.Status(fiber.StatusUnsupportedMediaType).JSON(fiber.Map{"error": err.Error()})
+		}
+		log.Printf("Failed to save avatar for user %s: %v", user.ID, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to save avatar"})
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// HandleDeleteMyAvatar removes the caller's avatar.
+func (h *UserHandler) HandleDeleteMyAvatar(c *fiber.Ctx) error {
+	user, err := currentUser(c)
+	if err != nil || user == nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "User not found"})
+	}
+	if err := services.DeleteAvatar(user.ID); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to delete avatar"})
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// HandleGetUserAvatar serves a user's avatar as PNG. ?size= picks the smallest stored size that is
+// at least that large. Responses carry an ETag so clients can revalidate cheaply.
+func (h *UserHandler) HandleGetUserAvatar(c *fiber.Ctx) error {
+	id, err := gocql.ParseUUID(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid UUID"})
+	}
+	if _, err := services.GetUserByID(id); err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "User not found"})
+	}
+
+	avatar, err := services.GetAvatar(id, c.QueryInt("size", 128))
+	if errors.Is(err, services.ErrAvatarNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Avatar not found"})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to load avatar"})
+	}
+
+	c.Set(fiber.HeaderETag, avatar.ETag)
+	c.Set(fiber.HeaderCacheControl, "public, max-age=300, must-revalidate")
+	c.Set(fiber.HeaderLastModified, avatar.UpdatedAt.UTC().Format(http.TimeFormat))
+	c.Set("X-Content-Type-Options", "nosniff")
+	for _, match := range strings.Split(c.Get(fiber.HeaderIfNoneMatch), ",") {
+		if match = strings.TrimPrefix(strings.TrimSpace(match), "W/"); match == avatar.ETag || match == "*" {
+			return c.SendStatus(fiber.StatusNotModified)
+		}
+	}
+	c.Set(fiber.HeaderContentType, avatar.ContentType)
+	return c.Send(avatar.Data)
+}
@@ -0,0 +1,39 @@
+package handlers
+
+import (
+	"fmt"
+
+	"go-keycloack/config"
+	"go-keycloack/models"
+	"go-keycloack/services"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// HandleBatchGetUsers looks up several users by ID, username or Keycloak subject in one request.
+// Results keep the order of the request; users that do not exist are returned with found=false.
+func (h *UserHandler) HandleBatchGetUsers(c *fiber.Ctx) error {
+	type BatchGetRequest struct {
+		Items []models.UserLookup `json:"items"`
+	}
+	var req BatchGetRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request payload"})
+	}
+
+	maxItems := config.GetInt("BATCH_GET_MAX_ITEMS", 100)
+	if len(req.Items) == 0 || len(req.Items) > maxItems {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": fmt.Sprintf("items must contain between 1 and %d lookups", maxItems)})
+	}
+
+	results, err := services.BatchGetUsers(req.Items, config.GetInt("BATCH_GET_CONCURRENCY", 8))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch users"})
+	}
+	for i := range results {
+		if results[i].User != nil {
+			results[i].User = presentUser(c, results[i].User)
+		}
+	}
+	return c.JSON(fiber.Map{"results": results})
+}
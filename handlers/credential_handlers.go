@@ -1,146 +1,133 @@
 package handlers
 
 import (
-	"bytes"
 	"encoding/json"
-	"fmt"
-	"io"
-	"net/http"
-	"net/url"
-	"strings"
-	"time"
+	"errors"
+	"log"
 
+	"go-keycloack/models"
+	"go-keycloack/oid4vc"
+	"go-keycloack/services"
+	"go-keycloack/utils"
+
+	"github.com/gocql/gocql"
 	"github.com/gofiber/fiber/v2"
 )
 
-// sendJSONRequest sends a JSON payload to a given URL and returns the response body
-func sendJSONRequest(targetURL string, payload map[string]interface{}) (string, error) {
-	jsonPayload, err := json.Marshal(payload)
-	if err != nil {
-		return "", fmt.Errorf("failed to marshal payload: %w", err)
-	}
-
-	req, err := http.NewRequest("POST", targetURL, bytes.NewBuffer(jsonPayload))
-	if err != nil {
-		return "", fmt.Errorf("failed to create request: %w", err)
-	}
-	req.Header.Set("Content-Type", "application/json")
-
-	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", fmt.Errorf("failed to send request: %w", err)
-	}
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return "", fmt.Errorf("failed to read response: %w", err)
-	}
-
-	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
-		return string(body), fmt.Errorf("request failed: status %d, body: %s", resp.StatusCode, string(body))
-	}
+// onboardIssuerRequest is the body of issuer onboarding: how the issuer service should generate
+// the key and DID, and what to record about the issuer.
+type onboardIssuerRequest struct {
+	oid4vc.OnboardIssuerRequest
+	Name            string   `json:"name"`
+	CredentialTypes []string `json:"credential_types"`
+}
 
-	return string(body), nil
+// issuanceRequest is the body of credential issuance. The issuer is either a registered one,
+// referenced by issuer_id, or given inline as issuerKey and issuerDid.
+type issuanceRequest struct {
+	oid4vc.IssuanceRequest
+	IssuerID string `json:"issuer_id"`
 }
 
-// OnboardIssuerFiber handles onboarding an issuer (Fiber version)
+// OnboardIssuerFiber onboards an issuer and records it, owned by the caller (Fiber version)
 func OnboardIssuerFiber(c *fiber.Ctx) error {
-	var payload map[string]interface{}
-	if err := c.BodyParser(&payload); err != nil {
-		return c.Status(fiber.StatusBadRequest).SendString("Invalid payload")
+	var req onboardIssuerRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid payload"})
+	}
+	if req.Name == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "name is required"})
+	}
+	issuer, err := services.RegisterIssuer(c.Context(), req.Name, utils.Subject(c), req.CredentialTypes, req.OnboardIssuerRequest)
+	if errors.Is(err, services.ErrIssuerKeysUnprotected) {
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{"error": "Issuer registration requires PII encryption"})
 	}
-
-	result, err := sendJSONRequest("http://localhost:7002/onboard/issuer", payload)
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).SendString(err.Error())
+		return credentialError(c, err)
 	}
-
-	return c.SendString(result)
+	return c.Status(fiber.StatusCreated).JSON(issuer)
 }
 
 // IssueCredentialFiber handles issuing a credential (Fiber version)
 func IssueCredentialFiber(c *fiber.Ctx) error {
-	var payload map[string]interface{}
-	if err := c.BodyParser(&payload); err != nil {
-		return c.Status(fiber.StatusBadRequest).SendString("Invalid payload")
-	}
-
-	result, err := sendJSONRequest("http://localhost:7002/openid4vc/jwt/issue", payload)
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).SendString(err.Error())
-	}
-
-	offerURL, err := parseOfferURL(result)
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).SendString(fmt.Sprintf("Invalid offer URL: %v", err))
-	}
-
-	resp, err := http.Get(offerURL)
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).SendString(fmt.Sprintf("Failed to fetch credential offer: %v", err))
-	}
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).SendString("Failed to read offer body")
-	}
+	var req issuanceRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid payload"})
+	}
+	if req.IssuerID == "" {
+		offer, err := services.IssueCredential(c.Context(), req.IssuanceRequest)
+		if err != nil {
+			return credentialError(c, err)
+		}
+		recordIssuedCredential(c, nil, req.IssuanceRequest, offer)
+		return c.JSON(offer)
+	}
+
+	if len(req.IssuerKey) > 0 || req.IssuerDID != "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "issuer_id cannot be combined with issuerKey or issuerDid"})
+	}
+	issuer, ok, err := loadIssuer(c, req.IssuerID)
+	if !ok {
+		return err
+	}
+	offer, err := services.IssueCredentialAs(c.Context(), issuer, req.IssuanceRequest)
+	switch {
+	case errors.Is(err, services.ErrIssuerDisabled):
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": err.Error()})
+	case errors.Is(err, services.ErrCredentialTypeNotSupported):
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	case err != nil:
+		return credentialError(c, err)
+	}
+	req.IssuerDID = issuer.DID
+	recordIssuedCredential(c, &issuer.ID, req.IssuanceRequest, offer)
+	return c.JSON(offer)
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return c.Status(fiber.StatusUnauthorized).SendString(fmt.Sprintf("Credential fetch failed: status %d, body: %s", resp.StatusCode, string(body)))
+// recordIssuedCredential keeps a record of the credential against the caller's user, so that it
+// shows up in data exports and is removed on erasure. Callers without a user record, such as
+// service accounts, are skipped; failures are logged rather than failing the issuance.
+func recordIssuedCredential(c *fiber.Ctx, issuerID *gocql.UUID, req oid4vc.IssuanceRequest, offer *oid4vc.CredentialOffer) {
+	user, err := currentUser(c)
+	if err != nil || user == nil {
+		return
+	}
+	rec := &models.IssuedCredential{
+		UserID:                    user.ID,
+		IssuerID:                  issuerID,
+		IssuerDID:                 req.IssuerDID,
+		CredentialIssuer:          offer.CredentialIssuer,
+		CredentialConfigurationID: req.CredentialConfigurationID,
+		CredentialData:            req.CredentialData,
+	}
+	if err := services.RecordIssuedCredential(rec); err != nil {
+		log.Printf("Failed to record issued credential for user %s: %v", user.ID, err)
 	}
-
-	c.Set("Content-Type", "application/json")
-	return c.Send(body)
 }
 
 // VerifyCredentialFiber handles verifying a credential (Fiber version)
 func VerifyCredentialFiber(c *fiber.Ctx) error {
-	var payload map[string]interface{}
-	if err := c.BodyParser(&payload); err != nil {
-		return c.Status(fiber.StatusBadRequest).SendString("Invalid payload")
+	body := c.Body()
+	if !json.Valid(body) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid payload"})
 	}
-
-	result, err := sendJSONRequest("http://localhost:7003/openid4vc/verify", payload)
+	verification, err := services.VerifyCredential(c.Context(), body)
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).SendString(err.Error())
+		return credentialError(c, err)
 	}
-
-	return c.SendString(result)
+	return c.JSON(verification)
 }
 
-// parseOfferURL parses the raw result from credential issuance to extract the valid offer URL.
-func parseOfferURL(raw string) (string, error) {
-	const prefix = "openid-credential-offer://"
-	if !strings.HasPrefix(raw, prefix) {
-		return "", fmt.Errorf("invalid credential offer URI format")
-	}
-	uriPart := strings.TrimPrefix(raw, prefix)
-	u, err := url.Parse("http://" + uriPart) // Add 'http://' for parsing
-	if err != nil {
-		return "", fmt.Errorf("invalid URI: %w", err)
-	}
-
-	// Replace 'host.docker.internal' with 'localhost' if it exists
-	if strings.Contains(u.Host, "host.docker.internal") {
-		u.Host = strings.Replace(u.Host, "host.docker.internal", "localhost", 1)
+// credentialError maps OID4VC client errors to responses. Requests the issuer or verifier
+// rejects are the caller's fault and get its message; anything else is a bad gateway.
+func credentialError(c *fiber.Ctx, err error) error {
+	var upstream *oid4vc.Error
+	if errors.As(err, &upstream) && upstream.StatusCode >= 400 && upstream.StatusCode < 500 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": upstream.Message})
 	}
-
-	query := u.Query().Get("credential_offer_uri")
-	if query == "" {
-		return "", fmt.Errorf("missing credential_offer_uri")
+	log.Printf("OID4VC request failed: %v", err)
+	if errors.Is(err, oid4vc.ErrInvalidOffer) {
+		return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{"error": "Issuer returned an invalid credential offer"})
 	}
-
-	parsedQueryURL, err := url.Parse(query)
-	if err != nil {
-		return "", fmt.Errorf("invalid credential offer URL: %w", err)
-	}
-
-	if strings.Contains(parsedQueryURL.Host, "host.docker.internal") {
-		parsedQueryURL.Host = strings.Replace(parsedQueryURL.Host, "host.docker.internal", "localhost", 1)
-	}
-
-	return parsedQueryURL.String(), nil
+	return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{"error": "Credential service unavailable"})
 }
@@ -0,0 +1,28 @@
+package handlers
+
+import (
+	"errors"
+
+	"go-keycloack/services"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// StartKeyRotationFiber starts re-encrypting PII with the active master key
+func StartKeyRotationFiber(c *fiber.Ctx) error {
+	status, err := services.StartKeyRotation()
+	switch {
+	case errors.Is(err, services.ErrEncryptionDisabled):
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": err.Error()})
+	case errors.Is(err, services.ErrRotationRunning):
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": err.Error(), "status": status})
+	case err != nil:
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to start key rotation"})
+	}
+	return c.Status(fiber.StatusAccepted).JSON(status)
+}
+
+// GetKeyRotationFiber reports the progress of the current or last key rotation
+func GetKeyRotationFiber(c *fiber.Ctx) error {
+	return c.JSON(services.GetKeyRotationStatus())
+}
@@ -0,0 +1,75 @@
+package handlers
+
+import (
+	"errors"
+
+	"go-keycloack/models"
+	"go-keycloack/services"
+	"go-keycloack/utils"
+
+	"github.com/gocql/gocql"
+	"github.com/gofiber/fiber/v2"
+)
+
+// HandleEraseUser starts the right-to-erasure workflow for a user and returns the job to poll.
+func (h *UserHandler) HandleEraseUser(c *fiber.Ctx) error {
+	id, err := gocql.ParseUUID(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid UUID"})
+	}
+	user, err := services.GetUserByIDIncludingDeleted(id)
+	if err != nil || user == nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "User not found"})
+	}
+
+	job, err := services.StartErasure(user, utils.Actor(c))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to start erasure"})
+	}
+	c.Location("/erasure/jobs/" + job.ID.String())
+	return c.Status(fiber.StatusAccepted).JSON(job)
+}
+
+// HandleGetErasureJob returns the status and completed steps of an erasure job.
+func (h *UserHandler) HandleGetErasureJob(c *fiber.Ctx) error {
+	id, err := gocql.ParseUUID(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid UUID"})
+	}
+	job, err := services.GetErasureJob(id)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Erasure job not found"})
+	}
+	return c.JSON(job)
+}
+
+// HandleResumeErasureJob restarts a failed erasure job from its first incomplete step.
+func (h *UserHandler) HandleResumeErasureJob(c *fiber.Ctx) error {
+	id, err := gocql.ParseUUID(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid UUID"})
+	}
+	job, err := services.GetErasureJob(id)
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Erasure job not found"})
+	}
+	if job.Status == models.ErasureStatusCompleted {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Erasure job already completed"})
+	}
+	if err := services.ResumeErasure(id); err != nil {
+		if errors.Is(err, services.ErrErasureInProgress) {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Erasure job is already running"})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to resume erasure"})
+	}
+	return c.Status(fiber.StatusAccepted).JSON(job)
+}
+
+// HandleVerifyErasureTombstones checks that the erasure tombstone chain has not been tampered with.
+func (h *UserHandler) HandleVerifyErasureTombstones(c *fiber.Ctx) error {
+	verified, err := services.VerifyErasureChain()
+	if err != nil {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"valid": false, "verified": verified, "error": err.Error()})
+	}
+	return c.JSON(fiber.Map{"valid": true, "verified": verified})
+}
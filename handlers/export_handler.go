@@ -0,0 +1,46 @@
+package handlers
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"time"
+
+	"go-keycloack/services"
+	"go-keycloack/utils"
+
+	"github.com/gocql/gocql"
+	"github.com/gofiber/fiber/v2"
+)
+
+// HandleExportUser returns a zip archive of everything held about the user (admin or self).
+func (h *UserHandler) HandleExportUser(c *fiber.Ctx) error {
+	id, err := gocql.ParseUUID(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid UUID"})
+	}
+	user, err := services.GetUserByID(id)
+	if err != nil || user == nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "User not found"})
+	}
+	if !canAccessUser(c, user) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Insufficient permissions"})
+	}
+
+	filename := fmt.Sprintf("user-%s-export-%s.zip", id, time.Now().UTC().Format("20060102T150405Z"))
+	c.Set(fiber.HeaderContentType, "application/zip")
+	c.Set(fiber.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", filename))
+	c.Set(fiber.HeaderCacheControl, "no-store")
+
+	// The archive is streamed as it is built, so a failure part way through can only cut the
+	// download short; the missing manifest makes that detectable.
+	level := viewerLevel(c, user)
+	release := utils.HoldSlot(c)
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		defer release()
+		if err := services.ExportUserData(w, user, level); err != nil {
+			log.Printf("Data export for user %s failed: %v", id, err)
+		}
+	})
+	return nil
+}
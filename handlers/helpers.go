@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"fmt"
+
+	"go-keycloack/models"
+	"go-keycloack/services"
+	"go-keycloack/utils"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 500
+)
+
+// parsePaging reads the limit and page_token query parameters used by paged listings.
+func parsePaging(c *fiber.Ctx) (int, []byte, error) {
+	limit := c.QueryInt("limit", defaultPageSize)
+	if limit < 1 || limit > maxPageSize {
+		return 0, nil, fmt.Errorf("limit must be between 1 and %d", maxPageSize)
+	}
+	pageState, err := base64.RawURLEncoding.DecodeString(c.Query("page_token"))
+	if err != nil {
+		return 0, nil, fmt.Errorf("invalid page_token")
+	}
+	return limit, pageState, nil
+}
+
+// encodePageToken turns a Cassandra page state into the page_token returned to clients.
+func encodePageToken(pageState []byte) string {
+	return base64.RawURLEncoding.EncodeToString(pageState)
+}
+
+// isSelf reports whether the caller's token belongs to the given user.
+func isSelf(c *fiber.Ctx, user *models.User) bool {
+	if sub := utils.Subject(c); sub != "" && user.KeycloakID != "" {
+		return sub == user.KeycloakID
+	}
+	username := utils.Username(c)
+	return username != "" && username == user.Username
+}
+
+// canAccessUser reports whether the caller may read the user's private data: admins and the user themselves.
+func canAccessUser(c *fiber.Ctx, user *models.User) bool {
+	return utils.IsAdmin(c) || isSelf(c, user)
+}
+
+// viewerLevel returns the attribute visibility level of the caller for the given user.
+func viewerLevel(c *fiber.Ctx, user *models.User) string {
+	switch {
+	case utils.IsAdmin(c):
+		return models.VisibilityAdmin
+	case isSelf(c, user):
+		return models.VisibilitySelf
+	default:
+		return models.VisibilityPublic
+	}
+}
+
+// presentUser returns a copy of the user with only the custom attributes the caller may see.
+func presentUser(c *fiber.Ctx, user *models.User) *models.User {
+	out := *user
+	out.Attributes = services.VisibleAttributes(user.Attributes, viewerLevel(c, user))
+	return &out
+}
+
+// currentUser returns the user record of the caller.
+func currentUser(c *fiber.Ctx) (*models.User, error) {
+	if sub := utils.Subject(c); sub != "" {
+		if user, err := services.GetUserByKeycloakID(sub); err == nil {
+			return user, nil
+		}
+	}
+	return services.GetUserByUsername(utils.Username(c))
+}
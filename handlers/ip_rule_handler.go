@@ -0,0 +1,115 @@
+package handlers
+
+import (
+	"errors"
+	"time"
+
+	"go-keycloack/models"
+	"go-keycloack/services"
+	"go-keycloack/utils"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// ipRuleRequest is the body of IP rule create and update requests. Expiry is given either as
+// an absolute expires_at or as a ttl duration such as "24h".
+type ipRuleRequest struct {
+	Group     string     `json:"group"`
+	CIDR      string     `json:"cidr"`
+	Action    string     `json:"action"`
+	Comment   string     `json:"comment"`
+	ExpiresAt *time.Time `json:"expires_at"`
+	TTL       string     `json:"ttl"`
+}
+
+func (req *ipRuleRequest) apply(rule *models.IPRule) error {
+	rule.Group = req.Group
+	rule.CIDR = req.CIDR
+	rule.Action = req.Action
+	rule.Comment = req.Comment
+	rule.ExpiresAt = req.ExpiresAt
+	if req.TTL != "" {
+		ttl, err := time.ParseDuration(req.TTL)
+		if err != nil || ttl <= 0 {
+			return errors.New("ttl must be a positive duration")
+		}
+		expiresAt := time.Now().UTC().Add(ttl)
+		rule.ExpiresAt = &expiresAt
+	}
+	return nil
+}
+
+// ListIPRulesFiber returns every IP allow and deny rule (admin)
+func ListIPRulesFiber(c *fiber.Ctx) error {
+	rules, err := services.ListIPRules(c.Context())
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to load IP rules"})
+	}
+	return c.JSON(rules)
+}
+
+// GetIPRuleFiber returns a single IP rule (admin)
+func GetIPRuleFiber(c *fiber.Ctx) error {
+	rule, err := services.GetIPRule(c.Context(), c.Params("id"))
+	if errors.Is(err, services.ErrIPRuleNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to load IP rule"})
+	}
+	return c.JSON(rule)
+}
+
+// CreateIPRuleFiber adds an IP rule, effective on every instance immediately (admin)
+func CreateIPRuleFiber(c *fiber.Ctx) error {
+	var req ipRuleRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request payload"})
+	}
+	rule := &models.IPRule{CreatedBy: utils.Actor(c)}
+	if err := req.apply(rule); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err := services.SaveIPRule(c.Context(), rule); err != nil {
+		return ipRuleError(c, err)
+	}
+	return c.Status(fiber.StatusCreated).JSON(rule)
+}
+
+// UpdateIPRuleFiber replaces an IP rule (admin)
+func UpdateIPRuleFiber(c *fiber.Ctx) error {
+	var req ipRuleRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request payload"})
+	}
+	rule, err := services.GetIPRule(c.Context(), c.Params("id"))
+	if err != nil {
+		return ipRuleError(c, err)
+	}
+	if err := req.apply(rule); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err := services.SaveIPRule(c.Context(), rule); err != nil {
+		return ipRuleError(c, err)
+	}
+	return c.JSON(rule)
+}
+
+// DeleteIPRuleFiber removes an IP rule (admin)
+func DeleteIPRuleFiber(c *fiber.Ctx) error {
+	if err := services.DeleteIPRule(c.Context(), c.Params("id")); err != nil {
+		return ipRuleError(c, err)
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func ipRuleError(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, services.ErrIPRuleNotFound):
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": err.Error()})
+	case errors.Is(err, services.ErrInvalidIPRule):
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	default:
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to save IP rule"})
+	}
+}
@@ -0,0 +1,92 @@
+package handlers
+
+import (
+	"errors"
+	"time"
+
+	"go-keycloack/models"
+	"go-keycloack/services"
+	"go-keycloack/utils"
+
+	"github.com/gocql/gocql"
+	"github.com/gofiber/fiber/v2"
+)
+
+// canManageIssuer reports whether the caller may see and use the issuer: its owner or an admin.
+func canManageIssuer(c *fiber.Ctx, issuer *models.Issuer) bool {
+	return utils.IsAdmin(c) || (issuer.Owner != "" && issuer.Owner == utils.Subject(c))
+}
+
+// loadIssuer looks up an issuer the caller may manage. It reports false, with the response
+// already written, when the request must not go on.
+func loadIssuer(c *fiber.Ctx, rawID string) (*models.Issuer, bool, error) {
+	id, err := gocql.ParseUUID(rawID)
+	if err != nil {
+		return nil, false, c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid UUID"})
+	}
+	issuer, err := services.GetIssuer(id)
+	if errors.Is(err, services.ErrIssuerNotFound) {
+		return nil, false, c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err != nil {
+		return nil, false, c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to load issuer"})
+	}
+	if !canManageIssuer(c, issuer) {
+		return nil, false, c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Insufficient permissions"})
+	}
+	return issuer, true, nil
+}
+
+// ListIssuersFiber returns the caller's issuers, or every issuer for admins (?owner= narrows it down)
+func ListIssuersFiber(c *fiber.Ctx) error {
+	owner := utils.Subject(c)
+	if utils.IsAdmin(c) {
+		owner = c.Query("owner")
+	}
+	issuers, err := services.ListIssuers(owner)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to load issuers"})
+	}
+	return c.JSON(issuers)
+}
+
+// GetIssuerFiber returns a single issuer (owner or admin)
+func GetIssuerFiber(c *fiber.Ctx) error {
+	issuer, ok, err := loadIssuer(c, c.Params("id"))
+	if !ok {
+		return err
+	}
+	return c.JSON(issuer)
+}
+
+// DisableIssuerFiber stops an issuer from issuing credentials (owner or admin)
+func DisableIssuerFiber(c *fiber.Ctx) error {
+	issuer, ok, err := loadIssuer(c, c.Params("id"))
+	if !ok {
+		return err
+	}
+	if err := services.DisableIssuer(issuer.ID); err != nil {
+		if errors.Is(err, services.ErrIssuerNotFound) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to disable issuer"})
+	}
+	issuer.Status = models.IssuerStatusDisabled
+	issuer.UpdatedAt = time.Now().UTC()
+	return c.JSON(issuer)
+}
+
+// DeleteIssuerFiber removes an issuer and its key material (owner or admin)
+func DeleteIssuerFiber(c *fiber.Ctx) error {
+	issuer, ok, err := loadIssuer(c, c.Params("id"))
+	if !ok {
+		return err
+	}
+	if err := services.DeleteIssuer(issuer.ID); err != nil {
+		if errors.Is(err, services.ErrIssuerNotFound) {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": err.Error()})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to delete issuer"})
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"strconv"
+	"time"
+
+	"go-keycloack/challenge"
+	"go-keycloack/models"
+	"go-keycloack/ratelimit"
+	"go-keycloack/services"
+	"go-keycloack/utils"
+
+	"github.com/gocql/gocql"
+	"github.com/gofiber/fiber/v2"
+)
+
+// tooManyLoginAttempts rejects a login during a backoff or lockout. The response is the same
+// whether or not the username exists.
+func tooManyLoginAttempts(c *fiber.Ctx, wait time.Duration) error {
+	c.Set(fiber.HeaderRetryAfter, strconv.FormatInt(max(ratelimit.Seconds(wait), 1), 10))
+	return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{"error": "Too many failed login attempts. Please try again later."})
+}
+
+// verifyLoginChallenge checks the answer to a login challenge. When it is missing or wrong, it
+// responds 401 with a fresh challenge and returns false; the returned error is the response.
+func verifyLoginChallenge(c *fiber.Ctx, response string) (bool, error) {
+	if response != "" {
+		err := services.VerifyLoginChallenge(c.Context(), response, utils.ClientIP(c))
+		if err == nil {
+			return true, nil
+		}
+		if !errors.Is(err, challenge.ErrInvalid) {
+			log.Printf("Login challenge verification failed: %v", err)
+			return false, c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{"error": "Challenge verification unavailable"})
+		}
+	}
+	next, err := services.IssueLoginChallenge(c.Context())
+	if err != nil {
+		log.Printf("Failed to issue login challenge: %v", err)
+		return false, c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{"error": "Challenge verification unavailable"})
+	}
+	return false, c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Challenge required", "challenge": next})
+}
+
+// HandleGetLoginChallenge issues a challenge ahead of a login attempt, so clients that expect
+// one can solve it up front.
+func (h *UserHandler) HandleGetLoginChallenge(c *fiber.Ctx) error {
+	if !services.LoginChallengeEnabled() {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Login challenges are not enabled"})
+	}
+	next, err := services.IssueLoginChallenge(c.Context())
+	if err != nil {
+		log.Printf("Failed to issue login challenge: %v", err)
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{"error": "Challenge verification unavailable"})
+	}
+	return c.JSON(next)
+}
+
+// HandleUnlockUser clears the failed-login counters and lockout of a user (admin). An IP
+// lockout can be lifted at the same time with ?ip=.
+func (h *UserHandler) HandleUnlockUser(c *fiber.Ctx) error {
+	id, err := gocql.ParseUUID(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid UUID"})
+	}
+	user, err := services.GetUserByIDIncludingDeleted(id)
+	if err != nil || user == nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "User not found"})
+	}
+
+	if err := services.ResetLoginFailures(c.Context(), user.Username); err != nil {
+		log.Printf("Failed to unlock user %s: %v", id, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Unlock failed"})
+	}
+	changes := map[string]models.FieldChange{}
+	if ip := c.Query("ip"); ip != "" {
+		if err := services.ResetLoginFailuresForIP(c.Context(), ip); err != nil {
+			log.Printf("Failed to unlock IP %s: %v", ip, err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Unlock failed"})
+		}
+		changes["ip"] = models.FieldChange{Before: ip, After: nil}
+	}
+	recordAudit(c, models.AuditActionUnlock, id, "", changes)
+	return c.SendStatus(fiber.StatusNoContent)
+}
@@ -0,0 +1,79 @@
+package handlers
+
+import (
+	"log"
+	"time"
+
+	"go-keycloack/models"
+	"go-keycloack/services"
+	"go-keycloack/utils"
+
+	"github.com/gocql/gocql"
+	"github.com/gofiber/fiber/v2"
+)
+
+// recordLoginAttempt stores the outcome of a login. Failures are logged rather than returned so
+// that history keeping never blocks a login.
+func recordLoginAttempt(c *fiber.Ctx, username string, user *models.User, success bool, sessionID string) {
+	attempt := &models.LoginAttempt{
+		Username:    username,
+		AttemptedAt: time.Now().UTC(),
+		Success:     success,
+		IP:          utils.ClientIP(c),
+		UserAgent:   c.Get(fiber.HeaderUserAgent),
+		SessionID:   sessionID,
+	}
+	if user != nil {
+		attempt.UserID = user.ID
+	}
+	if err := services.RecordLoginAttempt(attempt); err != nil {
+		log.Printf("Failed to record login attempt for %s: %v", username, err)
+	}
+	if success && user != nil {
+		if err := services.RecordSuccessfulLogin(user, attempt.AttemptedAt); err != nil {
+			log.Printf("Failed to update last login for user %s: %v", user.ID, err)
+		}
+	}
+}
+
+// HandleGetUserLogins returns a page of the user's login history (admin or self).
+func (h *UserHandler) HandleGetUserLogins(c *fiber.Ctx) error {
+	id, err := gocql.ParseUUID(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid UUID"})
+	}
+	user, err := services.GetUserByID(id)
+	if err != nil || user == nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "User not found"})
+	}
+	if !canAccessUser(c, user) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Insufficient permissions"})
+	}
+	return sendLoginHistory(c, user)
+}
+
+// HandleGetMyLogins returns a page of the caller's own login history.
+func (h *UserHandler) HandleGetMyLogins(c *fiber.Ctx) error {
+	user, err := currentUser(c)
+	if err != nil || user == nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "User not found"})
+	}
+	return sendLoginHistory(c, user)
+}
+
+func sendLoginHistory(c *fiber.Ctx, user *models.User) error {
+	limit, pageState, err := parsePaging(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	attempts, next, err := services.ListLoginHistory(user.ID, limit, pageState)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch login history"})
+	}
+	return c.JSON(fiber.Map{
+		"last_login_at":   user.LastLoginAt,
+		"login_count":     user.LoginCount,
+		"logins":          attempts,
+		"next_page_token": encodePageToken(next),
+	})
+}
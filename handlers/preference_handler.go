@@ -0,0 +1,112 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"go-keycloack/services"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// preferenceTimestamp returns the write time for a preference change: the optional ?timestamp=
+// (RFC 3339) sent by clients that queue changes offline, or now.
+func preferenceTimestamp(c *fiber.Ctx) (time.Time, error) {
+	v := c.Query("timestamp")
+	if v == "" {
+		return time.Now().UTC(), nil
+	}
+	at, err := time.Parse(time.RFC3339Nano, v)
+	if err != nil {
+		return time.Time{}, errors.New("Invalid timestamp, expected RFC 3339")
+	}
+	if at.After(time.Now().Add(services.MaxPreferenceClockSkew)) {
+		return time.Time{}, errors.New("timestamp is in the future")
+	}
+	return at, nil
+}
+
+func preferenceError(c *fiber.Ctx, err error) error {
+	if errors.Is(err, services.ErrPreferenceValidation) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to access preferences"})
+}
+
+// HandleListMyPreferenceNamespaces returns the namespaces in which the caller has preferences.
+func (h *UserHandler) HandleListMyPreferenceNamespaces(c *fiber.Ctx) error {
+	user, err := currentUser(c)
+	if err != nil || user == nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "User not found"})
+	}
+	namespaces, err := services.ListPreferenceNamespaces(user.ID)
+	if err != nil {
+		return preferenceError(c, err)
+	}
+	return c.JSON(fiber.Map{"namespaces": namespaces})
+}
+
+// HandleGetMyPreferences returns the caller's preferences in a namespace.
+func (h *UserHandler) HandleGetMyPreferences(c *fiber.Ctx) error {
+	user, err := currentUser(c)
+	if err != nil || user == nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "User not found"})
+	}
+	prefs, err := services.GetPreferences(user.ID, c.Params("namespace"))
+	if err != nil {
+		return preferenceError(c, err)
+	}
+	return c.JSON(prefs)
+}
+
+// HandlePutMyPreferences replaces the caller's preferences in a namespace with the request body.
+func (h *UserHandler) HandlePutMyPreferences(c *fiber.Ctx) error {
+	return h.writeMyPreferences(c, true)
+}
+
+// HandlePatchMyPreferences merges the request body into the caller's preferences; null removes a key.
+func (h *UserHandler) HandlePatchMyPreferences(c *fiber.Ctx) error {
+	return h.writeMyPreferences(c, false)
+}
+
+func (h *UserHandler) writeMyPreferences(c *fiber.Ctx, replace bool) error {
+	user, err := currentUser(c)
+	if err != nil || user == nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "User not found"})
+	}
+	var values map[string]json.RawMessage
+	if err := json.Unmarshal(c.Body(), &values); err != nil || values == nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Request body must be a JSON object"})
+	}
+	at, err := preferenceTimestamp(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	prefs, err := services.SetPreferences(user.ID, c.Params("namespace"), values, replace, at)
+	if err != nil {
+		return preferenceError(c, err)
+	}
+	return c.JSON(prefs)
+}
+
+// HandleDeleteMyPreferences removes a whole namespace, or a single key when :key is given.
+func (h *UserHandler) HandleDeleteMyPreferences(c *fiber.Ctx) error {
+	user, err := currentUser(c)
+	if err != nil || user == nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "User not found"})
+	}
+	at, err := preferenceTimestamp(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if key := c.Params("key"); key != "" {
+		err = services.DeletePreference(user.ID, c.Params("namespace"), key, at)
+	} else {
+		err = services.DeletePreferenceNamespace(user.ID, c.Params("namespace"), at)
+	}
+	if err != nil {
+		return preferenceError(c, err)
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
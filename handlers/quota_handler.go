@@ -0,0 +1,77 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+
+	"go-keycloack/models"
+	"go-keycloack/services"
+	"go-keycloack/utils"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// HandleGetMyQuota reports the caller's quota tier and remaining daily and monthly budgets.
+func (h *UserHandler) HandleGetMyQuota(c *fiber.Ctx) error {
+	if !services.QuotasEnabled() {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": services.ErrQuotasDisabled.Error()})
+	}
+	subject := utils.Subject(c)
+	tier, override, err := services.EffectiveQuota(c.Context(), subject, services.QuotaTierFor(utils.Claims(c)))
+	if err != nil {
+		log.Printf("Failed to load quota for %s: %v", subject, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to load quota"})
+	}
+	usage, err := services.GetQuotaUsage(c.Context(), subject, tier, override)
+	if err != nil {
+		log.Printf("Failed to load quota usage for %s: %v", subject, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to load quota"})
+	}
+	return c.JSON(usage)
+}
+
+// GetQuotaFiber reports a subject's override and usage (admin). The subject is a token subject
+// or, for anonymous callers, an IP. Its token is not known here, so usage is measured against
+// the override's tier or the default tier.
+func GetQuotaFiber(c *fiber.Ctx) error {
+	if !services.QuotasEnabled() {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": services.ErrQuotasDisabled.Error()})
+	}
+	subject := c.Params("subject")
+	tier, override, err := services.EffectiveQuota(c.Context(), subject, services.DefaultQuotaTier())
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to load quota"})
+	}
+	usage, err := services.GetQuotaUsage(c.Context(), subject, tier, override)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to load quota"})
+	}
+	return c.JSON(usage)
+}
+
+// PutQuotaOverrideFiber sets a subject's quota override (admin)
+func PutQuotaOverrideFiber(c *fiber.Ctx) error {
+	var override models.QuotaOverride
+	if err := c.BodyParser(&override); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request payload"})
+	}
+	override.CreatedBy = utils.Actor(c)
+	err := services.SetQuotaOverride(c.Context(), c.Params("subject"), &override)
+	switch {
+	case errors.Is(err, services.ErrQuotasDisabled):
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": err.Error()})
+	case errors.Is(err, services.ErrInvalidQuotaOverride):
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	case err != nil:
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to save quota override"})
+	}
+	return c.JSON(override)
+}
+
+// DeleteQuotaOverrideFiber removes a subject's quota override (admin)
+func DeleteQuotaOverrideFiber(c *fiber.Ctx) error {
+	if err := services.DeleteQuotaOverride(c.Context(), c.Params("subject")); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to delete quota override"})
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
@@ -0,0 +1,156 @@
+package handlers
+
+import (
+	"log"
+	"time"
+
+	"go-keycloack/config"
+	"go-keycloack/middleware"
+	"go-keycloack/ratelimit"
+	"go-keycloack/utils"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// GetRateLimitPoliciesFiber lists the rate limit rules currently in force
+func GetRateLimitPoliciesFiber(c *fiber.Ctx) error {
+	set := middleware.RateLimitPolicies()
+	rules := make([]fiber.Map, 0, len(set.Rules))
+	for i := range set.Rules {
+		rules = append(rules, presentRateLimitRule(&set.Rules[i]))
+	}
+	return c.JSON(fiber.Map{"default": presentRateLimitRule(&set.Default), "rules": rules})
+}
+
+// ReloadRateLimitPoliciesFiber re-reads the rate limit policy file without a restart
+func ReloadRateLimitPoliciesFiber(c *fiber.Ctx) error {
+	if err := middleware.ReloadRateLimitPolicies(); err != nil {
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{"error": err.Error()})
+	}
+	return GetRateLimitPoliciesFiber(c)
+}
+
+func presentRateLimitRule(rule *ratelimit.Rule) fiber.Map {
+	return fiber.Map{
+		"name":         rule.Name,
+		"path":         rule.Pattern,
+		"methods":      rule.Methods,
+		"algorithm":    rule.Algorithm,
+		"limit":        rule.Limit,
+		"window":       rule.Window.String(),
+		"burst":        rule.Burst,
+		"key":          rule.Key,
+		"exempt_roles": rule.ExemptRoles,
+	}
+}
+
+// GetRateLimitSubjectFiber shows a subject's buckets under every rule and its override, if any
+// (admin). The subject is what the policy keys on: a token subject, IP, "client:<azp>" or
+// "apikey:<hash>".
+func GetRateLimitSubjectFiber(c *fiber.Ctx) error {
+	subject := c.Params("subject")
+	limiter := ratelimit.New(config.Valkey)
+	buckets, err := limiter.Buckets(c.Context(), subject)
+	if err != nil {
+		log.Printf("Failed to inspect rate limits for %s: %v", subject, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to inspect rate limits"})
+	}
+	override, err := limiter.GetOverride(c.Context(), subject)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to inspect rate limits"})
+	}
+
+	views := make([]fiber.Map, 0, len(buckets))
+	for _, b := range buckets {
+		views = append(views, fiber.Map{
+			"rule":              b.Rule,
+			"algorithm":         b.Algorithm,
+			"requests":          b.Requests,
+			"oldest_request_at": b.OldestRequestAt,
+			"newest_request_at": b.NewestRequestAt,
+			"tokens":            b.Tokens,
+			"refilled_at":       b.RefilledAt,
+			"resets_in":         b.ExpiresIn.String(),
+		})
+	}
+	return c.JSON(fiber.Map{"subject": subject, "buckets": views, "override": presentRateLimitOverride(override)})
+}
+
+// ResetRateLimitSubjectFiber clears a subject's bucket for the ?rule= name, or all of its buckets
+// (admin)
+func ResetRateLimitSubjectFiber(c *fiber.Ctx) error {
+	subject := c.Params("subject")
+	removed, err := ratelimit.New(config.Valkey).Reset(c.Context(), subject, c.Query("rule"))
+	if err != nil {
+		log.Printf("Failed to reset rate limits for %s: %v", subject, err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to reset rate limits"})
+	}
+	return c.JSON(fiber.Map{"subject": subject, "removed": removed})
+}
+
+// PutRateLimitOverrideFiber temporarily replaces a subject's limits on every policy (admin)
+func PutRateLimitOverrideFiber(c *fiber.Ctx) error {
+	var req struct {
+		Limit     int        `json:"limit"`
+		Window    string     `json:"window"`
+		Burst     *int       `json:"burst"`
+		TTL       string     `json:"ttl"`
+		ExpiresAt *time.Time `json:"expires_at"`
+		Reason    string     `json:"reason"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request payload"})
+	}
+	override := ratelimit.Override{Limit: req.Limit, Burst: req.Burst, Reason: req.Reason, CreatedBy: utils.Actor(c)}
+	if req.Limit < 0 || (req.Burst != nil && *req.Burst < 0) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "limit and burst must not be negative"})
+	}
+	if req.Window != "" {
+		window, err := time.ParseDuration(req.Window)
+		if err != nil || window <= 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "window must be a positive duration"})
+		}
+		override.Window = window
+	}
+	switch {
+	case req.TTL != "":
+		ttl, err := time.ParseDuration(req.TTL)
+		if err != nil || ttl <= 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "ttl must be a positive duration"})
+		}
+		override.ExpiresAt = time.Now().Add(ttl)
+	case req.ExpiresAt != nil:
+		override.ExpiresAt = *req.ExpiresAt
+	default:
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Overrides are temporary; set ttl or expires_at"})
+	}
+	if err := ratelimit.New(config.Valkey).SetOverride(c.Context(), c.Params("subject"), override); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(presentRateLimitOverride(&override))
+}
+
+// DeleteRateLimitOverrideFiber removes a subject's override (admin)
+func DeleteRateLimitOverrideFiber(c *fiber.Ctx) error {
+	if err := ratelimit.New(config.Valkey).DeleteOverride(c.Context(), c.Params("subject")); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to delete override"})
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func presentRateLimitOverride(o *ratelimit.Override) fiber.Map {
+	if o == nil {
+		return nil
+	}
+	view := fiber.Map{
+		"limit":      o.Limit,
+		"burst":      o.Burst,
+		"reason":     o.Reason,
+		"created_by": o.CreatedBy,
+		"expires_at": o.ExpiresAt.UTC(),
+	}
+	if o.Window > 0 {
+		view["window"] = o.Window.String()
+	}
+	return view
+}
@@ -0,0 +1,82 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"slices"
+
+	"go-keycloack/models"
+	"go-keycloack/services"
+
+	"github.com/gocql/gocql"
+	"github.com/gofiber/fiber/v2"
+)
+
+// roleChangeRequest lists the realm roles to grant and to revoke.
+type roleChangeRequest struct {
+	Add    []string `json:"add"`
+	Remove []string `json:"remove"`
+}
+
+// HandleGetUserRoles returns the realm roles mapped directly to the user (admin)
+func (h *UserHandler) HandleGetUserRoles(c *fiber.Ctx) error {
+	id, err := gocql.ParseUUID(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid UUID"})
+	}
+	user, err := services.GetUserByID(id)
+	if err != nil || user == nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "User not found"})
+	}
+	roles, err := services.GetUserRoles(user)
+	if errors.Is(err, services.ErrKeycloakNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "User not found in Keycloak"})
+	}
+	if err != nil {
+		log.Printf("Failed to load roles of user %s: %v", id, err)
+		return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{"error": "Failed to load roles"})
+	}
+	return c.JSON(fiber.Map{"roles": roles})
+}
+
+// HandleUpdateUserRoles grants and revokes realm roles and records the change in the audit trail (admin)
+func (h *UserHandler) HandleUpdateUserRoles(c *fiber.Ctx) error {
+	id, err := gocql.ParseUUID(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid UUID"})
+	}
+	var req roleChangeRequest
+	if err := c.BodyParser(&req); err != nil || len(req.Add)+len(req.Remove) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "add or remove is required"})
+	}
+	for _, role := range req.Add {
+		if slices.Contains(req.Remove, role) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Role " + role + " is both added and removed"})
+		}
+	}
+	user, err := services.GetUserByID(id)
+	if err != nil || user == nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "User not found"})
+	}
+
+	before, after, err := services.UpdateUserRoles(user, req.Add, req.Remove)
+	if errors.Is(err, services.ErrKeycloakNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "User or role not found in Keycloak"})
+	}
+	if err != nil {
+		log.Printf("Failed to update roles of user %s: %v", id, err)
+		return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{"error": "Failed to update roles"})
+	}
+	if !slices.Equal(sortedCopy(before), sortedCopy(after)) {
+		recordAudit(c, models.AuditActionRoleChange, id, "", map[string]models.FieldChange{
+			"roles": {Before: before, After: after},
+		})
+	}
+	return c.JSON(fiber.Map{"roles": after})
+}
+
+func sortedCopy(s []string) []string {
+	s = slices.Clone(s)
+	slices.Sort(s)
+	return s
+}
@@ -4,12 +4,16 @@ import (
 	"bytes"
 	"encoding/json"
 	"io"
+	"log"
 	"net/http"
 	"net/url"
 	"os"
+	"path"
+	"strings"
 
 	"go-keycloack/models"
 	"go-keycloack/services"
+	"go-keycloack/utils"
 
 	"github.com/go-playground/validator/v10"
 	"github.com/gocql/gocql"
@@ -26,12 +30,28 @@ func (h *UserHandler) HandleLogin(c *fiber.Ctx) error {
 		Password  string `json:"password"`
 		FirstName string `json:"firstname"`
 		LastName  string `json:"lastname"`
+		// ChallengeResponse answers the challenge demanded after repeated failures
+		ChallengeResponse string `json:"challenge_response"`
 	}
 	var loginReq LoginRequest
-	if err := c.BodyParser(&loginReq); err != nil {
+	if err := c.BodyParser(&loginReq); err != nil || loginReq.Username == "" {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request payload"})
 	}
 
+	// Refuse attempts during a backoff or lockout, and demand a solved challenge after repeated
+	// failures, before Keycloak sees the password
+	if check, err := services.CheckLogin(c.Context(), loginReq.Username, utils.ClientIP(c)); err != nil {
+		log.Printf("Failed to check login lockout for %s: %v", loginReq.Username, err)
+		c.Set(fiber.HeaderRetryAfter, "5")
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{"error": "Service temporarily unavailable"})
+	} else if check.Wait > 0 {
+		return tooManyLoginAttempts(c, check.Wait)
+	} else if check.ChallengeRequired {
+		if ok, err := verifyLoginChallenge(c, loginReq.ChallengeResponse); !ok {
+			return err
+		}
+	}
+
 	keycloakBaseURL := os.Getenv("KEYCLOAK_BASE_URL")
 	if keycloakBaseURL == "" {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "KEYCLOAK_BASE_URL not set"})
@@ -57,9 +77,21 @@ func (h *UserHandler) HandleLogin(c *fiber.Ctx) error {
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{"error": "Authentication service unavailable"})
+	}
 	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Keycloak error: " + string(body)})
+		// Keycloak answers unknown users, wrong passwords and disabled accounts differently; all of
+		// them get the same response so that it does not reveal which usernames exist.
+		known, _ := services.GetUserByUsernameIncludingDeleted(loginReq.Username)
+		recordLoginAttempt(c, loginReq.Username, known, false, "")
+		if _, err := services.RecordLoginFailure(c.Context(), loginReq.Username, utils.ClientIP(c)); err != nil {
+			log.Printf("Failed to record login failure for %s: %v", loginReq.Username, err)
+		}
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid username or password"})
+	}
+	if err := services.ResetLoginFailures(c.Context(), loginReq.Username); err != nil {
+		log.Printf("Failed to reset login failures for %s: %v", loginReq.Username, err)
 	}
 
 	var tokenResponse map[string]interface{}
@@ -68,25 +100,38 @@ func (h *UserHandler) HandleLogin(c *fiber.Ctx) error {
 	}
 
 	// Ensure user exists in Cassandra (create if not)
-	user, err := services.GetUserByUsername(loginReq.Username)
+	user, err := services.GetUserByUsernameIncludingDeleted(loginReq.Username)
+	if err == nil && user.IsDeleted() {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Account has been deleted"})
+	}
 	if err != nil || user == nil {
 		// Create user in Cassandra
 		user = &models.User{Username: loginReq.Username, FirstName: loginReq.FirstName, LastName: loginReq.LastName}
+		if accessToken, ok := tokenResponse["access_token"].(string); ok {
+			if claims, err := utils.ParseJWT(accessToken); err == nil {
+				user.KeycloakID, _ = claims["sub"].(string)
+			}
+		}
 		if err := services.CreateUser(user); err != nil {
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to create user in Cassandra"})
 		}
+		recordAudit(c, models.AuditActionCreate, user.ID, user.Username, services.DiffUsers(nil, user))
 	}
+	recordAudit(c, models.AuditActionLogin, user.ID, user.Username, nil)
+	sessionID, _ := tokenResponse["session_state"].(string)
+	recordLoginAttempt(c, loginReq.Username, user, true, sessionID)
 
 	return c.JSON(tokenResponse)
 }
 
 func (h *UserHandler) HandleUserCreation(c *fiber.Ctx) error {
 	type UserCreationRequest struct {
-		Username  string `json:"username" validate:"required,min=3,max=32"`
-		Password  string `json:"password" validate:"required,min=6"`
-		Email     string `json:"email" validate:"required,email"`
-		FirstName string `json:"firstname" validate:"required,min=1,max=50"`
-		LastName  string `json:"lastname" validate:"required,min=1,max=50"`
+		Username   string                 `json:"username" validate:"required,min=3,max=32"`
+		Password   string                 `json:"password" validate:"required,min=6"`
+		Email      string                 `json:"email" validate:"required,email"`
+		FirstName  string                 `json:"firstname" validate:"required,min=1,max=50"`
+		LastName   string                 `json:"lastname" validate:"required,min=1,max=50"`
+		Attributes map[string]interface{} `json:"attributes"`
 	}
 	var userReq UserCreationRequest
 	if err := c.BodyParser(&userReq); err != nil {
@@ -98,9 +143,16 @@ func (h *UserHandler) HandleUserCreation(c *fiber.Ctx) error {
 	if err := validate.Struct(userReq); err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
 	}
+	attributes, err := services.ValidateAttributes(userReq.Attributes, models.VisibilitySelf)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if missing := services.MissingRequiredAttributes(attributes, models.VisibilitySelf); len(missing) > 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Missing required attributes", "attributes": missing})
+	}
 
 	// Get admin token for Keycloak
-	adminToken, err := getKeycloakAdminToken()
+	adminToken, err := services.GetKeycloakAdminToken()
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to get admin token: " + err.Error()})
 	}
@@ -110,11 +162,12 @@ func (h *UserHandler) HandleUserCreation(c *fiber.Ctx) error {
 	usersURL := keycloakBaseURL + "/admin/realms/" + realm + "/users"
 
 	userBody := map[string]interface{}{
-		"username":  userReq.Username,
-		"email":     userReq.Email,
-		"enabled":   true,
-		"firstName": userReq.FirstName,
-		"lastName":  userReq.LastName,
+		"username":   userReq.Username,
+		"email":      userReq.Email,
+		"enabled":    true,
+		"firstName":  userReq.FirstName,
+		"lastName":   userReq.LastName,
+		"attributes": services.KeycloakAttributes(attributes),
 		"credentials": []map[string]interface{}{
 			{"type": "password", "value": userReq.Password, "temporary": false},
 		},
@@ -140,53 +193,19 @@ func (h *UserHandler) HandleUserCreation(c *fiber.Ctx) error {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Failed to create user in Keycloak: " + string(body)})
 	}
 
-	// Create user in Cassandra
-	user := &models.User{Username: userReq.Username, Email: userReq.Email, FirstName: userReq.FirstName, LastName: userReq.LastName}
+	// Create user in Cassandra, keeping the Keycloak ID from the Location header
+	user := &models.User{Username: userReq.Username, Email: userReq.Email, FirstName: userReq.FirstName, LastName: userReq.LastName, Attributes: attributes}
+	if location := resp.Header.Get("Location"); location != "" {
+		user.KeycloakID = path.Base(location)
+	}
 	if err := services.CreateUser(user); err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "User created in Keycloak but failed in Cassandra"})
 	}
+	recordAudit(c, models.AuditActionCreate, user.ID, "", services.DiffUsers(nil, user))
 
 	return c.Status(fiber.StatusCreated).JSON(fiber.Map{"message": "User registered successfully"})
 }
 
-// Helper to get Keycloak admin token
-func getKeycloakAdminToken() (string, error) {
-	keycloakBaseURL := os.Getenv("KEYCLOAK_BASE_URL")
-	realm := os.Getenv("REALM")
-	clientID := os.Getenv("CLIENT_ID")
-	clientSecret := os.Getenv("CLIENT_SECRET")
-	adminUser := os.Getenv("ADMIN_USERNAME")
-	adminPass := os.Getenv("ADMIN_PASSWORD")
-	if keycloakBaseURL == "" || realm == "" || clientID == "" || clientSecret == "" || adminUser == "" || adminPass == "" {
-		return "", fiber.NewError(fiber.StatusInternalServerError, "Missing Keycloak admin credentials")
-	}
-	tokenURL := keycloakBaseURL + "/realms/" + realm + "/protocol/openid-connect/token"
-	data := url.Values{}
-	data.Set("client_id", clientID)
-	data.Set("client_secret", clientSecret)
-	data.Set("grant_type", "password")
-	data.Set("username", adminUser)
-	data.Set("password", adminPass)
-	resp, err := http.Post(tokenURL, "application/x-www-form-urlencoded", bytes.NewBufferString(data.Encode()))
-	if err != nil {
-		return "", err
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return "", fiber.NewError(fiber.StatusUnauthorized, string(body))
-	}
-	var tokenResp map[string]interface{}
-	if err := json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
-		return "", err
-	}
-	token, ok := tokenResp["access_token"].(string)
-	if !ok {
-		return "", fiber.NewError(fiber.StatusInternalServerError, "No access_token in response")
-	}
-	return token, nil
-}
-
 func (h *UserHandler) HandleGetUser(c *fiber.Ctx) error {
 	idParam := c.Params("id")
 	id, err := gocql.ParseUUID(idParam)
@@ -197,7 +216,7 @@ func (h *UserHandler) HandleGetUser(c *fiber.Ctx) error {
 	if err != nil || user == nil {
 		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "User not found"})
 	}
-	return c.JSON(user)
+	return c.JSON(presentUser(c, user))
 }
 
 func (h *UserHandler) HandleUpdateUser(c *fiber.Ctx) error {
@@ -206,14 +225,53 @@ func (h *UserHandler) HandleUpdateUser(c *fiber.Ctx) error {
 	if err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid UUID"})
 	}
-	var user models.User
-	if err := c.BodyParser(&user); err != nil {
+	before, err := services.GetUserByID(id)
+	if err != nil || before == nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "User not found"})
+	}
+	if !canAccessUser(c, before) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Insufficient permissions"})
+	}
+	type UserUpdateRequest struct {
+		Username   string                 `json:"username"`
+		Email      string                 `json:"email"`
+		FirstName  string                 `json:"firstname"`
+		LastName   string                 `json:"lastname"`
+		Attributes map[string]interface{} `json:"attributes"`
+	}
+	var userReq UserUpdateRequest
+	if err := c.BodyParser(&userReq); err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid input"})
 	}
+	user := *before
+	user.Username, user.Email, user.FirstName, user.LastName = userReq.Username, userReq.Email, userReq.FirstName, userReq.LastName
+
+	// Attributes are only replaced when sent; those the caller cannot change are kept as they are
+	if userReq.Attributes != nil {
+		level := viewerLevel(c, before)
+		attributes, err := services.ValidateAttributes(userReq.Attributes, level)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+		user.Attributes = services.MergeAttributes(before.Attributes, attributes, level)
+		if missing := services.MissingRequiredAttributes(user.Attributes, level); len(missing) > 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Missing required attributes", "attributes": missing})
+		}
+	}
+
 	if err := services.UpdateUser(id, &user); err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Update failed"})
 	}
-	return c.JSON(user)
+	changes := services.DiffUsers(before, &user)
+	if len(changes) > 0 {
+		recordAudit(c, models.AuditActionUpdate, id, "", changes)
+	}
+	if userReq.Attributes != nil && hasAttributeChanges(changes) {
+		if err := services.SyncKeycloakAttributes(&user); err != nil {
+			log.Printf("Failed to mirror attributes of user %s to Keycloak: %v", id, err)
+		}
+	}
+	return c.JSON(presentUser(c, &user))
 }
 
 func (h *UserHandler) HandleDeleteUser(c *fiber.Ctx) error {
@@ -228,18 +286,77 @@ func (h *UserHandler) HandleDeleteUser(c *fiber.Ctx) error {
 	if err != nil || user == nil {
 		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "User not found"})
 	}
+	// Deleting also disables the Keycloak account, so only the user and admins may do it
+	if !canAccessUser(c, user) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Insufficient permissions"})
+	}
 
-	if err := services.DeleteUser(id); err != nil {
+	if err := services.SoftDeleteUser(user, utils.Actor(c)); err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Delete failed"})
 	}
+	recordAudit(c, models.AuditActionDelete, id, "", map[string]models.FieldChange{
+		"deleted_at": {Before: nil, After: user.DeletedAt},
+	})
 	return c.SendStatus(fiber.StatusNoContent)
 }
 
-// HandleGetAllUsers returns all users from the database
+// HandleRestoreUser undoes a soft delete that has not been purged yet
+func (h *UserHandler) HandleRestoreUser(c *fiber.Ctx) error {
+	idParam := c.Params("id")
+	id, err := gocql.ParseUUID(idParam)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid UUID"})
+	}
+
+	user, err := services.GetUserByIDIncludingDeleted(id)
+	if err != nil || user == nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "User not found"})
+	}
+	if !user.IsDeleted() {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "User is not deleted"})
+	}
+
+	deletedAt := user.DeletedAt
+	if err := services.RestoreUser(user); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Restore failed"})
+	}
+	recordAudit(c, models.AuditActionRestore, id, "", map[string]models.FieldChange{
+		"deleted_at": {Before: deletedAt, After: nil},
+	})
+	return c.JSON(presentUser(c, user))
+}
+
+// HandleGetAllUsers returns all users from the database, or the user matching ?email=
 func (h *UserHandler) HandleGetAllUsers(c *fiber.Ctx) error {
+	if email := c.Query("email"); email != "" {
+		user, err := services.GetUserByEmail(email)
+		if err != nil || user == nil {
+			return c.JSON([]models.User{})
+		}
+		return c.JSON([]*models.User{presentUser(c, user)})
+	}
 	users, err := services.GetAllUsers()
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch users"})
 	}
-	return c.JSON(users)
+	presented := make([]*models.User, len(users))
+	for i := range users {
+		presented[i] = presentUser(c, &users[i])
+	}
+	return c.JSON(presented)
+}
+
+// hasAttributeChanges reports whether an audit diff touches any custom attribute.
+func hasAttributeChanges(changes map[string]models.FieldChange) bool {
+	for name := range changes {
+		if strings.HasPrefix(name, "attributes.") {
+			return true
+		}
+	}
+	return false
+}
+
+// HandleGetAttributeSchema returns the custom attribute definitions
+func (h *UserHandler) HandleGetAttributeSchema(c *fiber.Ctx) error {
+	return c.JSON(services.AttributeDefinitions())
 }
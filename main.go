@@ -2,11 +2,16 @@ package main
 
 import (
 	"go-keycloack/config"
+	"go-keycloack/encryption"
 	"go-keycloack/handlers"
 	"go-keycloack/middleware"
+	"go-keycloack/services"
 	"log"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/expvar"
+	"github.com/gofiber/fiber/v2/middleware/requestid"
 	"github.com/joho/godotenv"
 )
 
@@ -17,30 +22,118 @@ func main() {
 
 	config.InitCassandra()
 	defer config.Session.Close()
+	config.EnsureSchema()
+	encryption.Init()
+	services.LoadAttributeSchema()
+	services.LoadPreferencesConfig()
+	services.InitAvatarStore()
+	services.LoadQuotaTiers()
 
-	middleware.InitValkey() // Initialize Valkey (Redis-compatible) connection
+	// Soft-deleted users are purged from Cassandra and Keycloak once the retention period has passed
+	services.StartUserPurge(
+		config.GetDuration("USER_PURGE_INTERVAL", time.Hour),
+		config.GetDuration("USER_RETENTION_PERIOD", 30*24*time.Hour),
+	)
+
+	config.InitValkey() // Initialize Valkey (Redis-compatible) connection
+	services.StartUserCacheInvalidation()
+	services.StartLockoutWebhook()
+	services.InitLoginChallenge()
+	services.InitOID4VC()
+	services.StartIPFilter(config.GetDuration("IP_RULES_REFRESH_INTERVAL", 30*time.Second))
+
+	// Pick up erasure jobs that were interrupted by a restart
+	services.ResumeErasureJobs()
 
 	app := fiber.New()
 
-	app.Use(middleware.RateLimitAll()) // Apply rate limiting to all routes
+	app.Use(requestid.New())              // Tag every request with an X-Request-ID for auditing
+	app.Use(middleware.ResolveClientIP()) // Client IP behind trusted proxies, used by everything below
+	app.Use(middleware.IPFilter())        // Reject denied networks before they cost anything
+	app.Use(middleware.RateLimitAll())    // Apply rate limiting to all routes
+	app.Use(middleware.EnforceQuota())    // Per-tier request rates and daily/monthly budgets
 
 	userHandler := &handlers.UserHandler{}
 
 	// Public endpoints
 	app.Post("/login", userHandler.HandleLogin)
+	app.Get("/login/challenge", userHandler.HandleGetLoginChallenge)
 	app.Post("/users", userHandler.HandleUserCreation)
 
-	// Credential endpoints (public)
-	app.Post("/onboard/issuer", handlers.OnboardIssuerFiber)
-	app.Post("/issue/credential", handlers.IssueCredentialFiber)
+	// Credential verification (public)
 	app.Post("/verify/credential", handlers.VerifyCredentialFiber)
 
+	// Avatars are public so that they can be used directly in <img> tags
+	app.Get("/users/:id/avatar", userHandler.HandleGetUserAvatar)
+
 	// Protected endpoints
 	app.Use(middleware.KeycloakAuthMiddleware())
 	app.Get("/users", userHandler.HandleGetAllUsers)
+	app.Get("/user-attributes", userHandler.HandleGetAttributeSchema)
+	app.Post("/users\\:batchGet", userHandler.HandleBatchGetUsers)
 	app.Get("/users/:id", userHandler.HandleGetUser)
 	app.Put("/users/:id", userHandler.HandleUpdateUser)
 	app.Delete("/users/:id", userHandler.HandleDeleteUser)
+	app.Post("/users/:id/restore", middleware.RequireAdmin(), userHandler.HandleRestoreUser)
+	app.Get("/users/:id/audit", middleware.RequireAdmin(), userHandler.HandleGetUserAudit)
+	app.Post("/users/:id/unlock", middleware.RequireAdmin(), userHandler.HandleUnlockUser)
+	app.Get("/users/:id/roles", middleware.RequireAdmin(), userHandler.HandleGetUserRoles)
+	app.Patch("/users/:id/roles", middleware.RequireAdmin(), userHandler.HandleUpdateUserRoles)
+	app.Get("/users/:id/logins", userHandler.HandleGetUserLogins)
+	app.Get("/me/logins", userHandler.HandleGetMyLogins)
+	app.Get("/me/quota", userHandler.HandleGetMyQuota)
+	app.Get("/users/:id/export", middleware.LimitConcurrency("export"), userHandler.HandleExportUser)
+
+	// Credential issuers, owned by whoever onboarded them; issuance can reference one by ID
+	app.Post("/onboard/issuer", handlers.OnboardIssuerFiber)
+	app.Post("/issue/credential", middleware.LimitConcurrency("issue_credential"), handlers.IssueCredentialFiber)
+	app.Get("/issuers", handlers.ListIssuersFiber)
+	app.Get("/issuers/:id", handlers.GetIssuerFiber)
+	app.Post("/issuers/:id/disable", handlers.DisableIssuerFiber)
+	app.Delete("/issuers/:id", handlers.DeleteIssuerFiber)
+
+	app.Put("/me/avatar", userHandler.HandlePutMyAvatar)
+	app.Delete("/me/avatar", userHandler.HandleDeleteMyAvatar)
+
+	// Per-user preferences, one namespace per application
+	app.Get("/me/preferences", userHandler.HandleListMyPreferenceNamespaces)
+	app.Get("/me/preferences/:namespace", userHandler.HandleGetMyPreferences)
+	app.Put("/me/preferences/:namespace", userHandler.HandlePutMyPreferences)
+	app.Patch("/me/preferences/:namespace", userHandler.HandlePatchMyPreferences)
+	app.Delete("/me/preferences/:namespace/:key?", userHandler.HandleDeleteMyPreferences)
+
+	// Right-to-erasure workflow (admin)
+	app.Post("/users/:id/erasure", middleware.RequireAdmin(), userHandler.HandleEraseUser)
+	app.Get("/erasure/jobs/:id", middleware.RequireAdmin(), userHandler.HandleGetErasureJob)
+	app.Post("/erasure/jobs/:id/resume", middleware.RequireAdmin(), userHandler.HandleResumeErasureJob)
+	app.Get("/erasure/tombstones/verify", middleware.RequireAdmin(), userHandler.HandleVerifyErasureTombstones)
+
+	// Runtime metrics such as user cache hits and misses (admin)
+	app.Get("/debug/vars", middleware.RequireAdmin(), expvar.New())
+
+	// PII key rotation (admin)
+	app.Post("/admin/encryption/rotation", middleware.RequireAdmin(), handlers.StartKeyRotationFiber)
+	app.Get("/admin/encryption/rotation", middleware.RequireAdmin(), handlers.GetKeyRotationFiber)
+
+	// Rate limit policies and per-subject state (admin); the policy file is also reloaded on SIGHUP
+	app.Get("/admin/rate-limits/policies", middleware.RequireAdmin(), handlers.GetRateLimitPoliciesFiber)
+	app.Post("/admin/rate-limits/reload", middleware.RequireAdmin(), handlers.ReloadRateLimitPoliciesFiber)
+	app.Get("/admin/rate-limits/subjects/:subject", middleware.RequireAdmin(), handlers.GetRateLimitSubjectFiber)
+	app.Delete("/admin/rate-limits/subjects/:subject", middleware.RequireAdmin(), handlers.ResetRateLimitSubjectFiber)
+	app.Put("/admin/rate-limits/subjects/:subject/override", middleware.RequireAdmin(), handlers.PutRateLimitOverrideFiber)
+	app.Delete("/admin/rate-limits/subjects/:subject/override", middleware.RequireAdmin(), handlers.DeleteRateLimitOverrideFiber)
+
+	// Per-subject quota overrides (admin)
+	app.Get("/admin/quotas/:subject", middleware.RequireAdmin(), handlers.GetQuotaFiber)
+	app.Put("/admin/quotas/:subject", middleware.RequireAdmin(), handlers.PutQuotaOverrideFiber)
+	app.Delete("/admin/quotas/:subject", middleware.RequireAdmin(), handlers.DeleteQuotaOverrideFiber)
+
+	// IP allow/deny rules per route group (admin)
+	app.Get("/admin/ip-rules", middleware.RequireAdmin(), handlers.ListIPRulesFiber)
+	app.Post("/admin/ip-rules", middleware.RequireAdmin(), handlers.CreateIPRuleFiber)
+	app.Get("/admin/ip-rules/:id", middleware.RequireAdmin(), handlers.GetIPRuleFiber)
+	app.Put("/admin/ip-rules/:id", middleware.RequireAdmin(), handlers.UpdateIPRuleFiber)
+	app.Delete("/admin/ip-rules/:id", middleware.RequireAdmin(), handlers.DeleteIPRuleFiber)
 
 	if err := app.Listen(":3000"); err != nil {
 		log.Fatalf("Failed to start server: %v", err)
@@ -1,19 +1,50 @@
 package middleware
 
 import (
+	"errors"
+	"log"
+
 	"go-keycloack/utils"
 
 	"github.com/gofiber/fiber/v2"
 )
 
+// KeycloakAuthMiddleware rejects requests without a bearer token signed by the realm, and stores
+// the token's claims for the handlers.
 func KeycloakAuthMiddleware() fiber.Handler {
 	return func(c *fiber.Ctx) error {
-		_, err := utils.ExtractAndValidateBearerToken(c)
-		if err != nil {
+		if _, err := utils.ExtractAndValidateBearerToken(c); err != nil {
 			return err
 		}
-		// Optionally, validate token with Keycloak introspection endpoint here
-		// For now, just pass through
+		claims, err := verifyBearer(c)
+		if errors.Is(err, utils.ErrKeysUnavailable) {
+			log.Printf("Token verification unavailable: %v", err)
+			return fiber.NewError(fiber.StatusServiceUnavailable, "Authentication service unavailable")
+		}
+		if err != nil {
+			return fiber.NewError(fiber.StatusUnauthorized, "Invalid or expired token.")
+		}
+		c.Locals(utils.ClaimsLocalKey, claims)
+		return c.Next()
+	}
+}
+
+// RequireRole rejects requests whose token does not carry the given role. Roles are only taken
+// from the verified claims stored by KeycloakAuthMiddleware, so it must run after it; requests
+// that did not pass through it are rejected outright.
+func RequireRole(role string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if utils.Claims(c) == nil {
+			return fiber.NewError(fiber.StatusUnauthorized, "Authorization token is missing in the header.")
+		}
+		if !utils.HasRole(c, role) {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Insufficient permissions"})
+		}
 		return c.Next()
 	}
 }
+
+// RequireAdmin rejects requests whose token does not carry the admin role.
+func RequireAdmin() fiber.Handler {
+	return RequireRole(utils.AdminRole())
+}
@@ -0,0 +1,125 @@
+package middleware
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+const testIssuer = "https://keycloak.test/realms/test"
+
+var realmKey *rsa.PrivateKey
+
+// TestMain serves a JWKS with realmKey and points token verification at it.
+func TestMain(m *testing.M) {
+	var err error
+	if realmKey, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+		panic(err)
+	}
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kid": "realm", "kty": "RSA", "use": "sig",
+			"n": b64(realmKey.N.Bytes()), "e": b64(big.NewInt(int64(realmKey.E)).Bytes()),
+		}}})
+	}))
+	os.Setenv("JWKS_URL", jwks.URL)
+	os.Setenv("JWT_ISSUER", testIssuer)
+	os.Setenv("CLIENT_ID", "api")
+	code := m.Run()
+	jwks.Close()
+	os.Exit(code)
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// signToken returns an RS256 token over claims signed by key, with kid "realm".
+func signToken(t *testing.T, key *rsa.PrivateKey, claims map[string]interface{}) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "realm", "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := b64(header) + "." + b64(payload)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + b64(sig)
+}
+
+// tokenClaims returns valid claims for the test realm with the given realm roles.
+func tokenClaims(roles ...string) map[string]interface{} {
+	list := make([]interface{}, len(roles))
+	for i, r := range roles {
+		list[i] = r
+	}
+	return map[string]interface{}{
+		"sub":          "user-1",
+		"iss":          testIssuer,
+		"azp":          "api",
+		"exp":          time.Now().Add(time.Minute).Unix(),
+		"realm_access": map[string]interface{}{"roles": list},
+	}
+}
+
+func TestRequireAdminRejectsUnverifiedTokens(t *testing.T) {
+	forger, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired := tokenClaims("admin")
+	expired["exp"] = time.Now().Add(-time.Hour).Unix()
+	foreign := tokenClaims("admin")
+	foreign["iss"] = "https://evil.test/realms/test"
+	unsigned := func() string {
+		header, _ := json.Marshal(map[string]string{"alg": "none", "kid": "realm"})
+		payload, _ := json.Marshal(tokenClaims("admin"))
+		return b64(header) + "." + b64(payload) + "."
+	}
+
+	tests := []struct {
+		name   string
+		token  string
+		status int
+	}{
+		{"admin", signToken(t, realmKey, tokenClaims("admin")), fiber.StatusOK},
+		{"not admin", signToken(t, realmKey, tokenClaims("user")), fiber.StatusForbidden},
+		{"forged signature", signToken(t, forger, tokenClaims("admin")), fiber.StatusUnauthorized},
+		{"alg none", unsigned(), fiber.StatusUnauthorized},
+		{"expired", signToken(t, realmKey, expired), fiber.StatusUnauthorized},
+		{"other issuer", signToken(t, realmKey, foreign), fiber.StatusUnauthorized},
+		{"no token", "", fiber.StatusUnauthorized},
+	}
+
+	app := fiber.New()
+	app.Get("/admin", KeycloakAuthMiddleware(), RequireAdmin(), func(c *fiber.Ctx) error {
+		return c.SendStatus(fiber.StatusOK)
+	})
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(fiber.MethodGet, "/admin", nil)
+			if tt.token != "" {
+				req.Header.Set(fiber.HeaderAuthorization, "Bearer "+tt.token)
+			}
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tt.status {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+		})
+	}
+}
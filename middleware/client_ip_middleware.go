@@ -0,0 +1,149 @@
+package middleware
+
+import (
+	"log"
+	"net"
+	"net/netip"
+	"strings"
+
+	"go-keycloack/config"
+	"go-keycloack/utils"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Headers the client IP can be taken from.
+const (
+	headerXForwardedFor = "X-Forwarded-For"
+	headerXRealIP       = "X-Real-IP"
+	headerForwarded     = "Forwarded"
+)
+
+// ResolveClientIP works out the client address once per request and stores it for
+// utils.ClientIP. Forwarding headers are only believed when the peer is a trusted proxy
+// (TRUSTED_PROXIES), and the chain is read from the right: the first hop that is not a trusted
+// proxy is the client, so addresses a client prepends itself are never used.
+func ResolveClientIP() fiber.Handler {
+	var trusted []netip.Prefix
+	for _, cidr := range config.GetList("TRUSTED_PROXIES", nil) {
+		prefix, err := parseTrustedProxy(cidr)
+		if err != nil {
+			log.Fatalf("Invalid TRUSTED_PROXIES entry %q: %v", cidr, err)
+		}
+		trusted = append(trusted, prefix)
+	}
+	header := config.GetString("CLIENT_IP_HEADER", headerXForwardedFor)
+	switch {
+	case strings.EqualFold(header, headerXForwardedFor):
+		header = headerXForwardedFor
+	case strings.EqualFold(header, headerXRealIP):
+		header = headerXRealIP
+	case strings.EqualFold(header, headerForwarded):
+		header = headerForwarded
+	default:
+		log.Fatalf("Unsupported CLIENT_IP_HEADER %q", header)
+	}
+
+	isTrusted := func(addr netip.Addr) bool {
+		for _, prefix := range trusted {
+			if prefix.Contains(addr) {
+				return true
+			}
+		}
+		return false
+	}
+	return func(c *fiber.Ctx) error {
+		peer, ok := netip.AddrFromSlice(c.Context().RemoteIP())
+		if !ok {
+			return c.Next()
+		}
+		peer = peer.Unmap()
+		ip := peer
+		if len(trusted) > 0 && isTrusted(peer) {
+			ip = rightmostUntrusted(forwardedHops(c, header), peer, isTrusted)
+		}
+		c.Locals(utils.ClientIPLocalKey, ip.String())
+		return c.Next()
+	}
+}
+
+// forwardedHops returns the addresses in the forwarding header, closest to the client first.
+// Repeated headers are joined in order, as proxies may add a new header instead of appending.
+func forwardedHops(c *fiber.Ctx, header string) []string {
+	var hops []string
+	for _, value := range c.Request().Header.PeekAll(header) {
+		for _, element := range strings.Split(string(value), ",") {
+			element = strings.TrimSpace(element)
+			if header == headerForwarded {
+				element = forwardedFor(element)
+			}
+			hops = append(hops, element)
+		}
+	}
+	return hops
+}
+
+// forwardedFor extracts the for= parameter of one RFC 7239 Forwarded element.
+func forwardedFor(element string) string {
+	for _, pair := range strings.Split(element, ";") {
+		key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if ok && strings.EqualFold(key, "for") {
+			return strings.Trim(value, `"`)
+		}
+	}
+	return ""
+}
+
+// rightmostUntrusted walks the hops from the proxy nearest to us outwards and returns the first
+// address that is not a trusted proxy. If a hop cannot be parsed (for example "unknown" or an
+// obfuscated identifier), nothing further left can be trusted either, so the last good address
+// is used.
+func rightmostUntrusted(hops []string, peer netip.Addr, isTrusted func(netip.Addr) bool) netip.Addr {
+	last := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, ok := parseHop(hops[i])
+		if !ok {
+			return last
+		}
+		if !isTrusted(addr) {
+			return addr
+		}
+		last = addr
+	}
+	return last
+}
+
+// parseHop accepts "1.2.3.4", "1.2.3.4:80", "2001:db8::1" and "[2001:db8::1]:80".
+func parseHop(hop string) (netip.Addr, bool) {
+	if addr, err := netip.ParseAddr(hop); err == nil {
+		return addr.Unmap(), true
+	}
+	if host, _, err := net.SplitHostPort(hop); err == nil {
+		if addr, err := netip.ParseAddr(host); err == nil {
+			return addr.Unmap(), true
+		}
+	}
+	if strings.HasPrefix(hop, "[") && strings.HasSuffix(hop, "]") {
+		if addr, err := netip.ParseAddr(hop[1 : len(hop)-1]); err == nil {
+			return addr.Unmap(), true
+		}
+	}
+	return netip.Addr{}, false
+}
+
+// parseTrustedProxy accepts a CIDR or a single address.
+func parseTrustedProxy(cidr string) (netip.Prefix, error) {
+	if !strings.Contains(cidr, "/") {
+		addr, err := netip.ParseAddr(cidr)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		addr = addr.Unmap()
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return prefix.Masked(), nil
+}
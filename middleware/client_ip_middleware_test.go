@@ -0,0 +1,119 @@
+package middleware
+
+import (
+	"io"
+	"net/http/httptest"
+	"testing"
+
+	"go-keycloack/utils"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// The peer address of requests made with fiber's app.Test is 0.0.0.0.
+const testPeer = "0.0.0.0"
+
+func TestResolveClientIP(t *testing.T) {
+	tests := []struct {
+		name    string
+		trusted string
+		header  string
+		headers [][2]string
+		want    string
+	}{
+		{
+			name:    "no trusted proxies ignores headers",
+			headers: [][2]string{{"X-Forwarded-For", "198.51.100.1"}},
+			want:    testPeer,
+		},
+		{
+			name:    "untrusted peer ignores headers",
+			trusted: "10.0.0.0/8",
+			headers: [][2]string{{"X-Forwarded-For", "198.51.100.1"}},
+			want:    testPeer,
+		},
+		{
+			name:    "trusted peer without header",
+			trusted: testPeer,
+			want:    testPeer,
+		},
+		{
+			name:    "single hop",
+			trusted: testPeer,
+			headers: [][2]string{{"X-Forwarded-For", "198.51.100.1"}},
+			want:    "198.51.100.1",
+		},
+		{
+			name:    "spoofed hops left of the client are ignored",
+			trusted: testPeer + ",10.0.0.0/8",
+			headers: [][2]string{{"X-Forwarded-For", "1.1.1.1, 198.51.100.1, 10.0.0.2"}},
+			want:    "198.51.100.1",
+		},
+		{
+			name:    "repeated headers are joined in order",
+			trusted: testPeer + ",10.0.0.0/8",
+			headers: [][2]string{{"X-Forwarded-For", "198.51.100.1"}, {"X-Forwarded-For", "10.0.0.2"}},
+			want:    "198.51.100.1",
+		},
+		{
+			name:    "all hops trusted",
+			trusted: testPeer + ",10.0.0.0/8",
+			headers: [][2]string{{"X-Forwarded-For", "10.0.0.3, 10.0.0.2"}},
+			want:    "10.0.0.3",
+		},
+		{
+			name:    "unparsable hop stops the walk",
+			trusted: testPeer + ",10.0.0.0/8",
+			headers: [][2]string{{"X-Forwarded-For", "198.51.100.1, unknown, 10.0.0.2"}},
+			want:    "10.0.0.2",
+		},
+		{
+			name:    "hop with port",
+			trusted: testPeer,
+			headers: [][2]string{{"X-Forwarded-For", "198.51.100.1:4711"}},
+			want:    "198.51.100.1",
+		},
+		{
+			name:    "IPv4-mapped IPv6 hop",
+			trusted: testPeer,
+			headers: [][2]string{{"X-Forwarded-For", "::ffff:198.51.100.1"}},
+			want:    "198.51.100.1",
+		},
+		{
+			name:    "X-Real-IP",
+			trusted: testPeer,
+			header:  "x-real-ip",
+			headers: [][2]string{{"X-Forwarded-For", "1.1.1.1"}, {"X-Real-IP", "198.51.100.1"}},
+			want:    "198.51.100.1",
+		},
+		{
+			name:    "Forwarded with quoted IPv6 and port",
+			trusted: testPeer + ",10.0.0.0/8",
+			header:  "Forwarded",
+			headers: [][2]string{{"Forwarded", `for=1.1.1.1, for="[2001:db8::1]:4711";proto=https, for=10.0.0.2`}},
+			want:    "2001:db8::1",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("TRUSTED_PROXIES", tt.trusted)
+			t.Setenv("CLIENT_IP_HEADER", tt.header)
+			app := fiber.New()
+			app.Use(ResolveClientIP())
+			app.Get("/", func(c *fiber.Ctx) error { return c.SendString(utils.ClientIP(c)) })
+
+			req := httptest.NewRequest(fiber.MethodGet, "/", nil)
+			for _, h := range tt.headers {
+				req.Header.Add(h[0], h[1])
+			}
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			if got := string(body); got != tt.want {
+				t.Errorf("client IP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
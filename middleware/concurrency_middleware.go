@@ -0,0 +1,92 @@
+package middleware
+
+import (
+	"context"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go-keycloack/config"
+	"go-keycloack/ratelimit"
+	"go-keycloack/utils"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// LimitConcurrency caps how many requests each caller may have in flight on a route, counted
+// across instances. The cap is CONCURRENCY_LIMIT_<ROUTE>, falling back to CONCURRENCY_LIMIT. It
+// complements RateLimitAll, which limits how often requests start rather than how many run.
+// While Valkey is unreachable RATE_LIMIT_FAILURE_MODE applies, with "local" counting per instance.
+func LimitConcurrency(route string) fiber.Handler {
+	envRoute := strings.ToUpper(strings.NewReplacer("-", "_", "/", "_").Replace(route))
+	limit := config.GetInt("CONCURRENCY_LIMIT_"+envRoute, config.GetInt("CONCURRENCY_LIMIT", 2))
+	lease := config.GetDuration("CONCURRENCY_LEASE", 30*time.Second)
+	sem := ratelimit.NewSemaphore(config.Valkey, limit, lease)
+	local := ratelimit.NewLocalSemaphore(limit)
+	limiter := rateLimiter()
+
+	return func(c *fiber.Ctx) error {
+		subject := utils.Subject(c)
+		if subject == "" {
+			subject, _ = bearerClaims(c)["sub"].(string)
+		}
+		if subject == "" {
+			subject = utils.ClientIP(c)
+		}
+		key := ratelimit.InflightKey(subject, route)
+
+		var release func()
+		if !limiter.Degraded() {
+			held, wait, err := sem.Acquire(context.Background(), key)
+			switch {
+			case err != nil:
+				log.Printf("Concurrency limiter error on %s: %v", route, err)
+				limiter.ReportError(err)
+			case held == nil:
+				return tooManyConcurrent(c, limit, wait)
+			default:
+				release = func() {
+					if err := held.Release(context.Background()); err != nil {
+						log.Printf("Failed to release concurrency slot on %s: %v", route, err)
+					}
+				}
+			}
+		}
+		if release == nil {
+			switch limiter.Mode() {
+			case ratelimit.FailureModeOpen:
+				return c.Next()
+			case ratelimit.FailureModeClosed:
+				return serviceUnavailable(c)
+			default:
+				var ok bool
+				if release, ok = local.Acquire(key); !ok {
+					return tooManyConcurrent(c, limit, 0)
+				}
+			}
+		}
+
+		release = sync.OnceFunc(release)
+		kept := false
+		c.Locals(utils.SlotHoldLocalKey, func() func() {
+			kept = true
+			return release
+		})
+		defer func() {
+			if !kept {
+				release()
+			}
+		}()
+		return c.Next()
+	}
+}
+
+func tooManyConcurrent(c *fiber.Ctx, limit int, wait time.Duration) error {
+	c.Set(fiber.HeaderRetryAfter, strconv.FormatInt(max(ratelimit.Seconds(wait), 1), 10))
+	return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
+		"error": "Too many concurrent requests. Wait for earlier requests to finish.",
+		"limit": limit,
+	})
+}
@@ -0,0 +1,18 @@
+package middleware
+
+import (
+	"go-keycloack/services"
+	"go-keycloack/utils"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// IPFilter rejects requests from addresses denied for, or not allowed on, the route group.
+func IPFilter() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if allowed, _ := services.CheckIP(utils.RoutePath(c.Path()), utils.ClientIP(c)); !allowed {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Access denied"})
+		}
+		return c.Next()
+	}
+}
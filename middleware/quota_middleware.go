@@ -0,0 +1,103 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strconv"
+	"time"
+
+	"go-keycloack/ratelimit"
+	"go-keycloack/services"
+	"go-keycloack/utils"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// EnforceQuota applies the caller's quota tier: a per-minute rate and daily and monthly request
+// budgets. Authenticated callers are counted by token subject, anonymous ones by IP. While Valkey
+// is unreachable RATE_LIMIT_FAILURE_MODE applies: "local" keeps enforcing the per-minute rate per
+// instance, and only "closed" rejects requests. Budgets cannot be kept per instance, so they are
+// not counted during an outage.
+func EnforceQuota() fiber.Handler {
+	if !services.QuotasEnabled() {
+		return func(c *fiber.Ctx) error { return c.Next() }
+	}
+	limiter := rateLimiter()
+	return func(c *fiber.Ctx) error {
+		ctx := context.Background()
+		claims := bearerClaims(c)
+		subject, _ := claims["sub"].(string)
+		if subject == "" {
+			claims = nil
+			subject = utils.ClientIP(c)
+		}
+
+		// Without Valkey the override cannot be read, so the tier's own limits apply
+		tier := services.QuotaTierFor(claims)
+		if !limiter.Degraded() {
+			effective, _, err := services.EffectiveQuota(ctx, subject, tier)
+			if err != nil {
+				log.Printf("Quota lookup failed for %s: %v", subject, err)
+				limiter.ReportError(err)
+			} else {
+				tier = effective
+			}
+		}
+
+		if tier.PerMinute > 0 {
+			policy := ratelimit.Policy{
+				Name:      "quota:" + tier.Name,
+				Algorithm: ratelimit.AlgorithmTokenBucket,
+				Limit:     tier.PerMinute,
+				Window:    time.Minute,
+				Burst:     tier.Burst,
+			}
+			result, err := limiter.Allow(ctx, services.QuotaRateKey(subject), "", policy)
+			switch {
+			case errors.Is(err, ratelimit.ErrFailOpen):
+				return c.Next()
+			case errors.Is(err, ratelimit.ErrUnavailable):
+				return serviceUnavailable(c)
+			case err != nil:
+				log.Printf("Quota rate check failed for %s: %v", subject, err)
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Quota check failed"})
+			}
+			if !result.Allowed {
+				c.Set(fiber.HeaderRetryAfter, strconv.FormatInt(max(ratelimit.Seconds(result.RetryAfter), 1), 10))
+				return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{"error": "Quota rate exceeded", "tier": tier.Name})
+			}
+		}
+
+		if limiter.Degraded() {
+			return quotaBudgetsUnavailable(c, limiter)
+		}
+		allowed, resetsAt, err := services.ConsumeQuota(ctx, subject, tier)
+		if err != nil {
+			log.Printf("Quota budget check failed for %s: %v", subject, err)
+			limiter.ReportError(err)
+			if limiter.Degraded() {
+				return quotaBudgetsUnavailable(c, limiter)
+			}
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Quota check failed"})
+		}
+		if !allowed {
+			c.Set(fiber.HeaderRetryAfter, strconv.FormatInt(max(ratelimit.Seconds(time.Until(resetsAt)), 1), 10))
+			return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
+				"error":     "Quota exhausted",
+				"tier":      tier.Name,
+				"resets_at": resetsAt,
+			})
+		}
+		return c.Next()
+	}
+}
+
+// quotaBudgetsUnavailable handles a request whose budgets cannot be counted because Valkey is
+// unreachable: it is rejected in "closed" mode and goes through uncounted otherwise.
+func quotaBudgetsUnavailable(c *fiber.Ctx, limiter *ratelimit.Guarded) error {
+	if limiter.Mode() == ratelimit.FailureModeClosed {
+		return serviceUnavailable(c)
+	}
+	return c.Next()
+}
@@ -2,96 +2,221 @@ package middleware
 
 import (
 	"context"
-	"fmt"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
+	"go-keycloack/config"
+	"go-keycloack/ratelimit"
 	"go-keycloack/utils"
 
 	"github.com/gofiber/fiber/v2"
-	"github.com/redis/go-redis/v9"
 )
 
-var redisClient *redis.Client
+// ratePolicies is swapped atomically when the policy file is reloaded.
+var ratePolicies atomic.Pointer[ratelimit.RuleSet]
 
-func InitValkey() {
-	redisClient = redis.NewClient(&redis.Options{
-		Addr:     "localhost:6379",
-		Password: "",
-		DB:       0,
-	})
+// defaultRule is applied to routes that no rule in RATE_LIMIT_POLICY_FILE matches, and supplies
+// the settings a rule leaves out.
+func defaultRule() ratelimit.Rule {
+	return ratelimit.Rule{
+		Policy: ratelimit.Policy{
+			Name:      "default",
+			Algorithm: config.GetString("RATE_LIMIT_ALGORITHM", ratelimit.AlgorithmSlidingWindow),
+			Limit:     config.GetInt("RATE_LIMIT_LIMIT", 5),
+			Window:    config.GetDuration("RATE_LIMIT_WINDOW", 60*time.Second),
+			Burst:     config.GetInt("RATE_LIMIT_BURST", 0),
+		},
+		Key: ratelimit.KeyUser,
+	}
+}
+
+func loadRatePolicies() (*ratelimit.RuleSet, error) {
+	def := defaultRule()
+	path := config.GetString("RATE_LIMIT_POLICY_FILE", "")
+	if path == "" {
+		if err := def.Validate(); err != nil {
+			return nil, err
+		}
+		return &ratelimit.RuleSet{Default: def}, nil
+	}
+	return ratelimit.LoadRuleSet(path, def)
+}
 
-	ctx := context.Background()
-	info, err := redisClient.Info(ctx, "server").Result()
+// ReloadRateLimitPolicies re-reads RATE_LIMIT_POLICY_FILE. The current policies stay in place if
+// the file is invalid.
+func ReloadRateLimitPolicies() error {
+	set, err := loadRatePolicies()
 	if err != nil {
-		fmt.Printf("Failed to connect to Valkey: %v\n", err)
-	} else {
-		fmt.Printf("Connected to Valkey. Server info:\n%s\n", info)
+		return err
 	}
+	ratePolicies.Store(set)
+	log.Printf("Loaded %d rate limit rules", len(set.Rules))
+	return nil
 }
 
-func RateLimitLogin() fiber.Handler {
-	return func(c *fiber.Ctx) error {
-		type LoginRequest struct {
-			Username string `json:"username"`
-		}
-		var req LoginRequest
-		if err := c.BodyParser(&req); err != nil || req.Username == "" {
-			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request payload"})
-		}
-		key := fmt.Sprintf("login_rate:%s", req.Username)
-		ctx := context.Background()
-		count, err := redisClient.Incr(ctx, key).Result()
-		if err != nil {
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Rate limiter error"})
-		}
-		if count == 1 {
-			redisClient.Expire(ctx, key, 60*time.Second)
-		}
-		if count > 5 {
-			return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{"error": "Too many login attempts. Please try again later."})
+// RateLimitPolicies returns the rules currently in force.
+func RateLimitPolicies() *ratelimit.RuleSet {
+	return ratePolicies.Load()
+}
+
+// watchRateLimitPolicies reloads the policy file on SIGHUP.
+func watchRateLimitPolicies() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	go func() {
+		for range signals {
+			if err := ReloadRateLimitPolicies(); err != nil {
+				log.Printf("Rate limit policy reload failed: %v", err)
+			}
 		}
-		return c.Next()
-	}
+	}()
 }
 
+// RateLimitAll enforces the rule matching each request's method and path.
 func RateLimitAll() fiber.Handler {
+	if err := ReloadRateLimitPolicies(); err != nil {
+		log.Fatalf("Invalid rate limit configuration: %v", err)
+	}
+	watchRateLimitPolicies()
+	limiter := rateLimiter()
+	badToken := badTokenPolicy()
 	return func(c *fiber.Ctx) error {
-		var userID string
-		// Try to extract user from JWT (for authenticated requests)
-		bearer := c.Get("Authorization")
-		if len(bearer) > 7 && bearer[:7] == "Bearer " {
-			token := bearer[7:]
-			claims, err := utils.ParseJWT(token)
-			if err == nil && claims["sub"] != nil {
-				userID = claims["sub"].(string)
+		path := utils.RoutePath(c.Path())
+		rule := ratePolicies.Load().Match(c.Method(), path)
+
+		// Only a verified token identifies the caller, so anyone presenting an invalid token is
+		// counted by IP. Forged or malformed tokens also count against a separate, stricter
+		// bucket so that minting tokens is not a way to get a fresh allowance; genuine tokens
+		// that merely expired do not.
+		claims, tokenErr := verifyBearer(c)
+		if errors.Is(tokenErr, utils.ErrBadSignature) {
+			subject := "bad_token:" + utils.ClientIP(c)
+			if ok, err := enforceRateLimit(c, limiter, subject, badToken); !ok {
+				return err
 			}
 		}
-		// For login, extract username from body
-		if userID == "" && c.Path() == "/login" && c.Method() == fiber.MethodPost {
-			type LoginRequest struct {
-				Username string `json:"username"`
-			}
-			var req LoginRequest
-			if err := c.BodyParser(&req); err == nil && req.Username != "" {
-				userID = req.Username
-			}
+		if len(rule.ExemptRoles) > 0 && rule.Exempt(utils.Roles(claims)) {
+			return c.Next()
 		}
-		// Fallback to IP address
-		if userID == "" {
-			userID = c.IP()
+
+		subject := rateLimitSubject(c, rule.Key, claims)
+		if ok, err := enforceRateLimit(c, limiter, subject, rule.Policy); !ok {
+			return err
 		}
-		key := fmt.Sprintf("rate:%s:%s", userID, c.Path())
-		ctx := context.Background()
-		count, err := redisClient.Incr(ctx, key).Result()
-		if err != nil {
-			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Rate limiter error"})
+		return c.Next()
+	}
+}
+
+// rateLimiter is shared by the rate limit, quota and concurrency middleware so that they agree on
+// whether Valkey is reachable and apply the same RATE_LIMIT_FAILURE_MODE while it is not.
+var rateLimiter = sync.OnceValue(func() *ratelimit.Guarded {
+	limiter, err := ratelimit.NewGuarded(config.Valkey, config.GetString("RATE_LIMIT_FAILURE_MODE", ratelimit.FailureModeLocal))
+	if err != nil {
+		log.Fatalf("Invalid rate limit configuration: %v", err)
+	}
+	go limiter.Monitor(context.Background(), config.GetDuration("RATE_LIMIT_HEALTH_INTERVAL", 2*time.Second))
+	return limiter
+})
+
+// badTokenPolicy limits how many requests with an invalid bearer token one IP may make.
+func badTokenPolicy() ratelimit.Policy {
+	policy := ratelimit.Policy{
+		Name:      "bad_token",
+		Algorithm: ratelimit.AlgorithmSlidingWindow,
+		Limit:     config.GetInt("RATE_LIMIT_BAD_TOKEN_LIMIT", 10),
+		Window:    config.GetDuration("RATE_LIMIT_BAD_TOKEN_WINDOW", 10*time.Minute),
+	}
+	if err := policy.Validate(); err != nil {
+		log.Fatalf("Invalid rate limit configuration: %v", err)
+	}
+	return policy
+}
+
+// enforceRateLimit counts the request against the subject's bucket for the policy. It reports
+// false, with the response already written, when the request must not go on.
+func enforceRateLimit(c *fiber.Ctx, limiter *ratelimit.Guarded, subject string, policy ratelimit.Policy) (bool, error) {
+	result, err := limiter.Allow(context.Background(), ratelimit.Key(subject, policy.Name), ratelimit.OverrideKey(subject), policy)
+	switch {
+	case errors.Is(err, ratelimit.ErrFailOpen):
+		return true, nil
+	case errors.Is(err, ratelimit.ErrUnavailable):
+		return false, serviceUnavailable(c)
+	case err != nil:
+		return false, c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Rate limiter error"})
+	}
+	ratelimit.SetHeaders(c, result)
+	if !result.Allowed {
+		return false, c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{"error": "Too many requests. Please try again later."})
+	}
+	return true, nil
+}
+
+// serviceUnavailable rejects a request that cannot be checked while Valkey is unreachable.
+func serviceUnavailable(c *fiber.Ctx) error {
+	c.Set(fiber.HeaderRetryAfter, "5")
+	return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{"error": "Service temporarily unavailable"})
+}
+
+// tokenCheck is the outcome of verifying a request's bearer token. It is kept in Locals so that
+// the limiters and KeycloakAuthMiddleware verify each token only once.
+type tokenCheck struct {
+	claims map[string]interface{}
+	err    error
+}
+
+const tokenCheckLocalKey = "token_check"
+
+// verifyBearer verifies the request's bearer token and returns its claims. Requests without a
+// bearer token return nil claims and no error.
+func verifyBearer(c *fiber.Ctx) (map[string]interface{}, error) {
+	if check, ok := c.Locals(tokenCheckLocalKey).(tokenCheck); ok {
+		return check.claims, check.err
+	}
+	var check tokenCheck
+	bearer := c.Get("Authorization")
+	if len(bearer) > 7 && bearer[:7] == "Bearer " {
+		check.claims, check.err = utils.VerifyJWT(bearer[7:])
+	}
+	c.Locals(tokenCheckLocalKey, check)
+	return check.claims, check.err
+}
+
+// bearerClaims returns the claims of the request's bearer token, or nil for anonymous requests
+// and tokens that fail verification.
+func bearerClaims(c *fiber.Ctx) map[string]interface{} {
+	claims, _ := verifyBearer(c)
+	return claims
+}
+
+// rateLimitSubject picks what a request is counted against for the given key strategy. Every
+// strategy falls back to the client IP when its identifier is missing.
+func rateLimitSubject(c *fiber.Ctx, strategy string, claims map[string]interface{}) string {
+	switch strategy {
+	case ratelimit.KeyUser:
+		// Anonymous requests, logins included, are counted by IP. Keying a login on the username in
+		// its body would let anyone drain a named user's allowance; failed logins per username are
+		// limited by the login protection counters instead.
+		if sub, _ := claims["sub"].(string); sub != "" {
+			return sub
 		}
-		if count == 1 {
-			redisClient.Expire(ctx, key, 60*time.Second)
+	case ratelimit.KeyClientID:
+		if azp, _ := claims["azp"].(string); azp != "" {
+			return "client:" + azp
 		}
-		if count > 5 {
-			return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{"error": "Too many requests. Please try again later."})
+	case ratelimit.KeyAPIKey:
+		if apiKey := c.Get("X-API-Key"); apiKey != "" {
+			// Keys are hashed so that they never show up in Valkey
+			sum := sha256.Sum256([]byte(apiKey))
+			return "apikey:" + hex.EncodeToString(sum[:16])
 		}
-		return c.Next()
 	}
+	return utils.ClientIP(c)
 }
@@ -0,0 +1,65 @@
+package middleware
+
+import (
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"go-keycloack/ratelimit"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+func TestRateLimitSubject(t *testing.T) {
+	token := signToken(t, realmKey, tokenClaims())
+	tests := []struct {
+		name     string
+		strategy string
+		method   string
+		path     string
+		body     string
+		token    string
+		apiKey   string
+		want     string
+	}{
+		{"login by IP, not by the username in the body", ratelimit.KeyUser, fiber.MethodPost, "/login",
+			`{"username":"victim","password":"x"}`, "", "", "0.0.0.0"},
+		{"login with a mixed-case path", ratelimit.KeyUser, fiber.MethodPost, "/Login/",
+			`{"username":"victim","password":"x"}`, "", "", "0.0.0.0"},
+		{"user", ratelimit.KeyUser, fiber.MethodGet, "/users", "", token, "", "user-1"},
+		{"user without a token", ratelimit.KeyUser, fiber.MethodGet, "/users", "", "", "", "0.0.0.0"},
+		{"client", ratelimit.KeyClientID, fiber.MethodGet, "/users", "", token, "", "client:api"},
+		{"api key", ratelimit.KeyAPIKey, fiber.MethodGet, "/users", "", "", "secret",
+			"apikey:2bb80d537b1da3e38bd30361aa855686"},
+		{"ip", ratelimit.KeyIP, fiber.MethodGet, "/users", "", token, "", "0.0.0.0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			app := fiber.New()
+			app.Use(func(c *fiber.Ctx) error {
+				got = rateLimitSubject(c, tt.strategy, bearerClaims(c))
+				return c.SendStatus(fiber.StatusNoContent)
+			})
+			var body io.Reader
+			if tt.body != "" {
+				body = strings.NewReader(tt.body)
+			}
+			req := httptest.NewRequest(tt.method, tt.path, body)
+			req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+			if tt.token != "" {
+				req.Header.Set(fiber.HeaderAuthorization, "Bearer "+tt.token)
+			}
+			if tt.apiKey != "" {
+				req.Header.Set("X-API-Key", tt.apiKey)
+			}
+			if _, err := app.Test(req); err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("rateLimitSubject() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
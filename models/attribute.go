@@ -0,0 +1,32 @@
+package models
+
+// Attribute types supported by the custom attribute schema.
+const (
+	AttributeTypeString = "string"
+	AttributeTypeInt    = "int"
+	AttributeTypeBool   = "bool"
+	AttributeTypeEnum   = "enum"
+)
+
+// Attribute visibilities, from least to most restricted. Public attributes are shown to every
+// authenticated caller, self attributes to the user and admins, and admin attributes to admins only.
+const (
+	VisibilityPublic = "public"
+	VisibilitySelf   = "self"
+	VisibilityAdmin  = "admin"
+)
+
+// AttributeDefinition describes one custom user attribute. Visibility is the lowest level that may
+// see the attribute and Editable the lowest level that may change it.
+type AttributeDefinition struct {
+	Name       string   `json:"name"`
+	Type       string   `json:"type"`
+	Required   bool     `json:"required"`
+	MaxLength  int      `json:"max_length,omitempty"`
+	Pattern    string   `json:"pattern,omitempty"`
+	Values     []string `json:"values,omitempty"`
+	Visibility string   `json:"visibility"`
+	Editable   string   `json:"editable"`
+	// PII attributes are encrypted at rest when PII encryption is configured.
+	PII bool `json:"pii,omitempty"`
+}
@@ -0,0 +1,37 @@
+package models
+
+import (
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+// Audit actions recorded against a user.
+const (
+	AuditActionCreate     = "create"
+	AuditActionUpdate     = "update"
+	AuditActionDelete     = "delete"
+	AuditActionRestore    = "restore"
+	AuditActionRoleChange = "role_change"
+	AuditActionLogin      = "login"
+	AuditActionUnlock     = "unlock"
+)
+
+// FieldChange holds the value of a single field before and after a change.
+type FieldChange struct {
+	Before interface{} `json:"before"`
+	After  interface{} `json:"after"`
+}
+
+// AuditEntry records who did what to a user, and from where.
+type AuditEntry struct {
+	UserID    gocql.UUID             `json:"user_id"`
+	EventID   gocql.UUID             `json:"event_id"`
+	Timestamp time.Time              `json:"timestamp"`
+	Action    string                 `json:"action"`
+	Actor     string                 `json:"actor"`
+	Changes   map[string]FieldChange `json:"changes,omitempty"`
+	IP        string                 `json:"ip"`
+	UserAgent string                 `json:"user_agent"`
+	RequestID string                 `json:"request_id"`
+}
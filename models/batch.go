@@ -0,0 +1,23 @@
+package models
+
+// Batch lookup types accepted by the batch user endpoint.
+const (
+	LookupByID       = "id"
+	LookupByUsername = "username"
+	LookupBySubject  = "subject"
+)
+
+// UserLookup identifies one user in a batch request by ID, username or Keycloak subject.
+type UserLookup struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+// UserLookupResult is the outcome of one lookup, returned in the caller's order.
+type UserLookupResult struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+	Found bool   `json:"found"`
+	User  *User  `json:"user,omitempty"`
+	Error string `json:"error,omitempty"`
+}
@@ -0,0 +1,20 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+// IssuedCredential records a credential offer created for a user. CredentialData is the subject
+// data the credential was issued with.
+type IssuedCredential struct {
+	UserID                    gocql.UUID      `json:"user_id"`
+	IssuedAt                  time.Time       `json:"issued_at"`
+	IssuerID                  *gocql.UUID     `json:"issuer_id,omitempty"`
+	IssuerDID                 string          `json:"issuer_did"`
+	CredentialIssuer          string          `json:"credential_issuer"`
+	CredentialConfigurationID string          `json:"credential_configuration_id"`
+	CredentialData            json.RawMessage `json:"credential_data,omitempty"`
+}
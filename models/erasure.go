@@ -0,0 +1,43 @@
+package models
+
+import (
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+// Erasure job statuses.
+const (
+	ErasureStatusPending   = "pending"
+	ErasureStatusRunning   = "running"
+	ErasureStatusCompleted = "completed"
+	ErasureStatusFailed    = "failed"
+)
+
+// ErasureJob tracks the right-to-erasure workflow for one user. Completed steps are recorded as
+// they finish so that an interrupted job can be resumed without repeating work.
+type ErasureJob struct {
+	ID             gocql.UUID           `json:"id"`
+	UserID         gocql.UUID           `json:"user_id"`
+	Username       string               `json:"-"`
+	KeycloakID     string               `json:"-"`
+	Status         string               `json:"status"`
+	CompletedSteps map[string]time.Time `json:"completed_steps"`
+	RequestedBy    string               `json:"requested_by"`
+	CreatedAt      time.Time            `json:"created_at"`
+	UpdatedAt      time.Time            `json:"updated_at"`
+	Error          string               `json:"error,omitempty"`
+	TombstoneHash  string               `json:"tombstone_hash,omitempty"`
+}
+
+// ErasureTombstone is the proof that a user was erased. It holds no personal data: the subject
+// is only recorded as a keyed hash, and each tombstone is chained to the previous one by hash so
+// that removed or altered entries can be detected.
+type ErasureTombstone struct {
+	UserID      gocql.UUID `json:"user_id"`
+	SubjectHash string     `json:"subject_hash"`
+	ErasedAt    time.Time  `json:"erased_at"`
+	Steps       []string   `json:"steps"`
+	PrevHash    string     `json:"prev_hash"`
+	Hash        string     `json:"hash"`
+}
@@ -0,0 +1,27 @@
+package models
+
+import "time"
+
+// IP rule actions.
+const (
+	IPRuleAllow = "allow"
+	IPRuleDeny  = "deny"
+)
+
+// IPRule allows or denies a CIDR range on a route group. Groups are path prefixes such as
+// "/admin"; "/" covers every route.
+type IPRule struct {
+	ID        string     `json:"id"`
+	Group     string     `json:"group"`
+	CIDR      string     `json:"cidr"`
+	Action    string     `json:"action"`
+	Comment   string     `json:"comment,omitempty"`
+	CreatedBy string     `json:"created_by,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// Expired reports whether the rule has passed its expiry time.
+func (r *IPRule) Expired(now time.Time) bool {
+	return r.ExpiresAt != nil && !now.Before(*r.ExpiresAt)
+}
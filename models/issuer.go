@@ -0,0 +1,29 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+// Issuer statuses. Disabled issuers are kept but cannot issue credentials.
+const (
+	IssuerStatusActive   = "active"
+	IssuerStatusDisabled = "disabled"
+)
+
+// Issuer is an onboarded credential issuer. Key is the issuer key handed to the issuer service
+// on every issuance; it is never returned by the API, KeyRef identifies it instead.
+type Issuer struct {
+	ID              gocql.UUID      `json:"id"`
+	Name            string          `json:"name"`
+	DID             string          `json:"did"`
+	KeyRef          string          `json:"key_ref"`
+	CredentialTypes []string        `json:"credential_types"`
+	Owner           string          `json:"owner"`
+	Status          string          `json:"status"`
+	CreatedAt       time.Time       `json:"created_at"`
+	UpdatedAt       time.Time       `json:"updated_at"`
+	Key             json.RawMessage `json:"-"`
+}
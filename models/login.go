@@ -0,0 +1,34 @@
+package models
+
+import (
+	"time"
+
+	"github.com/gocql/gocql"
+)
+
+// LoginAttempt is a single entry in a user's login history.
+type LoginAttempt struct {
+	Username    string     `json:"username"`
+	UserID      gocql.UUID `json:"user_id,omitempty"`
+	AttemptedAt time.Time  `json:"attempted_at"`
+	Success     bool       `json:"success"`
+	IP          string     `json:"ip"`
+	UserAgent   string     `json:"user_agent"`
+	SessionID   string     `json:"session_id,omitempty"`
+}
+
+// Scopes a failed-login counter or lockout can apply to.
+const (
+	LoginScopeUsername = "username"
+	LoginScopeIP       = "ip"
+)
+
+// LoginLockout is sent to lockout notification hooks when too many logins have failed.
+type LoginLockout struct {
+	Scope       string    `json:"scope"`
+	Username    string    `json:"username"`
+	IP          string    `json:"ip"`
+	Failures    int       `json:"failures"`
+	LockedAt    time.Time `json:"locked_at"`
+	LockedUntil time.Time `json:"locked_until"`
+}
@@ -0,0 +1,13 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// PreferenceNamespace holds one application's preferences for a user.
+type PreferenceNamespace struct {
+	Namespace string                     `json:"namespace"`
+	Values    map[string]json.RawMessage `json:"values"`
+	UpdatedAt map[string]time.Time       `json:"updated_at"`
+}
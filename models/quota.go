@@ -0,0 +1,47 @@
+package models
+
+import "time"
+
+// QuotaTier is a plan assigned to callers by token role or client ID. A budget of zero is
+// unlimited.
+type QuotaTier struct {
+	Name    string   `json:"name" yaml:"name"`
+	Roles   []string `json:"roles,omitempty" yaml:"roles"`
+	Clients []string `json:"clients,omitempty" yaml:"clients"`
+	// PerMinute is the sustained request rate; Burst allows short spikes above it.
+	PerMinute int   `json:"per_minute" yaml:"per_minute"`
+	Burst     int   `json:"burst" yaml:"burst"`
+	Daily     int64 `json:"daily" yaml:"daily"`
+	Monthly   int64 `json:"monthly" yaml:"monthly"`
+}
+
+// QuotaOverride replaces parts of a subject's tier. Nil fields keep the tier's value.
+type QuotaOverride struct {
+	Tier      string     `json:"tier,omitempty"`
+	PerMinute *int       `json:"per_minute,omitempty"`
+	Burst     *int       `json:"burst,omitempty"`
+	Daily     *int64     `json:"daily,omitempty"`
+	Monthly   *int64     `json:"monthly,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	Reason    string     `json:"reason,omitempty"`
+	CreatedBy string     `json:"created_by,omitempty"`
+}
+
+// QuotaBudget is the usage of one calendar period.
+type QuotaBudget struct {
+	Limit     int64     `json:"limit"`
+	Used      int64     `json:"used"`
+	Remaining int64     `json:"remaining"`
+	ResetsAt  time.Time `json:"resets_at"`
+}
+
+// QuotaUsage is what GET /me/quota reports.
+type QuotaUsage struct {
+	Subject   string         `json:"subject"`
+	Tier      string         `json:"tier"`
+	PerMinute int            `json:"per_minute"`
+	Burst     int            `json:"burst"`
+	Daily     QuotaBudget    `json:"daily"`
+	Monthly   QuotaBudget    `json:"monthly"`
+	Override  *QuotaOverride `json:"override,omitempty"`
+}
@@ -1,13 +1,26 @@
 package models
 
 import (
+	"time"
+
 	"github.com/gocql/gocql"
 )
 
 type User struct {
-	ID        gocql.UUID `json:"id"`
-	Username  string     `json:"username" validate:"required,min=3,max=32"`
-	Email     string     `json:"email" validate:"required,email"`
-	FirstName string     `json:"firstname"`
-	LastName  string     `json:"lastname"`
+	ID          gocql.UUID        `json:"id"`
+	Username    string            `json:"username" validate:"required,min=3,max=32"`
+	Email       string            `json:"email" validate:"required,email"`
+	FirstName   string            `json:"firstname"`
+	LastName    string            `json:"lastname"`
+	Attributes  map[string]string `json:"attributes,omitempty"`
+	KeycloakID  string            `json:"keycloak_id,omitempty"`
+	LastLoginAt *time.Time        `json:"last_login_at,omitempty"`
+	LoginCount  int               `json:"login_count"`
+	DeletedAt   *time.Time        `json:"deleted_at,omitempty"`
+	DeletedBy   string            `json:"deleted_by,omitempty"`
+}
+
+// IsDeleted reports whether the user has been soft deleted.
+func (u *User) IsDeleted() bool {
+	return u.DeletedAt != nil
 }
@@ -0,0 +1,231 @@
+// Package oid4vc is a client for the OpenID for Verifiable Credentials issuer and verifier
+// services (walt.id's issuer-api and verifier-api).
+package oid4vc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// maxResponseBytes caps how much of a response is read.
+const maxResponseBytes = 1 << 20
+
+// ErrInvalidOffer is returned when the issuer answers with something that is not a usable
+// credential offer.
+var ErrInvalidOffer = errors.New("invalid credential offer")
+
+// Error is returned when the issuer or verifier answers with an error status.
+type Error struct {
+	Service    string
+	Operation  string
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s %s failed: status %d: %s", e.Service, e.Operation, e.StatusCode, e.Message)
+}
+
+// Config configures a Client. Headers are sent with every request to the respective service,
+// typically an Authorization header.
+type Config struct {
+	IssuerURL       string
+	VerifierURL     string
+	Timeout         time.Duration
+	IssuerHeaders   http.Header
+	VerifierHeaders http.Header
+	HostRewrites    []HostRewrite
+}
+
+// Client calls the issuer and verifier services.
+type Client struct {
+	cfg  Config
+	http *http.Client
+}
+
+func New(cfg Config) *Client {
+	cfg.IssuerURL = strings.TrimSuffix(cfg.IssuerURL, "/")
+	cfg.VerifierURL = strings.TrimSuffix(cfg.VerifierURL, "/")
+	return &Client{cfg: cfg, http: &http.Client{Timeout: cfg.Timeout}}
+}
+
+// OnboardIssuerRequest asks the issuer to generate a key and a DID for a new issuer.
+type OnboardIssuerRequest struct {
+	Key json.RawMessage `json:"key"`
+	DID json.RawMessage `json:"did"`
+}
+
+// IssuerOnboarding is a generated issuer key (a JWK, or a reference to a key held by a KMS) and
+// the DID derived from it.
+type IssuerOnboarding struct {
+	IssuerKey json.RawMessage `json:"issuerKey"`
+	IssuerDID string          `json:"issuerDid"`
+}
+
+// IssuanceRequest describes the credential to offer and the issuer that signs it.
+type IssuanceRequest struct {
+	IssuerKey                 json.RawMessage `json:"issuerKey"`
+	IssuerDID                 string          `json:"issuerDid"`
+	CredentialConfigurationID string          `json:"credentialConfigurationId"`
+	CredentialData            json.RawMessage `json:"credentialData"`
+	Mapping                   json.RawMessage `json:"mapping,omitempty"`
+	SelectiveDisclosure       json.RawMessage `json:"selectiveDisclosure,omitempty"`
+	AuthenticationMethod      string          `json:"authenticationMethod,omitempty"`
+}
+
+// CredentialOffer is the offer a wallet redeems for the credential. Credentials holds the
+// offered credentials under pre-final drafts, which predate CredentialConfigurationIDs.
+type CredentialOffer struct {
+	CredentialIssuer           string                     `json:"credential_issuer"`
+	CredentialConfigurationIDs []string                   `json:"credential_configuration_ids,omitempty"`
+	Credentials                json.RawMessage            `json:"credentials,omitempty"`
+	Grants                     map[string]json.RawMessage `json:"grants,omitempty"`
+}
+
+// VerificationRequest is the authorization request a wallet answers with a presentation, and
+// the state under which the verifier tracks the session.
+type VerificationRequest struct {
+	URL   string `json:"url"`
+	State string `json:"state,omitempty"`
+}
+
+// OnboardIssuer generates a key and a DID for a new issuer.
+func (c *Client) OnboardIssuer(ctx context.Context, req OnboardIssuerRequest) (*IssuerOnboarding, error) {
+	body, err := c.post(ctx, "issuer", "onboarding", c.cfg.IssuerURL+"/onboard/issuer", c.cfg.IssuerHeaders, req)
+	if err != nil {
+		return nil, err
+	}
+	var onboarding IssuerOnboarding
+	if err := json.Unmarshal(body, &onboarding); err != nil {
+		return nil, fmt.Errorf("decode issuer onboarding: %w", err)
+	}
+	return &onboarding, nil
+}
+
+// IssueCredential creates a JWT credential offer and resolves it, returning the offer itself
+// rather than the openid-credential-offer:// link to it.
+func (c *Client) IssueCredential(ctx context.Context, req IssuanceRequest) (*CredentialOffer, error) {
+	body, err := c.post(ctx, "issuer", "issuance", c.cfg.IssuerURL+"/openid4vc/jwt/issue", c.cfg.IssuerHeaders, req)
+	if err != nil {
+		return nil, err
+	}
+	offerURL, err := c.offerURL(strings.TrimSpace(string(body)))
+	if err != nil {
+		return nil, err
+	}
+	// The offer URI comes from the issuer's response, so the issuer credentials only go along
+	// when it points back at the configured issuer.
+	var headers http.Header
+	if sameOrigin(offerURL, c.cfg.IssuerURL) {
+		headers = c.cfg.IssuerHeaders
+	}
+	body, err = c.do(ctx, "issuer", "offer retrieval", http.MethodGet, offerURL.String(), headers, nil)
+	if err != nil {
+		return nil, err
+	}
+	var offer CredentialOffer
+	if err := json.Unmarshal(body, &offer); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidOffer, err)
+	}
+	return &offer, nil
+}
+
+// Verify starts a verification session. The request body (requested credentials and policies)
+// is passed to the verifier as is.
+func (c *Client) Verify(ctx context.Context, req json.RawMessage) (*VerificationRequest, error) {
+	body, err := c.post(ctx, "verifier", "verification", c.cfg.VerifierURL+"/openid4vc/verify", c.cfg.VerifierHeaders, req)
+	if err != nil {
+		return nil, err
+	}
+	raw := strings.TrimSpace(string(body))
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme == "" {
+		return nil, fmt.Errorf("verifier returned an invalid authorization request %q", raw)
+	}
+	return &VerificationRequest{URL: raw, State: u.Query().Get("state")}, nil
+}
+
+// offerURL extracts the credential_offer_uri from an openid-credential-offer:// link and applies
+// the host rewrites to it.
+func (c *Client) offerURL(link string) (*url.URL, error) {
+	u, err := url.Parse(link)
+	if err != nil || u.Scheme != "openid-credential-offer" {
+		return nil, fmt.Errorf("%w: unexpected link %q", ErrInvalidOffer, link)
+	}
+	offerURI := u.Query().Get("credential_offer_uri")
+	if offerURI == "" {
+		return nil, fmt.Errorf("%w: missing credential_offer_uri", ErrInvalidOffer)
+	}
+	offer, err := url.Parse(offerURI)
+	if err != nil || (offer.Scheme != "http" && offer.Scheme != "https") {
+		return nil, fmt.Errorf("%w: invalid credential_offer_uri %q", ErrInvalidOffer, offerURI)
+	}
+	rewriteURL(offer, c.cfg.HostRewrites)
+	return offer, nil
+}
+
+// sameOrigin reports whether u has the scheme and host of base, an absolute URL. Default ports
+// are spelled out so that https://issuer and https://issuer:443 compare equal.
+func sameOrigin(u *url.URL, base string) bool {
+	b, err := url.Parse(base)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Scheme, b.Scheme) && originHost(u) == originHost(b)
+}
+
+func originHost(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		port = map[string]string{"http": "80", "https": "443"}[strings.ToLower(u.Scheme)]
+	}
+	return net.JoinHostPort(strings.ToLower(u.Hostname()), port)
+}
+
+func (c *Client) post(ctx context.Context, service, operation, target string, headers http.Header, payload interface{}) ([]byte, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	return c.do(ctx, service, operation, http.MethodPost, target, headers, body)
+}
+
+func (c *Client) do(ctx context.Context, service, operation, method, target string, headers http.Header, body []byte) ([]byte, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, target, reader)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range headers {
+		req.Header[name] = values
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %w", service, operation, err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseBytes))
+	if err != nil {
+		return nil, fmt.Errorf("%s %s: %w", service, operation, err)
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return nil, &Error{Service: service, Operation: operation, StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(data))}
+	}
+	return data, nil
+}
@@ -0,0 +1,104 @@
+package oid4vc
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestIssueCredentialOfferHeaders(t *testing.T) {
+	// offerAuth records the Authorization header each offer server received.
+	offerAuth := map[string]string{}
+	offerServer := func(name string) *httptest.Server {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			offerAuth[name] = r.Header.Get("Authorization")
+			fmt.Fprint(w, `{"credential_issuer":"https://issuer.example.com","credential_configuration_ids":["UniversityDegree_jwt_vc_json"]}`)
+		}))
+		t.Cleanup(srv.Close)
+		return srv
+	}
+	other := offerServer("other")
+
+	var offerURI string
+	issuer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/openid4vc/jwt/issue" {
+			fmt.Fprint(w, "openid-credential-offer://?credential_offer_uri="+url.QueryEscape(offerURI))
+			return
+		}
+		offerAuth["issuer"] = r.Header.Get("Authorization")
+		fmt.Fprint(w, `{"credential_issuer":"https://issuer.example.com"}`)
+	}))
+	defer issuer.Close()
+	issuerHost := strings.TrimPrefix(issuer.URL, "http://")
+	_, issuerPort, _ := strings.Cut(issuerHost, ":")
+
+	tests := []struct {
+		name     string
+		offerURI string
+		rewrites []HostRewrite
+		server   string
+	}{
+		{"issuer", issuer.URL + "/openid4vc/credentialOffer?id=1", nil, "issuer"},
+		{"issuer rewritten", "http://issuer.example.com:" + issuerPort + "/openid4vc/credentialOffer?id=1",
+			[]HostRewrite{{From: "issuer.example.com", To: "127.0.0.1"}}, "issuer"},
+		{"other host", other.URL + "/openid4vc/credentialOffer?id=1", nil, "other"},
+		{"rewritten to other host", "http://issuer.example.com/openid4vc/credentialOffer?id=1",
+			[]HostRewrite{{From: "issuer.example.com", To: strings.TrimPrefix(other.URL, "http://")}}, "other"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clear(offerAuth)
+			offerURI = tt.offerURI
+			client := New(Config{
+				IssuerURL:     issuer.URL + "/",
+				IssuerHeaders: http.Header{"Authorization": {"Bearer secret"}},
+				HostRewrites:  tt.rewrites,
+			})
+			offer, err := client.IssueCredential(context.Background(), IssuanceRequest{})
+			if err != nil {
+				t.Fatalf("IssueCredential() error = %v", err)
+			}
+			if offer.CredentialIssuer != "https://issuer.example.com" {
+				t.Errorf("IssueCredential() offer = %+v", offer)
+			}
+			auth, ok := offerAuth[tt.server]
+			if !ok {
+				t.Fatalf("offer not fetched from %s: %v", tt.server, offerAuth)
+			}
+			want := ""
+			if tt.server == "issuer" {
+				want = "Bearer secret"
+			}
+			if auth != want {
+				t.Errorf("offer request to %s carried Authorization %q, want %q", tt.server, auth, want)
+			}
+		})
+	}
+}
+
+func TestSameOrigin(t *testing.T) {
+	tests := []struct {
+		url, base string
+		want      bool
+	}{
+		{"https://issuer.example.com/offer", "https://issuer.example.com", true},
+		{"https://Issuer.Example.com:443/offer", "https://issuer.example.com", true},
+		{"http://issuer.example.com/offer", "https://issuer.example.com", false},
+		{"https://issuer.example.com:8443/offer", "https://issuer.example.com", false},
+		{"https://issuer.example.com.evil.test/offer", "https://issuer.example.com", false},
+		{"https://evil.test/issuer.example.com", "https://issuer.example.com", false},
+	}
+	for _, tt := range tests {
+		u, err := url.Parse(tt.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := sameOrigin(u, tt.base); got != tt.want {
+			t.Errorf("sameOrigin(%q, %q) = %v, want %v", tt.url, tt.base, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package oid4vc
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// HostRewrite replaces the host of URLs the issuer hands out before the client follows them.
+// The issuer advertises itself under its public name, which is not always reachable from here
+// (host.docker.internal from outside Docker, say). A From without a port matches any port and
+// keeps it unless To names one.
+type HostRewrite struct {
+	From string
+	To   string
+}
+
+// ParseHostRewrites parses rules of the form "from=to", e.g. "host.docker.internal=localhost" or
+// "issuer.example.com:443=issuer:7002".
+func ParseHostRewrites(rules []string) ([]HostRewrite, error) {
+	var rewrites []HostRewrite
+	for _, rule := range rules {
+		from, to, ok := strings.Cut(rule, "=")
+		from, to = strings.TrimSpace(from), strings.TrimSpace(to)
+		if !ok || from == "" || to == "" {
+			return nil, fmt.Errorf("invalid host rewrite %q, expected from=to", rule)
+		}
+		rewrites = append(rewrites, HostRewrite{From: strings.ToLower(from), To: to})
+	}
+	return rewrites, nil
+}
+
+// rewriteURL applies the first matching rule to u's host.
+func rewriteURL(u *url.URL, rewrites []HostRewrite) {
+	host := strings.ToLower(u.Host)
+	hostname, port := strings.ToLower(u.Hostname()), u.Port()
+	for _, r := range rewrites {
+		switch {
+		case r.From == host:
+			u.Host = r.To
+		case r.From == hostname:
+			if _, _, err := net.SplitHostPort(r.To); err == nil || port == "" {
+				u.Host = r.To
+			} else {
+				u.Host = net.JoinHostPort(r.To, port)
+			}
+		default:
+			continue
+		}
+		return
+	}
+}
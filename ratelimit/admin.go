@@ -0,0 +1,220 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Override temporarily replaces the limits of every policy for one subject. Zero fields keep
+// the policy's value.
+type Override struct {
+	Limit     int
+	Window    time.Duration
+	Burst     *int
+	Reason    string
+	CreatedBy string
+	ExpiresAt time.Time
+}
+
+// Bucket is the state of one of a subject's rate limit keys.
+type Bucket struct {
+	Key string
+	// Rule is the name of the rule whose requests the bucket counts.
+	Rule      string
+	Algorithm string
+	// Requests is the number of requests in the current window (sliding window).
+	Requests int
+	// OldestRequestAt and NewestRequestAt bound the current window (sliding window).
+	OldestRequestAt *time.Time
+	NewestRequestAt *time.Time
+	// Tokens is what was left in the bucket at RefilledAt (token bucket).
+	Tokens     *float64
+	RefilledAt *time.Time
+	// ExpiresIn is how long until the key expires, at which point the subject is back to a full
+	// allowance under this rule.
+	ExpiresIn time.Duration
+}
+
+// OverrideKey is the Valkey key of a subject's override.
+func OverrideKey(subject string) string {
+	return "rate_override:" + subject
+}
+
+// Buckets lists the subject's rate limit keys, walking the keyspace with SCAN.
+func (l *Limiter) Buckets(ctx context.Context, subject string) ([]Bucket, error) {
+	keys, err := l.scanSubject(ctx, subject)
+	if err != nil || len(keys) == 0 {
+		return nil, err
+	}
+
+	pipe := l.client.Pipeline()
+	types := make([]*redis.StatusCmd, len(keys))
+	ttls := make([]*redis.DurationCmd, len(keys))
+	oldest := make([]*redis.ZSliceCmd, len(keys))
+	newest := make([]*redis.ZSliceCmd, len(keys))
+	counts := make([]*redis.IntCmd, len(keys))
+	states := make([]*redis.SliceCmd, len(keys))
+	for i, key := range keys {
+		types[i] = pipe.Type(ctx, key)
+		ttls[i] = pipe.PTTL(ctx, key)
+	}
+	if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+		return nil, err
+	}
+	for i, key := range keys {
+		switch types[i].Val() {
+		case "zset":
+			counts[i] = pipe.ZCard(ctx, key)
+			oldest[i] = pipe.ZRangeWithScores(ctx, key, 0, 0)
+			newest[i] = pipe.ZRangeWithScores(ctx, key, -1, -1)
+		case "hash":
+			states[i] = pipe.HMGet(ctx, key, "tokens", "ts")
+		}
+	}
+	if _, err := pipe.Exec(ctx); err != nil && !errors.Is(err, redis.Nil) {
+		return nil, err
+	}
+
+	buckets := make([]Bucket, 0, len(keys))
+	prefix := Key(subject, "")
+	for i, key := range keys {
+		b := Bucket{Key: key, Rule: strings.TrimPrefix(key, prefix), ExpiresIn: max(ttls[i].Val(), 0)}
+		switch types[i].Val() {
+		case "zset":
+			b.Algorithm = AlgorithmSlidingWindow
+			b.Requests = int(counts[i].Val())
+			if members := oldest[i].Val(); len(members) > 0 {
+				at := time.UnixMilli(int64(members[0].Score)).UTC()
+				b.OldestRequestAt = &at
+			}
+			if members := newest[i].Val(); len(members) > 0 {
+				at := time.UnixMilli(int64(members[0].Score)).UTC()
+				b.NewestRequestAt = &at
+			}
+		case "hash":
+			b.Algorithm = AlgorithmTokenBucket
+			values := states[i].Val()
+			if tokens, err := strconv.ParseFloat(stringValue(values[0]), 64); err == nil {
+				b.Tokens = &tokens
+			}
+			if ts, err := strconv.ParseInt(stringValue(values[1]), 10, 64); err == nil {
+				refilled := time.UnixMilli(ts).UTC()
+				b.RefilledAt = &refilled
+			}
+		default:
+			// Expired between SCAN and TYPE
+			continue
+		}
+		buckets = append(buckets, b)
+	}
+	return buckets, nil
+}
+
+// Reset deletes the subject's bucket for the named rule, or all of its buckets if rule is empty,
+// and returns how many were removed.
+func (l *Limiter) Reset(ctx context.Context, subject, rule string) (int64, error) {
+	if rule != "" {
+		return l.client.Del(ctx, Key(subject, rule)).Result()
+	}
+	keys, err := l.scanSubject(ctx, subject)
+	if err != nil || len(keys) == 0 {
+		return 0, err
+	}
+	return l.client.Del(ctx, keys...).Result()
+}
+
+// scanSubject returns the subject's bucket keys. The ":rule:" marker keeps a subject from picking
+// up the keys of another subject it is a prefix of, such as 2001:db8::1 and 2001:db8::1:5.
+func (l *Limiter) scanSubject(ctx context.Context, subject string) ([]string, error) {
+	prefix := Key(subject, "")
+	pattern := escapeGlob(prefix) + "*"
+	var keys []string
+	var cursor uint64
+	for {
+		batch, next, err := l.client.Scan(ctx, cursor, pattern, 500).Result()
+		if err != nil {
+			return nil, err
+		}
+		for _, key := range batch {
+			keys = append(keys, key)
+		}
+		if cursor = next; cursor == 0 {
+			return keys, nil
+		}
+	}
+}
+
+// SetOverride stores a temporary override for the subject. It expires at o.ExpiresAt.
+func (l *Limiter) SetOverride(ctx context.Context, subject string, o Override) error {
+	ttl := time.Until(o.ExpiresAt)
+	if ttl <= 0 {
+		return errors.New("override must expire in the future")
+	}
+	fields := map[string]interface{}{
+		"reason":     o.Reason,
+		"created_by": o.CreatedBy,
+		"expires_at": o.ExpiresAt.UTC().Format(time.RFC3339),
+	}
+	if o.Limit > 0 {
+		fields["limit"] = o.Limit
+	}
+	if o.Window > 0 {
+		fields["window_ms"] = o.Window.Milliseconds()
+	}
+	if o.Burst != nil {
+		fields["burst"] = *o.Burst
+	}
+	key := OverrideKey(subject)
+	pipe := l.client.TxPipeline()
+	pipe.Del(ctx, key)
+	pipe.HSet(ctx, key, fields)
+	pipe.PExpire(ctx, key, ttl)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// GetOverride returns the subject's override, or nil if it has none.
+func (l *Limiter) GetOverride(ctx context.Context, subject string) (*Override, error) {
+	fields, err := l.client.HGetAll(ctx, OverrideKey(subject)).Result()
+	if err != nil || len(fields) == 0 {
+		return nil, err
+	}
+	o := &Override{Reason: fields["reason"], CreatedBy: fields["created_by"]}
+	o.Limit, _ = strconv.Atoi(fields["limit"])
+	if ms, err := strconv.ParseInt(fields["window_ms"], 10, 64); err == nil {
+		o.Window = time.Duration(ms) * time.Millisecond
+	}
+	if burst, err := strconv.Atoi(fields["burst"]); err == nil {
+		o.Burst = &burst
+	}
+	o.ExpiresAt, _ = time.Parse(time.RFC3339, fields["expires_at"])
+	return o, nil
+}
+
+// DeleteOverride removes the subject's override.
+func (l *Limiter) DeleteOverride(ctx context.Context, subject string) error {
+	return l.client.Del(ctx, OverrideKey(subject)).Err()
+}
+
+func stringValue(v interface{}) string {
+	s, _ := v.(string)
+	return s
+}
+
+// escapeGlob escapes the characters SCAN MATCH treats specially.
+func escapeGlob(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch r {
+		case '*', '?', '[', ']', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,115 @@
+package ratelimit
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// acquireScript takes a slot in a semaphore kept as a sorted set of lease IDs scored by lease
+// expiry in ms. Leases of crashed requests are dropped once they expire.
+// ARGV: limit, lease_ms, lease_id. Returns {acquired, in_flight, retry_ms}.
+var acquireScript = redis.NewScript(`
+local key = KEYS[1]
+local limit = tonumber(ARGV[1])
+local lease = tonumber(ARGV[2])
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+
+redis.call('ZREMRANGEBYSCORE', key, '-inf', now)
+local count = redis.call('ZCARD', key)
+if count < limit then
+  redis.call('ZADD', key, now + lease, ARGV[3])
+  redis.call('PEXPIRE', key, lease)
+  return {1, count + 1, 0}
+end
+local first = redis.call('ZRANGE', key, 0, 0, 'WITHSCORES')
+return {0, count, tonumber(first[2]) - now}
+`)
+
+// renewScript extends a lease that is still held. ARGV: lease_ms, lease_id.
+var renewScript = redis.NewScript(`
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+local renewed = redis.call('ZADD', KEYS[1], 'XX', 'CH', now + tonumber(ARGV[1]), ARGV[2])
+if renewed == 1 and redis.call('PTTL', KEYS[1]) < tonumber(ARGV[1]) then
+  redis.call('PEXPIRE', KEYS[1], ARGV[1])
+end
+return renewed
+`)
+
+// Semaphore limits how many requests a subject may have in flight on a route, across instances.
+type Semaphore struct {
+	client *redis.Client
+	limit  int
+	lease  time.Duration
+}
+
+// Lease is a held semaphore slot. Release it when the request finishes.
+type Lease struct {
+	sem  *Semaphore
+	key  string
+	id   string
+	stop chan struct{}
+}
+
+// NewSemaphore allows limit concurrent requests per key. A lease that is not renewed, because
+// its instance died, frees its slot after lease.
+func NewSemaphore(client *redis.Client, limit int, lease time.Duration) *Semaphore {
+	return &Semaphore{client: client, limit: limit, lease: lease}
+}
+
+// InflightKey is the Valkey key of a subject's semaphore for a route.
+func InflightKey(subject, route string) string {
+	return "inflight:" + subject + ":" + route
+}
+
+// Acquire takes a slot for key. If none is free it returns a nil lease and how long until the
+// oldest lease expires at the latest.
+func (s *Semaphore) Acquire(ctx context.Context, key string) (*Lease, time.Duration, error) {
+	buf := make([]byte, 12)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, 0, err
+	}
+	id := hex.EncodeToString(buf)
+	raw, err := acquireScript.Run(ctx, s.client, []string{key}, s.limit, s.lease.Milliseconds(), id).Int64Slice()
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(raw) != 3 {
+		return nil, 0, fmt.Errorf("unexpected semaphore script result %v", raw)
+	}
+	if raw[0] == 0 {
+		return nil, time.Duration(raw[2]) * time.Millisecond, nil
+	}
+	lease := &Lease{sem: s, key: key, id: id, stop: make(chan struct{})}
+	go lease.keepAlive()
+	return lease, 0, nil
+}
+
+// keepAlive renews the lease while the request is still running, so that slow requests keep
+// their slot while crashed ones lose it.
+func (l *Lease) keepAlive() {
+	ticker := time.NewTicker(l.sem.lease / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), l.sem.lease/3)
+			renewScript.Run(ctx, l.sem.client, []string{l.key}, l.sem.lease.Milliseconds(), l.id)
+			cancel()
+		}
+	}
+}
+
+// Release frees the slot.
+func (l *Lease) Release(ctx context.Context) error {
+	close(l.stop)
+	return l.sem.client.ZRem(ctx, l.key, l.id).Err()
+}
@@ -0,0 +1,188 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// What to do with requests while Valkey is unreachable.
+const (
+	// FailureModeLocal enforces policies with per-instance token buckets.
+	FailureModeLocal = "local"
+	// FailureModeOpen lets every request through.
+	FailureModeOpen = "open"
+	// FailureModeClosed rejects every request.
+	FailureModeClosed = "closed"
+)
+
+var (
+	// ErrFailOpen is returned instead of a result when the request should go through unlimited.
+	ErrFailOpen = errors.New("rate limiter unavailable, failing open")
+	// ErrUnavailable is returned when the request should be rejected because Valkey is down.
+	ErrUnavailable = errors.New("rate limiter unavailable")
+)
+
+var metrics = expvar.NewMap("rate_limiter")
+
+// Guarded wraps a Limiter and switches to the failure mode while Valkey is unreachable. A
+// background health check brings it back once Valkey answers again.
+type Guarded struct {
+	remote *Limiter
+	local  *LocalLimiter
+	client *redis.Client
+	mode   string
+
+	degraded atomic.Bool
+
+	mu            sync.Mutex
+	degradedSince time.Time
+	degradedTotal time.Duration
+}
+
+func NewGuarded(client *redis.Client, mode string) (*Guarded, error) {
+	switch mode {
+	case FailureModeLocal, FailureModeOpen, FailureModeClosed:
+	default:
+		return nil, fmt.Errorf("unknown rate limit failure mode %q", mode)
+	}
+	g := &Guarded{remote: New(client), local: NewLocal(), client: client, mode: mode}
+	metrics.Set("failure_mode", stringVar(mode))
+	metrics.Set("degraded", expvar.Func(func() interface{} {
+		if g.degraded.Load() {
+			return 1
+		}
+		return 0
+	}))
+	metrics.Set("degraded_seconds_total", expvar.Func(func() interface{} {
+		return g.DegradedTime().Seconds()
+	}))
+	return g, nil
+}
+
+// Allow checks the request against Valkey, applying the override in overrideKey if there is one,
+// or against the failure mode while Valkey is down. Overrides are not applied locally.
+func (g *Guarded) Allow(ctx context.Context, key, overrideKey string, p Policy) (Result, error) {
+	if !g.degraded.Load() {
+		result, err := g.remote.AllowWithOverride(ctx, key, overrideKey, p)
+		if err == nil || !isConnectionError(err) {
+			return result, err
+		}
+		g.markDegraded(err)
+	}
+
+	switch g.mode {
+	case FailureModeOpen:
+		metrics.Add("fail_open", 1)
+		return Result{}, ErrFailOpen
+	case FailureModeClosed:
+		metrics.Add("fail_closed", 1)
+		return Result{}, ErrUnavailable
+	default:
+		metrics.Add("local_checks", 1)
+		return g.local.Allow(key, p), nil
+	}
+}
+
+// Mode is the failure mode applied while Valkey is unreachable.
+func (g *Guarded) Mode() string {
+	return g.mode
+}
+
+// ReportError lets other users of Valkey share the health state: an error showing that Valkey
+// is unreachable marks the limiter degraded until the health check succeeds again.
+func (g *Guarded) ReportError(err error) {
+	if err != nil && isConnectionError(err) {
+		g.markDegraded(err)
+	}
+}
+
+// Degraded reports whether Valkey is currently considered unreachable.
+func (g *Guarded) Degraded() bool {
+	return g.degraded.Load()
+}
+
+// DegradedTime is the total time spent degraded since startup, including the current outage.
+func (g *Guarded) DegradedTime() time.Duration {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	total := g.degradedTotal
+	if !g.degradedSince.IsZero() {
+		total += time.Since(g.degradedSince)
+	}
+	return total
+}
+
+// Monitor pings Valkey every interval, marking the limiter degraded when the ping fails and
+// recovering when it succeeds. It runs until ctx is cancelled.
+func (g *Guarded) Monitor(ctx context.Context, interval time.Duration) {
+	g.check(ctx, interval)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			g.check(ctx, interval)
+			g.local.Prune()
+		}
+	}
+}
+
+func (g *Guarded) check(ctx context.Context, timeout time.Duration) {
+	pingCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	if err := g.client.Ping(pingCtx).Err(); err != nil {
+		g.markDegraded(err)
+		return
+	}
+	g.markHealthy()
+}
+
+func (g *Guarded) markDegraded(err error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.degraded.Load() {
+		return
+	}
+	g.degraded.Store(true)
+	g.degradedSince = time.Now()
+	metrics.Add("degraded_events", 1)
+	log.Printf("Valkey unreachable, rate limiting degraded (%s): %v", g.mode, err)
+}
+
+func (g *Guarded) markHealthy() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if !g.degraded.Load() {
+		return
+	}
+	outage := time.Since(g.degradedSince)
+	g.degradedTotal += outage
+	g.degradedSince = time.Time{}
+	g.degraded.Store(false)
+	// Counts kept during the outage are per instance and not worth carrying over
+	g.local.Reset()
+	log.Printf("Valkey reachable again after %s, rate limiting recovered", outage.Round(time.Millisecond))
+}
+
+// isConnectionError tells an unreachable Valkey apart from errors the server returned.
+func isConnectionError(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	var serverErr redis.Error
+	return !errors.As(err, &serverErr)
+}
+
+type stringVar string
+
+func (s stringVar) String() string { return fmt.Sprintf("%q", string(s)) }
@@ -0,0 +1,55 @@
+package ratelimit
+
+import (
+	"math"
+	"strconv"
+	"time"
+)
+
+// HeaderSetter is implemented by *fiber.Ctx and http.Header.
+type HeaderSetter interface {
+	Set(key, value string)
+}
+
+// SetHeaders writes the IETF draft RateLimit-* headers and their legacy X-RateLimit-*
+// equivalents for a result, and Retry-After when the request was rejected.
+func SetHeaders(h HeaderSetter, r Result) {
+	p := r.Policy
+	limit := r.Limit
+	if p.Algorithm == AlgorithmTokenBucket {
+		// A full bucket holds the burst allowance on top of the steady rate
+		limit += p.Burst
+	}
+	reset := strconv.FormatInt(Seconds(r.ResetAfter), 10)
+
+	h.Set("RateLimit-Limit", strconv.Itoa(limit))
+	h.Set("RateLimit-Remaining", strconv.Itoa(r.Remaining))
+	h.Set("RateLimit-Reset", reset)
+	h.Set("RateLimit-Policy", PolicyHeader(p))
+
+	h.Set("X-RateLimit-Limit", strconv.Itoa(limit))
+	h.Set("X-RateLimit-Remaining", strconv.Itoa(r.Remaining))
+	// The legacy header carries the reset time as a Unix timestamp
+	h.Set("X-RateLimit-Reset", strconv.FormatInt(time.Now().Add(r.ResetAfter).Unix(), 10))
+
+	if !r.Allowed {
+		h.Set("Retry-After", strconv.FormatInt(max(Seconds(r.RetryAfter), 1), 10))
+	}
+}
+
+// PolicyHeader formats a policy as a RateLimit-Policy value, e.g. "5;w=60" or "10;w=60;burst=5".
+func PolicyHeader(p Policy) string {
+	value := strconv.Itoa(p.Limit) + ";w=" + strconv.FormatInt(Seconds(p.Window), 10)
+	if p.Algorithm == AlgorithmTokenBucket && p.Burst > 0 {
+		value += ";burst=" + strconv.Itoa(p.Burst)
+	}
+	return value
+}
+
+// Seconds rounds a duration up to whole seconds, as the headers require.
+func Seconds(d time.Duration) int64 {
+	if d <= 0 {
+		return 0
+	}
+	return int64(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,172 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Both scripts read the clock from Valkey so that every instance agrees on time. KEYS[1] is the
+// bucket; the optional KEYS[2] is an override hash whose limit, window_ms and burst fields take
+// precedence over the policy. A bucket holding another data type (for example after a policy
+// switched algorithm) is reset. Both return
+// {allowed, remaining, reset_ms, retry_ms, limit, window_ms, burst}.
+
+const overridePrelude = `
+local limit = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local burst = tonumber(ARGV[3])
+if KEYS[2] then
+  local o = redis.call('HMGET', KEYS[2], 'limit', 'window_ms', 'burst')
+  limit = tonumber(o[1]) or limit
+  window = tonumber(o[2]) or window
+  burst = tonumber(o[3]) or burst
+end
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000 + math.floor(tonumber(t[2]) / 1000)
+`
+
+// slidingWindowScript keeps one sorted-set member per allowed request, scored by time in ms. Up
+// to limit+burst requests are allowed in any window.
+// ARGV: limit, window_ms, burst, member.
+var slidingWindowScript = redis.NewScript(overridePrelude + `
+local key = KEYS[1]
+local kind = redis.call('TYPE', key).ok
+if kind ~= 'none' and kind ~= 'zset' then
+  redis.call('DEL', key)
+end
+
+local capacity = limit + burst
+redis.call('ZREMRANGEBYSCORE', key, '-inf', now - window)
+local count = redis.call('ZCARD', key)
+local allowed = 0
+if count < capacity then
+  redis.call('ZADD', key, now, now .. '-' .. ARGV[4])
+  count = count + 1
+  allowed = 1
+end
+redis.call('PEXPIRE', key, window)
+
+local reset = 0
+local oldest = redis.call('ZRANGE', key, 0, 0, 'WITHSCORES')
+if oldest[2] then
+  reset = tonumber(oldest[2]) + window - now
+end
+local retry = 0
+if allowed == 0 then
+  retry = reset
+end
+return {allowed, math.max(capacity - count, 0), reset, retry, limit, window, burst}
+`)
+
+// tokenBucketScript stores the token count and the time it was last refilled in a hash. The
+// bucket holds limit+burst tokens and refills limit tokens per window.
+// ARGV: limit, window_ms, burst.
+var tokenBucketScript = redis.NewScript(overridePrelude + `
+local key = KEYS[1]
+local kind = redis.call('TYPE', key).ok
+if kind ~= 'none' and kind ~= 'hash' then
+  redis.call('DEL', key)
+end
+
+local rate = limit / window
+local capacity = limit + burst
+local state = redis.call('HMGET', key, 'tokens', 'ts')
+local tokens = tonumber(state[1]) or capacity
+local ts = tonumber(state[2]) or now
+tokens = math.min(capacity, tokens + math.max(0, now - ts) * rate)
+
+local allowed = 0
+local retry = 0
+if tokens >= 1 then
+  tokens = tokens - 1
+  allowed = 1
+else
+  retry = math.ceil((1 - tokens) / rate)
+end
+redis.call('HSET', key, 'tokens', tostring(tokens), 'ts', now)
+redis.call('PEXPIRE', key, math.ceil(capacity / rate))
+
+local reset = math.ceil((capacity - tokens) / rate)
+return {allowed, math.floor(tokens), reset, retry, limit, window, burst}
+`)
+
+// Limiter enforces policies with Lua scripts in Valkey. Each check is a single atomic round trip
+// (EVALSHA, falling back to EVAL the first time a script is seen).
+type Limiter struct {
+	client *redis.Client
+	seq    atomic.Uint64
+}
+
+func New(client *redis.Client) *Limiter {
+	return &Limiter{client: client}
+}
+
+// Key is the Valkey key of a subject's bucket for a policy. Every request the policy applies to
+// shares the bucket, whatever its concrete path, so that /users/1 and /users/2 draw on the same
+// allowance and the number of keys per subject is bounded by the number of rules.
+func Key(subject, policy string) string {
+	return "rate:" + subject + ":rule:" + policy
+}
+
+// Allow records a request for key under the policy and reports whether it is allowed.
+func (l *Limiter) Allow(ctx context.Context, key string, p Policy) (Result, error) {
+	return l.AllowWithOverride(ctx, key, "", p)
+}
+
+// AllowWithOverride is Allow with the limits in the overrideKey hash, if it exists, taking
+// precedence over the policy's. The override is read in the same script, so it costs nothing
+// extra.
+func (l *Limiter) AllowWithOverride(ctx context.Context, key, overrideKey string, p Policy) (Result, error) {
+	keys := []string{key}
+	if overrideKey != "" {
+		keys = append(keys, overrideKey)
+	}
+	var (
+		raw interface{}
+		err error
+	)
+	switch p.Algorithm {
+	case AlgorithmTokenBucket:
+		raw, err = tokenBucketScript.Run(ctx, l.client, keys,
+			p.Limit, p.Window.Milliseconds(), p.Burst).Result()
+	case AlgorithmSlidingWindow:
+		member := strconv.FormatUint(l.seq.Add(1), 36) + "-" + strconv.FormatInt(time.Now().UnixNano(), 36)
+		raw, err = slidingWindowScript.Run(ctx, l.client, keys,
+			p.Limit, p.Window.Milliseconds(), p.Burst, member).Result()
+	default:
+		return Result{}, fmt.Errorf("unknown rate limit algorithm %q", p.Algorithm)
+	}
+	if err != nil {
+		return Result{}, err
+	}
+	return parseResult(raw, p)
+}
+
+func parseResult(raw interface{}, p Policy) (Result, error) {
+	values, ok := raw.([]interface{})
+	if !ok || len(values) != 7 {
+		return Result{}, fmt.Errorf("unexpected rate limit script result %v", raw)
+	}
+	n := make([]int64, len(values))
+	for i, v := range values {
+		if n[i], ok = v.(int64); !ok {
+			return Result{}, fmt.Errorf("unexpected rate limit script result %v", raw)
+		}
+	}
+	p.Limit = int(n[4])
+	p.Window = time.Duration(n[5]) * time.Millisecond
+	p.Burst = int(n[6])
+	return Result{
+		Allowed:    n[0] == 1,
+		Limit:      p.Limit,
+		Remaining:  int(max(n[1], 0)),
+		ResetAfter: time.Duration(n[2]) * time.Millisecond,
+		RetryAfter: time.Duration(n[3]) * time.Millisecond,
+		Policy:     p,
+	}, nil
+}
@@ -0,0 +1,231 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// newTestLimiter returns a Limiter backed by an in-memory Valkey whose clock the test controls.
+func newTestLimiter(t *testing.T) (*Limiter, *miniredis.Miniredis) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	mr.SetTime(time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC))
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+	return New(client), mr
+}
+
+// step is one request in a limiter scenario, made after advancing the clock by after.
+type step struct {
+	after     time.Duration
+	allowed   bool
+	remaining int
+	retry     time.Duration
+}
+
+func runSteps(t *testing.T, p Policy, steps []step) {
+	t.Helper()
+	l, mr := newTestLimiter(t)
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, s := range steps {
+		now = now.Add(s.after)
+		mr.SetTime(now)
+		mr.FastForward(s.after)
+		r, err := l.Allow(context.Background(), Key("alice", "test"), p)
+		if err != nil {
+			t.Fatalf("request %d: Allow() error = %v", i, err)
+		}
+		if r.Allowed != s.allowed || r.Remaining != s.remaining || r.RetryAfter != s.retry {
+			t.Errorf("request %d: allowed=%v remaining=%d retry=%v, want allowed=%v remaining=%d retry=%v",
+				i, r.Allowed, r.Remaining, r.RetryAfter, s.allowed, s.remaining, s.retry)
+		}
+	}
+}
+
+func TestSlidingWindow(t *testing.T) {
+	p := Policy{Name: "test", Algorithm: AlgorithmSlidingWindow, Limit: 3, Window: 10 * time.Second}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"allows up to the limit", []step{
+			{0, true, 2, 0},
+			{0, true, 1, 0},
+			{0, true, 0, 0},
+			{0, false, 0, 10 * time.Second},
+		}},
+		{"rejected requests are not counted", []step{
+			{0, true, 2, 0},
+			{0, true, 1, 0},
+			{0, true, 0, 0},
+			{time.Second, false, 0, 9 * time.Second},
+			{time.Second, false, 0, 8 * time.Second},
+			{8 * time.Second, true, 2, 0},
+		}},
+		{"no burst at window boundaries", []step{
+			{0, true, 2, 0},
+			{9 * time.Second, true, 1, 0},
+			{0, true, 0, 0},
+			{2 * time.Second, true, 0, 0},
+			{0, false, 0, 8 * time.Second},
+		}},
+		{"empties after a quiet window", []step{
+			{0, true, 2, 0},
+			{0, true, 1, 0},
+			{0, true, 0, 0},
+			{11 * time.Second, true, 2, 0},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) { runSteps(t, p, tt.steps) })
+	}
+
+	t.Run("burst adds to the limit", func(t *testing.T) {
+		burst := p
+		burst.Burst = 2
+		runSteps(t, burst, []step{
+			{0, true, 4, 0},
+			{0, true, 3, 0},
+			{0, true, 2, 0},
+			{0, true, 1, 0},
+			{0, true, 0, 0},
+			{0, false, 0, 10 * time.Second},
+		})
+	})
+}
+
+func TestTokenBucket(t *testing.T) {
+	p := Policy{Name: "test", Algorithm: AlgorithmTokenBucket, Limit: 2, Window: 2 * time.Second, Burst: 1}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"starts full with the burst", []step{
+			{0, true, 2, 0},
+			{0, true, 1, 0},
+			{0, true, 0, 0},
+			{0, false, 0, time.Second},
+		}},
+		{"refills at limit per window", []step{
+			{0, true, 2, 0},
+			{0, true, 1, 0},
+			{0, true, 0, 0},
+			{500 * time.Millisecond, false, 0, 500 * time.Millisecond},
+			{500 * time.Millisecond, true, 0, 0},
+			{time.Second, true, 0, 0},
+		}},
+		{"refill is capped at capacity", []step{
+			{0, true, 2, 0},
+			{time.Minute, true, 2, 0},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) { runSteps(t, p, tt.steps) })
+	}
+}
+
+func TestOverride(t *testing.T) {
+	l, mr := newTestLimiter(t)
+	ctx := context.Background()
+	p := Policy{Name: "test", Algorithm: AlgorithmSlidingWindow, Limit: 1, Window: time.Minute}
+	mr.HSet(OverrideKey("alice"), "limit", "2")
+
+	for i, want := range []bool{true, true, false} {
+		r, err := l.AllowWithOverride(ctx, Key("alice", "test"), OverrideKey("alice"), p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if r.Allowed != want || r.Limit != 2 {
+			t.Errorf("request %d: allowed=%v limit=%d, want allowed=%v limit=2", i, r.Allowed, r.Limit, want)
+		}
+	}
+	r, err := l.AllowWithOverride(ctx, Key("bob", "test"), OverrideKey("bob"), p)
+	if err != nil || !r.Allowed || r.Limit != 1 {
+		t.Errorf("without an override: allowed=%v limit=%d err=%v, want the policy", r.Allowed, r.Limit, err)
+	}
+}
+
+func TestAlgorithmSwitchResetsBucket(t *testing.T) {
+	l, _ := newTestLimiter(t)
+	ctx := context.Background()
+	key := Key("alice", "test")
+	sliding := Policy{Name: "test", Algorithm: AlgorithmSlidingWindow, Limit: 1, Window: time.Minute}
+	bucket := Policy{Name: "test", Algorithm: AlgorithmTokenBucket, Limit: 1, Window: time.Minute}
+
+	if r, err := l.Allow(ctx, key, sliding); err != nil || !r.Allowed {
+		t.Fatalf("sliding window: allowed=%v err=%v", r.Allowed, err)
+	}
+	if r, err := l.Allow(ctx, key, bucket); err != nil || !r.Allowed {
+		t.Errorf("token bucket after sliding window: allowed=%v err=%v", r.Allowed, err)
+	}
+	if r, err := l.Allow(ctx, key, sliding); err != nil || !r.Allowed {
+		t.Errorf("sliding window after token bucket: allowed=%v err=%v", r.Allowed, err)
+	}
+}
+
+func TestRuleSharesBucketAcrossPaths(t *testing.T) {
+	set, err := loadTestRuleSet(t, testPolicyFile)
+	if err != nil {
+		t.Fatalf("LoadRuleSet() error = %v", err)
+	}
+	l, _ := newTestLimiter(t)
+	ctx := context.Background()
+	rule := set.Match("GET", "/users/1")
+	rule.Limit = 2
+
+	for i, path := range []string{"/users/1", "/users/2", "/users/3"} {
+		matched := set.Match("GET", path)
+		r, err := l.Allow(ctx, Key("alice", matched.Name), rule.Policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := i < 2; r.Allowed != want {
+			t.Errorf("GET %s: allowed = %v, want %v", path, r.Allowed, want)
+		}
+	}
+	buckets, err := l.Buckets(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buckets) != 1 || buckets[0].Rule != "user" || buckets[0].Requests != 2 {
+		t.Errorf("Buckets() = %+v, want one bucket for rule user with 2 requests", buckets)
+	}
+}
+
+func TestBucketsAndReset(t *testing.T) {
+	l, _ := newTestLimiter(t)
+	ctx := context.Background()
+	p := Policy{Name: "test", Algorithm: AlgorithmSlidingWindow, Limit: 5, Window: time.Minute}
+	// 2001:db8::1 is a prefix of 2001:db8::1:5, whose buckets must not show up under it
+	for _, key := range []string{Key("2001:db8::1", "login"), Key("2001:db8::1", "default"), Key("2001:db8::1:5", "login")} {
+		if _, err := l.Allow(ctx, key, p); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	buckets, err := l.Buckets(ctx, "2001:db8::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules := map[string]bool{}
+	for _, b := range buckets {
+		rules[b.Rule] = true
+	}
+	if len(buckets) != 2 || !rules["login"] || !rules["default"] {
+		t.Errorf("Buckets() = %+v, want login and default", buckets)
+	}
+
+	if n, err := l.Reset(ctx, "2001:db8::1", "login"); err != nil || n != 1 {
+		t.Errorf("Reset(login) = %d, %v, want 1", n, err)
+	}
+	if n, err := l.Reset(ctx, "2001:db8::1", ""); err != nil || n != 1 {
+		t.Errorf("Reset() = %d, %v, want 1", n, err)
+	}
+	if buckets, _ := l.Buckets(ctx, "2001:db8::1:5"); len(buckets) != 1 {
+		t.Errorf("Buckets() of the other subject = %+v, want it untouched", buckets)
+	}
+}
@@ -0,0 +1,105 @@
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// LocalLimiter is an in-process token bucket limiter used while Valkey is unreachable. Each
+// instance counts on its own, so the effective limit across N instances is up to N times the
+// policy; it is only meant to keep abuse in check during an outage.
+type LocalLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*localBucket
+}
+
+type localBucket struct {
+	tokens  float64
+	updated time.Time
+	// idle is how long the bucket takes to refill completely, after which it can be dropped
+	idle time.Duration
+}
+
+func NewLocal() *LocalLimiter {
+	return &LocalLimiter{buckets: map[string]*localBucket{}}
+}
+
+// Allow takes a token for key. Every algorithm is approximated by a bucket of Limit+Burst
+// tokens refilled at Limit per Window.
+func (l *LocalLimiter) Allow(key string, p Policy) Result {
+	now := time.Now()
+	capacity := float64(p.Limit + p.Burst)
+	rate := float64(p.Limit) / float64(p.Window)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &localBucket{tokens: capacity, updated: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(capacity, b.tokens+float64(now.Sub(b.updated))*rate)
+	b.updated = now
+	b.idle = time.Duration(capacity / rate)
+
+	result := Result{Limit: p.Limit, Policy: p}
+	if b.tokens >= 1 {
+		b.tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = time.Duration(math.Ceil((1 - b.tokens) / rate))
+	}
+	result.Remaining = int(b.tokens)
+	result.ResetAfter = time.Duration(math.Ceil((capacity - b.tokens) / rate))
+	return result
+}
+
+// Prune drops buckets that have been idle long enough to be full again.
+func (l *LocalLimiter) Prune() {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for key, b := range l.buckets {
+		if now.Sub(b.updated) >= b.idle {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// Reset drops every bucket.
+func (l *LocalLimiter) Reset() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.buckets = map[string]*localBucket{}
+}
+
+// LocalSemaphore is the in-process counterpart of Semaphore, used while Valkey is unreachable.
+// Like LocalLimiter it counts per instance.
+type LocalSemaphore struct {
+	mu       sync.Mutex
+	limit    int
+	inflight map[string]int
+}
+
+func NewLocalSemaphore(limit int) *LocalSemaphore {
+	return &LocalSemaphore{limit: limit, inflight: map[string]int{}}
+}
+
+// Acquire takes a slot for key and returns the func that gives it back, or false when every slot
+// is in use.
+func (s *LocalSemaphore) Acquire(key string) (func(), bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.inflight[key] >= s.limit {
+		return nil, false
+	}
+	s.inflight[key]++
+	return sync.OnceFunc(func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.inflight[key]--; s.inflight[key] <= 0 {
+			delete(s.inflight, key)
+		}
+	}), true
+}
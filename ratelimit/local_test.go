@@ -0,0 +1,93 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+func TestLocalSemaphore(t *testing.T) {
+	s := NewLocalSemaphore(2)
+	first, ok := s.Acquire("a")
+	if !ok {
+		t.Fatal("first Acquire() failed")
+	}
+	if _, ok := s.Acquire("a"); !ok {
+		t.Fatal("second Acquire() failed")
+	}
+	if _, ok := s.Acquire("a"); ok {
+		t.Error("third Acquire() succeeded past the limit")
+	}
+	if _, ok := s.Acquire("b"); !ok {
+		t.Error("Acquire() on another key failed")
+	}
+	first()
+	first()
+	if _, ok := s.Acquire("a"); !ok {
+		t.Error("Acquire() after a release failed")
+	}
+	if _, ok := s.Acquire("a"); ok {
+		t.Error("a double release freed two slots")
+	}
+}
+
+func TestGuardedFailureModes(t *testing.T) {
+	p := Policy{Name: "test", Algorithm: AlgorithmSlidingWindow, Limit: 1, Window: time.Minute}
+	tests := []struct {
+		mode    string
+		allowed []bool
+		wantErr error
+	}{
+		{FailureModeLocal, []bool{true, false}, nil},
+		{FailureModeOpen, nil, ErrFailOpen},
+		{FailureModeClosed, nil, ErrUnavailable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			mr := miniredis.RunT(t)
+			client := redis.NewClient(&redis.Options{Addr: mr.Addr(), MaxRetries: -1})
+			t.Cleanup(func() { client.Close() })
+			g, err := NewGuarded(client, tt.mode)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if g.Mode() != tt.mode {
+				t.Errorf("Mode() = %q, want %q", g.Mode(), tt.mode)
+			}
+			mr.Close()
+
+			for i := 0; i < 2; i++ {
+				r, err := g.Allow(context.Background(), Key("alice", "test"), "", p)
+				if !errors.Is(err, tt.wantErr) || (tt.wantErr == nil && err != nil) {
+					t.Fatalf("request %d: Allow() error = %v, want %v", i, err, tt.wantErr)
+				}
+				if tt.allowed != nil && r.Allowed != tt.allowed[i] {
+					t.Errorf("request %d: allowed = %v, want %v", i, r.Allowed, tt.allowed[i])
+				}
+			}
+			if !g.Degraded() {
+				t.Error("Degraded() = false after Valkey went away")
+			}
+		})
+	}
+}
+
+func TestGuardedReportError(t *testing.T) {
+	g, err := NewGuarded(redis.NewClient(&redis.Options{}), FailureModeLocal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.ReportError(redis.Nil)
+	g.ReportError(nil)
+	if g.Degraded() {
+		t.Fatal("ReportError() marked a server reply as an outage")
+	}
+	g.ReportError(errors.New("dial tcp: connection refused"))
+	if !g.Degraded() {
+		t.Error("ReportError() did not mark a connection error as an outage")
+	}
+}
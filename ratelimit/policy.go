@@ -0,0 +1,59 @@
+package ratelimit
+
+import (
+	"fmt"
+	"time"
+)
+
+// Supported rate limiting algorithms.
+const (
+	// AlgorithmSlidingWindow keeps a log of request times and allows at most Limit+Burst requests
+	// in any Window-long interval, so there is no extra burst at window boundaries.
+	AlgorithmSlidingWindow = "sliding_window"
+	// AlgorithmTokenBucket refills Limit tokens per Window and lets up to Limit+Burst requests
+	// through at once.
+	AlgorithmTokenBucket = "token_bucket"
+)
+
+// Policy describes how many requests a subject may make.
+type Policy struct {
+	Name      string
+	Algorithm string
+	Limit     int
+	Window    time.Duration
+	Burst     int
+}
+
+// Validate reports whether the policy can be enforced.
+func (p Policy) Validate() error {
+	switch p.Algorithm {
+	case AlgorithmSlidingWindow, AlgorithmTokenBucket:
+	default:
+		return fmt.Errorf("policy %q: unknown algorithm %q", p.Name, p.Algorithm)
+	}
+	if p.Limit <= 0 {
+		return fmt.Errorf("policy %q: limit must be positive", p.Name)
+	}
+	if p.Window <= 0 {
+		return fmt.Errorf("policy %q: window must be positive", p.Name)
+	}
+	if p.Burst < 0 {
+		return fmt.Errorf("policy %q: burst must not be negative", p.Name)
+	}
+	return nil
+}
+
+// Result is the outcome of one rate limit check.
+type Result struct {
+	Allowed bool
+	// Limit is the number of requests the policy allows per window.
+	Limit int
+	// Remaining is how many more requests would be allowed right now.
+	Remaining int
+	// ResetAfter is how long until the limiter is back to its full allowance.
+	ResetAfter time.Duration
+	// RetryAfter is how long a rejected client should wait before the next request can succeed.
+	RetryAfter time.Duration
+	// Policy is the policy that was enforced, after any override.
+	Policy Policy
+}
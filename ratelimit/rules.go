@@ -0,0 +1,204 @@
+package ratelimit
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Key strategies decide which subject a request is counted against.
+const (
+	// KeyUser counts requests per authenticated user (the token subject), falling back to the IP.
+	KeyUser = "user"
+	// KeyIP counts requests per client IP.
+	KeyIP = "ip"
+	// KeyClientID counts requests per OAuth client (the azp claim), falling back to the IP.
+	KeyClientID = "client_id"
+	// KeyAPIKey counts requests per X-API-Key header, falling back to the IP.
+	KeyAPIKey = "api_key"
+)
+
+// Rule applies a policy to the requests matching a route pattern. All of them count against one
+// bucket per subject, named after the rule.
+type Rule struct {
+	Policy
+	Pattern     string
+	Methods     []string
+	Key         string
+	ExemptRoles []string
+
+	segments []string
+}
+
+// RuleSet is an ordered list of rules with a fallback for requests no rule matches.
+type RuleSet struct {
+	Rules   []Rule
+	Default Rule
+}
+
+// ruleFile is the on-disk format of a policy file. JSON files are read by the same YAML decoder.
+type ruleFile struct {
+	Default ruleConfig   `yaml:"default"`
+	Rules   []ruleConfig `yaml:"rules"`
+}
+
+type ruleConfig struct {
+	Name        string   `yaml:"name"`
+	Path        string   `yaml:"path"`
+	Methods     []string `yaml:"methods"`
+	Algorithm   string   `yaml:"algorithm"`
+	Limit       int      `yaml:"limit"`
+	Window      string   `yaml:"window"`
+	Burst       *int     `yaml:"burst"`
+	Key         string   `yaml:"key"`
+	ExemptRoles []string `yaml:"exempt_roles"`
+}
+
+// LoadRuleSet reads a policy file. Fields missing from the default section are taken from def,
+// and fields missing from a rule are taken from the default section.
+func LoadRuleSet(path string, def Rule) (*RuleSet, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file ruleFile
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", path, err)
+	}
+
+	file.Default.Name = "default"
+	file.Default.Path = ""
+	set := &RuleSet{}
+	if set.Default, err = file.Default.rule(def); err != nil {
+		return nil, err
+	}
+	names := map[string]bool{set.Default.Name: true}
+	for i, cfg := range file.Rules {
+		if cfg.Path == "" {
+			return nil, fmt.Errorf("rule %d: path is required", i)
+		}
+		if cfg.Name == "" {
+			cfg.Name = cfg.Path
+		}
+		// The name keys the rule's buckets, so two rules sharing one would share an allowance
+		if names[cfg.Name] {
+			return nil, fmt.Errorf("rule %d: name %q is already in use", i, cfg.Name)
+		}
+		names[cfg.Name] = true
+		rule, err := cfg.rule(set.Default)
+		if err != nil {
+			return nil, err
+		}
+		set.Rules = append(set.Rules, rule)
+	}
+	return set, nil
+}
+
+func (cfg ruleConfig) rule(base Rule) (Rule, error) {
+	rule := base
+	rule.Name = cfg.Name
+	rule.Pattern = cfg.Path
+	rule.segments = splitPath(strings.ToLower(cfg.Path))
+	rule.Methods = nil
+	for _, m := range cfg.Methods {
+		rule.Methods = append(rule.Methods, strings.ToUpper(m))
+	}
+	if cfg.Algorithm != "" {
+		rule.Algorithm = cfg.Algorithm
+	}
+	if cfg.Limit != 0 {
+		rule.Limit = cfg.Limit
+	}
+	if cfg.Window != "" {
+		window, err := time.ParseDuration(cfg.Window)
+		if err != nil {
+			return Rule{}, fmt.Errorf("policy %q: invalid window: %w", cfg.Name, err)
+		}
+		rule.Window = window
+	}
+	if cfg.Burst != nil {
+		rule.Burst = *cfg.Burst
+	}
+	if cfg.Key != "" {
+		rule.Key = cfg.Key
+	}
+	if cfg.ExemptRoles != nil {
+		rule.ExemptRoles = cfg.ExemptRoles
+	}
+	if err := rule.Validate(); err != nil {
+		return Rule{}, err
+	}
+	switch rule.Key {
+	case KeyUser, KeyIP, KeyClientID, KeyAPIKey:
+	default:
+		return Rule{}, fmt.Errorf("policy %q: unknown key strategy %q", rule.Name, rule.Key)
+	}
+	return rule, nil
+}
+
+// Match returns the first rule matching the request, or the default rule. Like Fiber's router,
+// matching ignores case and trailing slashes.
+func (s *RuleSet) Match(method, path string) *Rule {
+	segments := splitPath(strings.ToLower(path))
+	for i := range s.Rules {
+		if s.Rules[i].matches(method, segments) {
+			return &s.Rules[i]
+		}
+	}
+	return &s.Default
+}
+
+// Exempt reports whether any of roles skips this rule.
+func (r *Rule) Exempt(roles []string) bool {
+	for _, exempt := range r.ExemptRoles {
+		for _, role := range roles {
+			if role == exempt {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matches compares path segments against the pattern. ":name" and "*" match exactly one
+// segment and a trailing "**" matches any remainder, including nothing.
+func (r *Rule) matches(method string, segments []string) bool {
+	if len(r.Methods) > 0 {
+		found := false
+		for _, m := range r.Methods {
+			if m == method {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	for i, pattern := range r.segments {
+		if pattern == "**" && i == len(r.segments)-1 {
+			return true
+		}
+		if i >= len(segments) {
+			return false
+		}
+		if pattern == "*" || strings.HasPrefix(pattern, ":") {
+			continue
+		}
+		if pattern != segments[i] {
+			return false
+		}
+	}
+	return len(segments) == len(r.segments)
+}
+
+func splitPath(path string) []string {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return nil
+	}
+	return strings.Split(path, "/")
+}
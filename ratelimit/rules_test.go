@@ -0,0 +1,118 @@
+package ratelimit
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const testPolicyFile = `
+default:
+  limit: 100
+  window: 1m
+rules:
+  - name: login
+    path: /login
+    methods: [post]
+    limit: 5
+    key: ip
+  - name: user
+    path: /users/:id
+    limit: 20
+  - name: Admin
+    path: /Admin/**
+    limit: 50
+    exempt_roles: [admin]
+  - name: avatar
+    path: /users/*/avatar
+    limit: 2
+`
+
+func loadTestRuleSet(t *testing.T, content string) (*RuleSet, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "policies.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	def := Rule{
+		Policy: Policy{Name: "default", Algorithm: AlgorithmSlidingWindow, Limit: 5, Window: time.Minute},
+		Key:    KeyUser,
+	}
+	return LoadRuleSet(path, def)
+}
+
+func TestRuleSetMatch(t *testing.T) {
+	set, err := loadTestRuleSet(t, testPolicyFile)
+	if err != nil {
+		t.Fatalf("LoadRuleSet() error = %v", err)
+	}
+	tests := []struct {
+		method string
+		path   string
+		want   string
+	}{
+		{"POST", "/login", "login"},
+		{"POST", "/login/", "login"},
+		{"POST", "/LOGIN", "login"},
+		{"GET", "/login", "default"},
+		{"GET", "/users/123", "user"},
+		{"GET", "/Users/123/", "user"},
+		{"GET", "/users", "default"},
+		{"GET", "/users/123/roles", "default"},
+		{"PUT", "/users/123/avatar", "avatar"},
+		{"GET", "/admin", "Admin"},
+		{"GET", "/admin/ip-rules/1", "Admin"},
+		{"GET", "/ADMIN/quotas", "Admin"},
+		{"GET", "/administrator", "default"},
+		{"GET", "/", "default"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			if got := set.Match(tt.method, tt.path); got.Name != tt.want {
+				t.Errorf("Match() = %q, want %q", got.Name, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadRuleSetInheritance(t *testing.T) {
+	set, err := loadTestRuleSet(t, testPolicyFile)
+	if err != nil {
+		t.Fatalf("LoadRuleSet() error = %v", err)
+	}
+	login := set.Match("POST", "/login")
+	if login.Limit != 5 || login.Window != time.Minute || login.Key != KeyIP || login.Algorithm != AlgorithmSlidingWindow {
+		t.Errorf("login rule = %+v, want limit 5 per minute by IP", login)
+	}
+	if set.Default.Limit != 100 || set.Default.Key != KeyUser {
+		t.Errorf("default rule = %+v, want limit 100 by user", set.Default)
+	}
+	admin := set.Match("GET", "/admin")
+	if !admin.Exempt([]string{"user", "admin"}) || admin.Exempt([]string{"user"}) {
+		t.Errorf("admin rule exemptions = %v", admin.ExemptRoles)
+	}
+}
+
+func TestLoadRuleSetErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"missing path", "rules:\n  - limit: 5\n"},
+		{"unknown algorithm", "rules:\n  - path: /x\n    algorithm: leaky\n"},
+		{"invalid window", "rules:\n  - path: /x\n    window: soon\n"},
+		{"negative limit", "rules:\n  - path: /x\n    limit: -1\n"},
+		{"unknown key", "rules:\n  - path: /x\n    key: cookie\n"},
+		{"duplicate name", "rules:\n  - path: /x\n  - path: /x\n    methods: [POST]\n"},
+		{"name of the default", "rules:\n  - name: default\n    path: /x\n"},
+		{"invalid YAML", "rules: [\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := loadTestRuleSet(t, tt.content); err == nil {
+				t.Error("LoadRuleSet() succeeded, want an error")
+			}
+		})
+	}
+}
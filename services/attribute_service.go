@@ -0,0 +1,361 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go-keycloack/config"
+	"go-keycloack/encryption"
+	"go-keycloack/models"
+)
+
+type attributeRule struct {
+	def     models.AttributeDefinition
+	pattern *regexp.Regexp
+}
+
+// attributeSchema holds the custom attribute definitions by name. It is empty, and custom
+// attributes are rejected, until LoadAttributeSchema reads a schema file.
+var attributeSchema = map[string]attributeRule{}
+
+var visibilityRank = map[string]int{
+	models.VisibilityPublic: 0,
+	models.VisibilitySelf:   1,
+	models.VisibilityAdmin:  2,
+}
+
+// LoadAttributeSchema reads the custom attribute definitions from USER_ATTRIBUTES_FILE, a JSON
+// array of models.AttributeDefinition.
+func LoadAttributeSchema() {
+	path := config.GetString("USER_ATTRIBUTES_FILE", "")
+	if path == "" {
+		return
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatalf("Failed to read user attribute schema: %v", err)
+	}
+	var defs []models.AttributeDefinition
+	if err := json.Unmarshal(data, &defs); err != nil {
+		log.Fatalf("Failed to parse user attribute schema: %v", err)
+	}
+
+	schema := map[string]attributeRule{}
+	for _, def := range defs {
+		if def.Visibility == "" {
+			def.Visibility = models.VisibilitySelf
+		}
+		if _, ok := visibilityRank[def.Visibility]; !ok {
+			log.Fatalf("User attribute %q has unknown visibility %q", def.Name, def.Visibility)
+		}
+		// Only the user and admins change attributes, so public attributes default to self.
+		if def.Editable == "" {
+			def.Editable = def.Visibility
+			if def.Editable == models.VisibilityPublic {
+				def.Editable = models.VisibilitySelf
+			}
+		}
+		if _, ok := visibilityRank[def.Editable]; !ok {
+			log.Fatalf("User attribute %q has unknown editable level %q", def.Name, def.Editable)
+		}
+		if visibilityRank[def.Editable] < visibilityRank[def.Visibility] {
+			log.Fatalf("User attribute %q is editable by callers that cannot see it", def.Name)
+		}
+		switch def.Type {
+		case models.AttributeTypeString, models.AttributeTypeInt, models.AttributeTypeBool:
+		case models.AttributeTypeEnum:
+			if len(def.Values) == 0 {
+				log.Fatalf("User attribute %q is an enum without values", def.Name)
+			}
+		default:
+			log.Fatalf("User attribute %q has unknown type %q", def.Name, def.Type)
+		}
+		rule := attributeRule{def: def}
+		if def.Pattern != "" {
+			if rule.pattern, err = regexp.Compile(def.Pattern); err != nil {
+				log.Fatalf("User attribute %q has an invalid pattern: %v", def.Name, err)
+			}
+		}
+		schema[def.Name] = rule
+	}
+	attributeSchema = schema
+	log.Printf("Loaded %d custom user attributes", len(schema))
+}
+
+// AttributeDefinitions returns the custom attribute schema, sorted by name.
+func AttributeDefinitions() []models.AttributeDefinition {
+	defs := make([]models.AttributeDefinition, 0, len(attributeSchema))
+	for _, rule := range attributeSchema {
+		defs = append(defs, rule.def)
+	}
+	sort.Slice(defs, func(i, j int) bool { return defs[i].Name < defs[j].Name })
+	return defs
+}
+
+// ValidateAttributes checks submitted attribute values against the schema and returns them in
+// their stored string form. Only attributes editable at the caller's level may be set.
+func ValidateAttributes(input map[string]interface{}, level string) (map[string]string, error) {
+	out := make(map[string]string, len(input))
+	for name, value := range input {
+		rule, ok := attributeSchema[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown attribute %q", name)
+		}
+		if !AttributeEditable(rule.def, level) {
+			return nil, fmt.Errorf("attribute %q cannot be changed by this caller", name)
+		}
+		if value == nil {
+			continue
+		}
+		s, err := normaliseAttribute(rule, value)
+		if err != nil {
+			return nil, fmt.Errorf("attribute %q: %w", name, err)
+		}
+		out[name] = s
+	}
+	return out, nil
+}
+
+// MissingRequiredAttributes lists the required attributes, settable at the caller's level, that
+// have no value.
+func MissingRequiredAttributes(attrs map[string]string, level string) []string {
+	var missing []string
+	for name, rule := range attributeSchema {
+		if rule.def.Required && AttributeEditable(rule.def, level) && attrs[name] == "" {
+			missing = append(missing, name)
+		}
+	}
+	sort.Strings(missing)
+	return missing
+}
+
+func normaliseAttribute(rule attributeRule, value interface{}) (string, error) {
+	switch rule.def.Type {
+	case models.AttributeTypeInt:
+		switch v := value.(type) {
+		case float64:
+			if v != math.Trunc(v) {
+				return "", fmt.Errorf("must be an integer")
+			}
+			return strconv.FormatInt(int64(v), 10), nil
+		case string:
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return "", fmt.Errorf("must be an integer")
+			}
+			return strconv.FormatInt(n, 10), nil
+		}
+		return "", fmt.Errorf("must be an integer")
+	case models.AttributeTypeBool:
+		switch v := value.(type) {
+		case bool:
+			return strconv.FormatBool(v), nil
+		case string:
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return "", fmt.Errorf("must be a boolean")
+			}
+			return strconv.FormatBool(b), nil
+		}
+		return "", fmt.Errorf("must be a boolean")
+	case models.AttributeTypeEnum:
+		s, ok := value.(string)
+		if ok {
+			for _, allowed := range rule.def.Values {
+				if s == allowed {
+					return s, nil
+				}
+			}
+		}
+		return "", fmt.Errorf("must be one of %v", rule.def.Values)
+	default:
+		s, ok := value.(string)
+		if !ok {
+			return "", fmt.Errorf("must be a string")
+		}
+		if rule.def.MaxLength > 0 && len(s) > rule.def.MaxLength {
+			return "", fmt.Errorf("must be at most %d characters", rule.def.MaxLength)
+		}
+		if rule.pattern != nil && !rule.pattern.MatchString(s) {
+			return "", fmt.Errorf("does not match the required format")
+		}
+		return s, nil
+	}
+}
+
+// AttributeVisible reports whether a caller at the given level may see the attribute.
+func AttributeVisible(def models.AttributeDefinition, level string) bool {
+	return visibilityRank[level] >= visibilityRank[def.Visibility]
+}
+
+// AttributeEditable reports whether a caller at the given level may change the attribute.
+func AttributeEditable(def models.AttributeDefinition, level string) bool {
+	return visibilityRank[level] >= visibilityRank[def.Editable]
+}
+
+// VisibleAttributes returns the attributes a caller at the given level may see. Values for
+// attributes that are no longer in the schema are only shown to admins.
+func VisibleAttributes(attrs map[string]string, level string) map[string]string {
+	if len(attrs) == 0 {
+		return nil
+	}
+	out := make(map[string]string, len(attrs))
+	for name, value := range attrs {
+		rule, ok := attributeSchema[name]
+		if (ok && AttributeVisible(rule.def, level)) || (!ok && level == models.VisibilityAdmin) {
+			out[name] = value
+		}
+	}
+	return out
+}
+
+// VisibleChanges drops the attribute changes in an audit diff that a caller at the given level
+// may not see, by the same rules as VisibleAttributes. Profile fields are kept.
+func VisibleChanges(changes map[string]models.FieldChange, level string) map[string]models.FieldChange {
+	if len(changes) == 0 {
+		return changes
+	}
+	out := make(map[string]models.FieldChange, len(changes))
+	for field, change := range changes {
+		if name, ok := strings.CutPrefix(field, "attributes."); ok {
+			rule, known := attributeSchema[name]
+			if (known && !AttributeVisible(rule.def, level)) || (!known && level != models.VisibilityAdmin) {
+				continue
+			}
+		}
+		out[field] = change
+	}
+	return out
+}
+
+// MergeAttributes applies an update to the stored attributes. Attributes the caller cannot change
+// are kept; editable attributes are replaced by the update.
+func MergeAttributes(stored, update map[string]string, level string) map[string]string {
+	out := make(map[string]string, len(stored)+len(update))
+	for name, value := range stored {
+		rule, ok := attributeSchema[name]
+		if !ok || !AttributeEditable(rule.def, level) {
+			out[name] = value
+		}
+	}
+	for name, value := range update {
+		out[name] = value
+	}
+	return out
+}
+
+// visibleKeycloakAttributes drops the schema attributes a caller at the given level may not see
+// from a Keycloak attribute map. Attributes outside the schema come from Keycloak itself and are
+// kept.
+func visibleKeycloakAttributes(attrs map[string]interface{}, level string) map[string]interface{} {
+	out := make(map[string]interface{}, len(attrs))
+	for name, value := range attrs {
+		if rule, ok := attributeSchema[name]; ok && !AttributeVisible(rule.def, level) {
+			continue
+		}
+		out[name] = value
+	}
+	return out
+}
+
+// attributeField is the encryption field of a custom attribute, binding its ciphertext to the
+// attribute name.
+func attributeField(name string) string {
+	return "attr." + name
+}
+
+// attributeEncrypted reports whether values of the attribute are stored encrypted: it is marked
+// as PII in the schema and PII encryption is configured.
+func attributeEncrypted(name string) bool {
+	rule, ok := attributeSchema[name]
+	return ok && rule.def.PII && encryption.Default != nil
+}
+
+// attributeNeedsRotation reports whether a stored PII attribute value is still in plaintext or
+// wrapped with a retired master key.
+func attributeNeedsRotation(name, stored string) bool {
+	if !attributeEncrypted(name) || stored == "" {
+		return false
+	}
+	return !encryption.IsEncrypted(stored) || encryption.Default.NeedsRotation(attributeField(name), stored)
+}
+
+// encryptAttributes returns the stored form of the attributes, with PII attribute values encrypted.
+func encryptAttributes(attrs map[string]string) (map[string]string, error) {
+	if len(attrs) == 0 {
+		return attrs, nil
+	}
+	out := make(map[string]string, len(attrs))
+	for name, value := range attrs {
+		if attributeEncrypted(name) && value != "" && !encryption.IsEncrypted(value) {
+			ciphertext, err := encryption.Default.Seal(attributeField(name), value)
+			if err != nil {
+				return nil, err
+			}
+			value = ciphertext
+		}
+		out[name] = value
+	}
+	return out, nil
+}
+
+// decryptAttributes returns the attributes with every encrypted value replaced by its plaintext.
+// Values are decrypted whatever the current schema says, so that attributes that stop being PII
+// remain readable.
+func decryptAttributes(attrs map[string]string) (map[string]string, error) {
+	if len(attrs) == 0 {
+		return attrs, nil
+	}
+	out := make(map[string]string, len(attrs))
+	for name, value := range attrs {
+		plaintext, err := encryption.Default.Decrypt(attributeField(name), value)
+		if err != nil {
+			return nil, err
+		}
+		out[name] = plaintext
+	}
+	return out, nil
+}
+
+// KeycloakAttributes converts attributes to the multi-valued form used by the Keycloak admin API.
+func KeycloakAttributes(attrs map[string]string) map[string][]string {
+	out := make(map[string][]string, len(attrs))
+	for name, value := range attrs {
+		out[name] = []string{value}
+	}
+	return out
+}
+
+// SyncKeycloakAttributes mirrors the user's schema attributes to their Keycloak account so that
+// protocol mappers can put them in tokens. Keycloak attributes outside the schema are left alone.
+func SyncKeycloakAttributes(user *models.User) error {
+	keycloakID, err := resolveKeycloakID(user)
+	if err != nil {
+		return err
+	}
+	var rep map[string]interface{}
+	if err := keycloakAdminRequest(http.MethodGet, "/users/"+keycloakID, nil, &rep); err != nil {
+		return err
+	}
+	current, _ := rep["attributes"].(map[string]interface{})
+	if current == nil {
+		current = map[string]interface{}{}
+	}
+	for name := range attributeSchema {
+		if value, ok := user.Attributes[name]; ok {
+			current[name] = []string{value}
+		} else {
+			delete(current, name)
+		}
+	}
+	rep["attributes"] = current
+	return keycloakAdminRequest(http.MethodPut, "/users/"+keycloakID, rep, nil)
+}
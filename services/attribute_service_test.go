@@ -0,0 +1,209 @@
+package services
+
+import (
+	"bytes"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"go-keycloack/encryption"
+	"go-keycloack/models"
+)
+
+// withAttributeSchema installs defs as the attribute schema for the duration of the test.
+func withAttributeSchema(t *testing.T, defs ...models.AttributeDefinition) {
+	t.Helper()
+	saved := attributeSchema
+	attributeSchema = map[string]attributeRule{}
+	for _, def := range defs {
+		attributeSchema[def.Name] = attributeRule{def: def}
+	}
+	t.Cleanup(func() { attributeSchema = saved })
+}
+
+// withEncryption enables PII encryption with a throwaway keyfile whose active key is active.
+func withEncryption(t *testing.T, active string) {
+	t.Helper()
+	key := func(b byte) string { return base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{b}, 32)) }
+	path := filepath.Join(t.TempDir(), "keys.json")
+	content := `{"active":"` + active + `","keys":{"k1":"` + key(1) + `","k2":"` + key(2) + `"},"blind_index_key":"` + key(3) + `"}`
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	provider, indexKey, err := encryption.LoadKeyfile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := encryption.Default
+	encryption.Default = encryption.NewFieldEncryptor(provider, indexKey, nil)
+	t.Cleanup(func() { encryption.Default = saved })
+}
+
+func TestPIIAttributeEncryption(t *testing.T) {
+	withAttributeSchema(t,
+		models.AttributeDefinition{Name: "phone", Type: models.AttributeTypeString, Visibility: models.VisibilitySelf, PII: true},
+		models.AttributeDefinition{Name: "department", Type: models.AttributeTypeString, Visibility: models.VisibilityPublic},
+	)
+	attrs := map[string]string{"phone": "+4912345678", "department": "Sales", "legacy": "kept"}
+
+	tests := []struct {
+		name      string
+		keyfile   bool
+		encrypted map[string]bool
+	}{
+		{"encryption configured", true, map[string]bool{"phone": true}},
+		{"encryption disabled", false, map[string]bool{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.keyfile {
+				withEncryption(t, "k1")
+			}
+			stored, err := encryptAttributes(attrs)
+			if err != nil {
+				t.Fatalf("encryptAttributes() error = %v", err)
+			}
+			for name, value := range stored {
+				if encryption.IsEncrypted(value) != tt.encrypted[name] {
+					t.Errorf("stored %s = %q, encrypted = %v, want %v", name, value, encryption.IsEncrypted(value), tt.encrypted[name])
+				}
+			}
+			if attrs["phone"] != "+4912345678" {
+				t.Fatalf("encryptAttributes() modified its input")
+			}
+			got, err := decryptAttributes(stored)
+			if err != nil {
+				t.Fatalf("decryptAttributes() error = %v", err)
+			}
+			for name, want := range attrs {
+				if got[name] != want {
+					t.Errorf("decrypted %s = %q, want %q", name, got[name], want)
+				}
+			}
+		})
+	}
+}
+
+func TestAttributeCiphertextIsBoundToName(t *testing.T) {
+	withAttributeSchema(t,
+		models.AttributeDefinition{Name: "phone", Type: models.AttributeTypeString, Visibility: models.VisibilitySelf, PII: true},
+		models.AttributeDefinition{Name: "mobile", Type: models.AttributeTypeString, Visibility: models.VisibilitySelf, PII: true},
+	)
+	withEncryption(t, "k1")
+	stored, err := encryptAttributes(map[string]string{"phone": "+4912345678"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := decryptAttributes(map[string]string{"mobile": stored["phone"]}); err == nil {
+		t.Error("decryptAttributes() accepted a value moved to another attribute")
+	}
+}
+
+func TestAttributeNeedsRotation(t *testing.T) {
+	withAttributeSchema(t,
+		models.AttributeDefinition{Name: "phone", Type: models.AttributeTypeString, Visibility: models.VisibilitySelf, PII: true},
+		models.AttributeDefinition{Name: "department", Type: models.AttributeTypeString, Visibility: models.VisibilityPublic},
+	)
+	withEncryption(t, "k1")
+	oldKey, err := encryptAttributes(map[string]string{"phone": "+4912345678"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	withEncryption(t, "k2")
+	current, err := encryptAttributes(map[string]string{"phone": "+4912345678"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		attr   string
+		stored string
+		want   bool
+	}{
+		{"plaintext PII attribute", "phone", "+4912345678", true},
+		{"retired master key", "phone", oldKey["phone"], true},
+		{"active master key", "phone", current["phone"], false},
+		{"empty value", "phone", "", false},
+		{"non-PII attribute", "department", "Sales", false},
+		{"attribute outside the schema", "legacy", "kept", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := attributeNeedsRotation(tt.attr, tt.stored); got != tt.want {
+				t.Errorf("attributeNeedsRotation(%q) = %v, want %v", tt.attr, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAttributeEditability(t *testing.T) {
+	withAttributeSchema(t,
+		models.AttributeDefinition{Name: "department", Type: models.AttributeTypeString, Visibility: models.VisibilityPublic, Editable: models.VisibilityAdmin},
+		models.AttributeDefinition{Name: "locale", Type: models.AttributeTypeString, Visibility: models.VisibilitySelf, Editable: models.VisibilitySelf},
+		models.AttributeDefinition{Name: "cost_center", Type: models.AttributeTypeString, Visibility: models.VisibilityAdmin, Editable: models.VisibilityAdmin},
+	)
+	tests := []struct {
+		name    string
+		input   map[string]interface{}
+		level   string
+		wantErr bool
+	}{
+		{"self sets a self attribute", map[string]interface{}{"locale": "de"}, models.VisibilitySelf, false},
+		{"self sets a read-only public attribute", map[string]interface{}{"department": "Sales"}, models.VisibilitySelf, true},
+		{"self sets a hidden attribute", map[string]interface{}{"cost_center": "42"}, models.VisibilitySelf, true},
+		{"admin sets a read-only public attribute", map[string]interface{}{"department": "Sales"}, models.VisibilityAdmin, false},
+		{"admin sets an admin attribute", map[string]interface{}{"cost_center": "42"}, models.VisibilityAdmin, false},
+		{"unknown attribute", map[string]interface{}{"shoe_size": "42"}, models.VisibilityAdmin, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ValidateAttributes(tt.input, tt.level)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ValidateAttributes() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+
+	stored := map[string]string{"department": "Sales", "locale": "en", "cost_center": "42"}
+	merged := MergeAttributes(stored, map[string]string{}, models.VisibilitySelf)
+	want := map[string]string{"department": "Sales", "cost_center": "42"}
+	if len(merged) != len(want) || merged["department"] != want["department"] || merged["cost_center"] != want["cost_center"] {
+		t.Errorf("MergeAttributes() = %v, want %v", merged, want)
+	}
+}
+
+func TestVisibleChangesHidesAttributesInAuditDiffs(t *testing.T) {
+	withAttributeSchema(t,
+		models.AttributeDefinition{Name: "risk_score", Type: models.AttributeTypeString, Visibility: models.VisibilityAdmin},
+		models.AttributeDefinition{Name: "phone", Type: models.AttributeTypeString, Visibility: models.VisibilitySelf},
+	)
+	before := &models.User{Email: "a@example.com", Attributes: map[string]string{"risk_score": "low", "phone": "1", "legacy": "x"}}
+	after := &models.User{Email: "b@example.com", Attributes: map[string]string{"risk_score": "high", "phone": "2"}}
+	diff := DiffUsers(before, after)
+
+	tests := []struct {
+		level string
+		want  []string
+	}{
+		{models.VisibilitySelf, []string{"email", "attributes.phone"}},
+		{models.VisibilityAdmin, []string{"email", "attributes.phone", "attributes.risk_score", "attributes.legacy"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.level, func(t *testing.T) {
+			got := VisibleChanges(diff, tt.level)
+			if len(got) != len(tt.want) {
+				t.Errorf("VisibleChanges() = %v, want fields %v", got, tt.want)
+			}
+			for _, field := range tt.want {
+				if _, ok := got[field]; !ok {
+					t.Errorf("VisibleChanges() is missing %s", field)
+				}
+			}
+		})
+	}
+	if _, ok := diff["attributes.risk_score"]; !ok {
+		t.Error("VisibleChanges() modified its argument")
+	}
+}
@@ -0,0 +1,130 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"go-keycloack/config"
+	"go-keycloack/encryption"
+	"go-keycloack/models"
+
+	"github.com/gocql/gocql"
+)
+
+const auditChangesField = "audit.changes"
+
+// RecordAudit stores an audit entry in the user's time-ordered audit partition.
+func RecordAudit(entry *models.AuditEntry) error {
+	if entry.Timestamp.IsZero() {
+		entry.Timestamp = time.Now().UTC()
+	}
+	entry.EventID = gocql.UUIDFromTime(entry.Timestamp)
+
+	changes, err := json.Marshal(entry.Changes)
+	if err != nil {
+		return err
+	}
+	// Before/after values can contain PII, so the diff is encrypted whenever encryption is configured.
+	stored := string(changes)
+	if encryption.Default != nil {
+		if stored, err = encryption.Default.Seal(auditChangesField, stored); err != nil {
+			return err
+		}
+	}
+	return config.Session.Query(
+		`INSERT INTO user_audit (user_id, event_id, action, actor, changes, ip, user_agent, request_id)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		entry.UserID, entry.EventID, entry.Action, entry.Actor, stored, entry.IP, entry.UserAgent, entry.RequestID,
+	).Exec()
+}
+
+// ListAudit returns the user's audit entries between from and to, newest first. pageState is the
+// opaque cursor returned by a previous call; the returned cursor is empty on the last page. A diff
+// that cannot be decrypted, say because its master key was removed too early, fails the call
+// rather than coming back empty.
+func ListAudit(userID gocql.UUID, from, to time.Time, limit int, pageState []byte) ([]models.AuditEntry, []byte, error) {
+	iter := config.Session.Query(
+		`SELECT event_id, action, actor, changes, ip, user_agent, request_id FROM user_audit
+		WHERE user_id = ? AND event_id >= minTimeuuid(?) AND event_id <= maxTimeuuid(?)`,
+		userID, from, to,
+	).PageSize(limit).PageState(pageState).Iter()
+
+	entries := make([]models.AuditEntry, 0, limit)
+	var (
+		e       models.AuditEntry
+		changes string
+	)
+	for iter.Scan(&e.EventID, &e.Action, &e.Actor, &changes, &e.IP, &e.UserAgent, &e.RequestID) {
+		e.UserID = userID
+		e.Timestamp = e.EventID.Time().UTC()
+		plaintext, err := encryption.Default.Decrypt(auditChangesField, changes)
+		if err != nil {
+			iter.Close()
+			return nil, nil, fmt.Errorf("audit entry %s: %w", e.EventID, err)
+		}
+		if plaintext != "" && plaintext != "null" {
+			if err := json.Unmarshal([]byte(plaintext), &e.Changes); err != nil {
+				iter.Close()
+				return nil, nil, fmt.Errorf("audit entry %s: %w", e.EventID, err)
+			}
+		}
+		entries = append(entries, e)
+		e = models.AuditEntry{}
+	}
+	nextPage := iter.PageState()
+	if err := iter.Close(); err != nil {
+		return nil, nil, err
+	}
+	return entries, nextPage, nil
+}
+
+// DeleteAudit removes the user's entire audit partition.
+func DeleteAudit(userID gocql.UUID) error {
+	return config.Session.Query("DELETE FROM user_audit WHERE user_id = ?", userID).Exec()
+}
+
+// DiffUsers returns the profile fields that differ between before and after.
+// A nil before describes a creation and a nil after a deletion.
+func DiffUsers(before, after *models.User) map[string]models.FieldChange {
+	fields := func(u *models.User) map[string]string {
+		if u == nil {
+			return map[string]string{}
+		}
+		f := map[string]string{
+			"username":  u.Username,
+			"email":     u.Email,
+			"firstname": u.FirstName,
+			"lastname":  u.LastName,
+		}
+		for name, value := range u.Attributes {
+			f["attributes."+name] = value
+		}
+		return f
+	}
+	b, a := fields(before), fields(after)
+
+	names := map[string]bool{}
+	for name := range b {
+		names[name] = true
+	}
+	for name := range a {
+		names[name] = true
+	}
+
+	changes := map[string]models.FieldChange{}
+	for name := range names {
+		if b[name] == a[name] {
+			continue
+		}
+		change := models.FieldChange{}
+		if before != nil {
+			change.Before = b[name]
+		}
+		if after != nil {
+			change.After = a[name]
+		}
+		changes[name] = change
+	}
+	return changes
+}
@@ -0,0 +1,158 @@
+package services
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"  // register GIF decoding for uploads
+	_ "image/jpeg" // register JPEG decoding for uploads
+	"image/png"
+	"sort"
+	"strconv"
+	"time"
+
+	"go-keycloack/blob"
+	"go-keycloack/config"
+
+	"github.com/gabriel-vasile/mimetype"
+	"github.com/gocql/gocql"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp" // register WebP decoding for uploads
+)
+
+var (
+	// ErrInvalidAvatar is wrapped by errors caused by the uploaded file itself.
+	ErrInvalidAvatar = errors.New("invalid avatar")
+	// ErrAvatarNotFound is returned when the user has no avatar in the requested size.
+	ErrAvatarNotFound = errors.New("avatar not found")
+)
+
+var allowedAvatarTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+	"image/webp": true,
+}
+
+// maxAvatarPixels bounds the decoded size of an upload so that a small, highly compressed file
+// cannot exhaust memory.
+const maxAvatarPixels = 4096 * 4096
+
+// avatarStore is where avatars are kept; InitAvatarStore selects the backend.
+var avatarStore blob.Store
+
+// InitAvatarStore selects the blob backend for avatars from BLOB_STORE.
+func InitAvatarStore() {
+	avatarStore = blob.NewStoreFromEnv()
+}
+
+// AvatarMaxBytes is the largest upload accepted.
+func AvatarMaxBytes() int {
+	return config.GetInt("AVATAR_MAX_BYTES", 2<<20)
+}
+
+// AvatarSizes are the square sizes, in pixels, every avatar is rendered in.
+func AvatarSizes() []int {
+	var sizes []int
+	for _, s := range config.GetList("AVATAR_SIZES", []string{"64", "128", "256"}) {
+		if n, err := strconv.Atoi(s); err == nil && n > 0 {
+			sizes = append(sizes, n)
+		}
+	}
+	sort.Ints(sizes)
+	return sizes
+}
+
+func avatarKey(userID gocql.UUID, size int) string {
+	return fmt.Sprintf("avatars/%s/%d.png", userID, size)
+}
+
+// SaveAvatar validates an uploaded image by its content, then re-encodes it as PNG in every
+// configured size. Re-encoding drops EXIF and any other metadata from the original file.
+func SaveAvatar(userID gocql.UUID, data []byte) error {
+	if len(data) > AvatarMaxBytes() {
+		return fmt.Errorf("%w: file exceeds %d bytes", ErrInvalidAvatar, AvatarMaxBytes())
+	}
+	mtype := mimetype.Detect(data)
+	if !allowedAvatarTypes[mtype.String()] {
+		return fmt.Errorf("%w: unsupported file type %s", ErrInvalidAvatar, mtype.String())
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidAvatar, err)
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 || cfg.Width*cfg.Height > maxAvatarPixels {
+		return fmt.Errorf("%w: image dimensions %dx%d are not allowed", ErrInvalidAvatar, cfg.Width, cfg.Height)
+	}
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidAvatar, err)
+	}
+
+	now := time.Now().UTC()
+	for _, size := range AvatarSizes() {
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, squareThumbnail(src, size)); err != nil {
+			return err
+		}
+		sum := sha256.Sum256(buf.Bytes())
+		if err := avatarStore.Put(avatarKey(userID, size), &blob.Object{
+			Data:        buf.Bytes(),
+			ContentType: "image/png",
+			ETag:        `"` + hex.EncodeToString(sum[:16]) + `"`,
+			UpdatedAt:   now,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// squareThumbnail crops the centre square of src and scales it to size x size.
+func squareThumbnail(src image.Image, size int) image.Image {
+	b := src.Bounds()
+	side := b.Dx()
+	if b.Dy() < side {
+		side = b.Dy()
+	}
+	x0 := b.Min.X + (b.Dx()-side)/2
+	y0 := b.Min.Y + (b.Dy()-side)/2
+	crop := image.Rect(x0, y0, x0+side, y0+side)
+
+	dst := image.NewRGBA(image.Rect(0, 0, size, size))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, crop, draw.Src, nil)
+	return dst
+}
+
+// GetAvatar returns the user's avatar in the configured size closest to, and not smaller than,
+// the requested one.
+func GetAvatar(userID gocql.UUID, size int) (*blob.Object, error) {
+	sizes := AvatarSizes()
+	if len(sizes) == 0 {
+		return nil, ErrAvatarNotFound
+	}
+	chosen := sizes[len(sizes)-1]
+	for _, s := range sizes {
+		if s >= size && s < chosen {
+			chosen = s
+		}
+	}
+	obj, err := avatarStore.Get(avatarKey(userID, chosen))
+	if errors.Is(err, blob.ErrNotFound) {
+		return nil, ErrAvatarNotFound
+	}
+	return obj, err
+}
+
+// DeleteAvatar removes every size of the user's avatar.
+func DeleteAvatar(userID gocql.UUID) error {
+	for _, size := range AvatarSizes() {
+		if err := avatarStore.Delete(avatarKey(userID, size)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
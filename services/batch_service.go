@@ -0,0 +1,125 @@
+package services
+
+import (
+	"errors"
+	"sync"
+
+	"go-keycloack/config"
+	"go-keycloack/models"
+
+	"github.com/gocql/gocql"
+)
+
+// GetUserByKeycloakID returns the user linked to the given Keycloak subject. Soft-deleted users are
+// reported as gocql.ErrNotFound.
+func GetUserByKeycloakID(keycloakID string) (*models.User, error) {
+	var u models.User
+	err := config.Session.Query(
+		"SELECT "+userColumns+" FROM users WHERE keycloak_id = ?",
+		keycloakID,
+	).Consistency(gocql.One).Scan(userFields(&u)...)
+	if err != nil {
+		return nil, err
+	}
+	if err := decryptUser(&u); err != nil {
+		return nil, err
+	}
+	if u.IsDeleted() {
+		return nil, gocql.ErrNotFound
+	}
+	return &u, nil
+}
+
+// getUsersByIDs reads the users with the given IDs in one query, since id is the partition key.
+// Soft-deleted users are left out of the result.
+func getUsersByIDs(ids []gocql.UUID) (map[gocql.UUID]*models.User, error) {
+	users := make(map[gocql.UUID]*models.User, len(ids))
+	if len(ids) == 0 {
+		return users, nil
+	}
+	iter := config.Session.Query("SELECT "+userColumns+" FROM users WHERE id IN ?", ids).Iter()
+	u := &models.User{}
+	for iter.Scan(userFields(u)...) {
+		if !u.IsDeleted() {
+			if err := decryptUser(u); err != nil {
+				iter.Close()
+				return nil, err
+			}
+			users[u.ID] = u
+		}
+		u = &models.User{}
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// BatchGetUsers resolves each lookup and returns the results in the same order. IDs are fetched
+// together with an IN query on the partition key; usernames and subjects go through secondary
+// indexes and are fanned out with at most concurrency queries in flight.
+func BatchGetUsers(lookups []models.UserLookup, concurrency int) ([]models.UserLookupResult, error) {
+	results := make([]models.UserLookupResult, len(lookups))
+
+	var ids []gocql.UUID
+	idIndexes := map[int]gocql.UUID{}
+	var indexed []int
+	for i, l := range lookups {
+		results[i] = models.UserLookupResult{Type: l.Type, Value: l.Value}
+		switch l.Type {
+		case models.LookupByID:
+			id, err := gocql.ParseUUID(l.Value)
+			if err != nil {
+				results[i].Error = "invalid UUID"
+				continue
+			}
+			ids = append(ids, id)
+			idIndexes[i] = id
+		case models.LookupByUsername, models.LookupBySubject:
+			indexed = append(indexed, i)
+		default:
+			results[i].Error = "unknown lookup type"
+		}
+	}
+
+	byID, err := getUsersByIDs(ids)
+	if err != nil {
+		return nil, err
+	}
+	for i, id := range idIndexes {
+		if u, ok := byID[id]; ok {
+			results[i].Found, results[i].User = true, u
+		}
+	}
+
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for _, i := range indexed {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			var (
+				u   *models.User
+				err error
+			)
+			if lookups[i].Type == models.LookupByUsername {
+				u, err = GetUserByUsername(lookups[i].Value)
+			} else {
+				u, err = GetUserByKeycloakID(lookups[i].Value)
+			}
+			switch {
+			case err == nil:
+				results[i].Found, results[i].User = true, u
+			case !errors.Is(err, gocql.ErrNotFound):
+				results[i].Error = "lookup failed"
+			}
+		}(i)
+	}
+	wg.Wait()
+	return results, nil
+}
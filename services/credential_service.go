@@ -0,0 +1,119 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"go-keycloack/config"
+	"go-keycloack/encryption"
+	"go-keycloack/models"
+	"go-keycloack/oid4vc"
+
+	"github.com/gocql/gocql"
+)
+
+var credentialClient *oid4vc.Client
+
+// InitOID4VC configures the client for the OID4VC issuer and verifier services.
+func InitOID4VC() {
+	rewrites, err := oid4vc.ParseHostRewrites(config.GetList("OID4VC_HOST_REWRITES", []string{"host.docker.internal=localhost"}))
+	if err != nil {
+		log.Fatalf("Invalid OID4VC_HOST_REWRITES: %v", err)
+	}
+	authHeader := config.GetString("OID4VC_AUTH_HEADER", "Authorization")
+	credentialClient = oid4vc.New(oid4vc.Config{
+		IssuerURL:       config.GetString("OID4VC_ISSUER_URL", "http://localhost:7002"),
+		VerifierURL:     config.GetString("OID4VC_VERIFIER_URL", "http://localhost:7003"),
+		Timeout:         config.GetDuration("OID4VC_TIMEOUT", 10*time.Second),
+		IssuerHeaders:   authHeaders(authHeader, config.GetString("OID4VC_ISSUER_AUTH", "")),
+		VerifierHeaders: authHeaders(authHeader, config.GetString("OID4VC_VERIFIER_AUTH", "")),
+		HostRewrites:    rewrites,
+	})
+}
+
+func authHeaders(name, value string) http.Header {
+	if value == "" {
+		return nil
+	}
+	h := http.Header{}
+	h.Set(name, value)
+	return h
+}
+
+// OnboardIssuer has the issuer service generate a key and a DID for a new issuer.
+func OnboardIssuer(ctx context.Context, req oid4vc.OnboardIssuerRequest) (*oid4vc.IssuerOnboarding, error) {
+	return credentialClient.OnboardIssuer(ctx, req)
+}
+
+// IssueCredential creates a credential offer.
+func IssueCredential(ctx context.Context, req oid4vc.IssuanceRequest) (*oid4vc.CredentialOffer, error) {
+	return credentialClient.IssueCredential(ctx, req)
+}
+
+// VerifyCredential starts a verification session with the verifier service.
+func VerifyCredential(ctx context.Context, req json.RawMessage) (*oid4vc.VerificationRequest, error) {
+	return credentialClient.Verify(ctx, req)
+}
+
+const credentialDataField = "credential.data"
+
+// RecordIssuedCredential stores a credential issued to the user. The subject data is encrypted
+// whenever encryption is configured.
+func RecordIssuedCredential(rec *models.IssuedCredential) error {
+	if rec.IssuedAt.IsZero() {
+		rec.IssuedAt = time.Now().UTC()
+	}
+	data := string(rec.CredentialData)
+	if encryption.Default != nil && data != "" {
+		var err error
+		if data, err = encryption.Default.Seal(credentialDataField, data); err != nil {
+			return err
+		}
+	}
+	return config.Session.Query(
+		`INSERT INTO issued_credentials (user_id, issued_at, issuer_id, issuer_did, credential_issuer,
+		credential_configuration_id, credential_data) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		rec.UserID, gocql.UUIDFromTime(rec.IssuedAt), rec.IssuerID, rec.IssuerDID, rec.CredentialIssuer,
+		rec.CredentialConfigurationID, data,
+	).Exec()
+}
+
+// ListIssuedCredentials returns every credential issued to the user, newest first.
+func ListIssuedCredentials(userID gocql.UUID) ([]models.IssuedCredential, error) {
+	iter := config.Session.Query(
+		`SELECT issued_at, issuer_id, issuer_did, credential_issuer, credential_configuration_id, credential_data
+		FROM issued_credentials WHERE user_id = ?`, userID,
+	).PageSize(exportPageSize).Iter()
+	records := []models.IssuedCredential{}
+	var (
+		rec      models.IssuedCredential
+		issuedAt gocql.UUID
+		data     string
+	)
+	for iter.Scan(&issuedAt, &rec.IssuerID, &rec.IssuerDID, &rec.CredentialIssuer, &rec.CredentialConfigurationID, &data) {
+		rec.UserID = userID
+		rec.IssuedAt = issuedAt.Time().UTC()
+		plaintext, err := encryption.Default.Decrypt(credentialDataField, data)
+		if err != nil {
+			iter.Close()
+			return nil, err
+		}
+		if plaintext != "" {
+			rec.CredentialData = json.RawMessage(plaintext)
+		}
+		records = append(records, rec)
+		rec = models.IssuedCredential{}
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// DeleteIssuedCredentials removes every issued-credential record held for the user.
+func DeleteIssuedCredentials(userID gocql.UUID) error {
+	return config.Session.Query("DELETE FROM issued_credentials WHERE user_id = ?", userID).Exec()
+}
@@ -0,0 +1,274 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"go-keycloack/config"
+	"go-keycloack/encryption"
+
+	"github.com/gocql/gocql"
+)
+
+var (
+	// ErrEncryptionDisabled is returned when a rotation is requested without a PII keyfile.
+	ErrEncryptionDisabled = errors.New("PII encryption is not configured")
+	// ErrRotationRunning is returned when a rotation is requested while one is in progress.
+	ErrRotationRunning = errors.New("key rotation already running")
+)
+
+// KeyRotationStatus reports the progress of the PII re-encryption job.
+type KeyRotationStatus struct {
+	Running    bool       `json:"running"`
+	KeyID      string     `json:"key_id,omitempty"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	Scanned    int        `json:"scanned"`
+	Rotated    int        `json:"rotated"`
+	Failed     int        `json:"failed"`
+	Error      string     `json:"error,omitempty"`
+}
+
+var (
+	rotationMu     sync.Mutex
+	rotationStatus KeyRotationStatus
+)
+
+// GetKeyRotationStatus returns the status of the current or last rotation.
+func GetKeyRotationStatus() KeyRotationStatus {
+	rotationMu.Lock()
+	defer rotationMu.Unlock()
+	return rotationStatus
+}
+
+// StartKeyRotation re-encrypts, in the background and row by row, every user whose PII, including
+// PII custom attributes, is still in plaintext or wrapped with a retired master key, and backfills
+// missing email indexes. It then does the same for the other sealed columns. The service stays
+// online throughout since readers handle both old and new values.
+func StartKeyRotation() (KeyRotationStatus, error) {
+	if encryption.Default == nil {
+		return KeyRotationStatus{}, ErrEncryptionDisabled
+	}
+	rotationMu.Lock()
+	defer rotationMu.Unlock()
+	if rotationStatus.Running {
+		return rotationStatus, ErrRotationRunning
+	}
+	now := time.Now().UTC()
+	rotationStatus = KeyRotationStatus{Running: true, KeyID: encryption.Default.ActiveKeyID(), StartedAt: &now}
+	go runKeyRotation()
+	return rotationStatus, nil
+}
+
+func updateRotation(update func(s *KeyRotationStatus)) {
+	rotationMu.Lock()
+	update(&rotationStatus)
+	rotationMu.Unlock()
+}
+
+// sealedColumn is a column whose values are sealed with the keyring outside the users table. Every
+// primary key column is a uuid or timeuuid.
+type sealedColumn struct {
+	table  string
+	column string
+	field  string
+	keys   []string
+}
+
+// sealedColumns lists every sealed column rotated after the users table, so that once a rotation
+// finishes without failures no value is left wrapped with a retired key.
+var sealedColumns = []sealedColumn{
+	{"user_audit", "changes", auditChangesField, []string{"user_id", "event_id"}},
+	{"issued_credentials", "credential_data", credentialDataField, []string{"user_id", "issued_at"}},
+	{"issuers", "key_material", issuerKeyField, []string{"id"}},
+}
+
+func runKeyRotation() {
+	pause := config.GetDuration("PII_ROTATION_PAUSE", 0)
+	errs := []error{rotateUsers(pause)}
+	for _, col := range sealedColumns {
+		errs = append(errs, rotateSealedColumn(col, pause))
+	}
+	err := errors.Join(errs...)
+
+	now := time.Now().UTC()
+	updateRotation(func(s *KeyRotationStatus) {
+		s.Running = false
+		s.FinishedAt = &now
+		if err != nil {
+			s.Error = err.Error()
+		}
+	})
+	log.Printf("Key rotation finished: %+v", GetKeyRotationStatus())
+}
+
+// countRotation records the outcome of rotating one row in the status.
+func countRotation(rotated bool, err error) {
+	updateRotation(func(s *KeyRotationStatus) {
+		s.Scanned++
+		switch {
+		case err != nil:
+			s.Failed++
+		case rotated:
+			s.Rotated++
+		}
+	})
+}
+
+func rotateUsers(pause time.Duration) error {
+	iter := config.Session.Query("SELECT id, email, email_index, firstname, lastname, attributes FROM users").PageSize(200).Iter()
+	var (
+		id                                   gocql.UUID
+		email, emailIdx, firstName, lastName string
+		attrs                                map[string]string
+	)
+	for iter.Scan(&id, &email, &emailIdx, &firstName, &lastName, &attrs) {
+		stored := map[string]string{"email": email, "firstname": firstName, "lastname": lastName}
+		rotated, err := rotateUserRow(id, stored, emailIdx, attrs)
+		attrs = nil
+		if err != nil {
+			log.Printf("Key rotation failed for user %s: %v", id, err)
+		}
+		countRotation(rotated, err)
+		if pause > 0 {
+			time.Sleep(pause)
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return fmt.Errorf("users: %w", err)
+	}
+	return nil
+}
+
+// rotateSealedColumn re-seals every value of the column that is still in plaintext or wrapped
+// with a retired master key.
+func rotateSealedColumn(col sealedColumn, pause time.Duration) error {
+	iter := config.Session.Query(
+		"SELECT " + strings.Join(col.keys, ", ") + ", " + col.column + " FROM " + col.table,
+	).PageSize(200).Iter()
+	keys := make([]gocql.UUID, len(col.keys))
+	var value string
+	dest := make([]interface{}, 0, len(keys)+1)
+	for i := range keys {
+		dest = append(dest, &keys[i])
+	}
+	dest = append(dest, &value)
+	for iter.Scan(dest...) {
+		rotated, err := resealValue(col, keys, value)
+		if err != nil {
+			log.Printf("Key rotation failed for %s row %v: %v", col.table, keys, err)
+		}
+		countRotation(rotated, err)
+		if pause > 0 {
+			time.Sleep(pause)
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return fmt.Errorf("%s: %w", col.table, err)
+	}
+	return nil
+}
+
+// resealValue rewrites one sealed value with the active key. Like rotateUserRow, the update is
+// conditional on the old value, and a row deleted in the meantime is not recreated.
+func resealValue(col sealedColumn, keys []gocql.UUID, stored string) (bool, error) {
+	sealed, err := reseal(col.field, stored)
+	if err != nil || sealed == "" {
+		return false, err
+	}
+	conditions := make([]string, len(col.keys))
+	args := []interface{}{sealed}
+	for i, key := range col.keys {
+		conditions[i] = key + " = ?"
+		args = append(args, keys[i])
+	}
+	args = append(args, stored)
+	return config.Session.Query(
+		"UPDATE "+col.table+" SET "+col.column+" = ? WHERE "+strings.Join(conditions, " AND ")+" IF "+col.column+" = ?",
+		args...,
+	).MapScanCAS(map[string]interface{}{})
+}
+
+// reseal returns the value sealed with the active key, or "" if it is already.
+func reseal(field, stored string) (string, error) {
+	if stored == "" || (encryption.IsEncrypted(stored) && !encryption.Default.NeedsRotation(field, stored)) {
+		return "", nil
+	}
+	plaintext, err := encryption.Default.Decrypt(field, stored)
+	if err != nil {
+		return "", err
+	}
+	return encryption.Default.Seal(field, plaintext)
+}
+
+// rotateUserRow rewrites the row's PII columns and attributes if any of them needs rotation. The
+// update is conditional on the old ciphertext so that a concurrent profile update is never
+// overwritten.
+func rotateUserRow(id gocql.UUID, stored map[string]string, storedIndex string, storedAttrs map[string]string) (bool, error) {
+	needsRotation := false
+	for field, value := range stored {
+		if encryption.Default.NeedsRotation(field, value) {
+			needsRotation = true
+		}
+	}
+	updatedAttrs := make(map[string]string, len(storedAttrs))
+	for name, value := range storedAttrs {
+		if !attributeNeedsRotation(name, value) {
+			updatedAttrs[name] = value
+			continue
+		}
+		plaintext, err := encryption.Default.Decrypt(attributeField(name), value)
+		if err != nil {
+			return false, err
+		}
+		if updatedAttrs[name], err = encryption.Default.Seal(attributeField(name), plaintext); err != nil {
+			return false, err
+		}
+		needsRotation = true
+	}
+
+	plaintext := map[string]string{}
+	for field, value := range stored {
+		p, err := encryption.Default.Decrypt(field, value)
+		if err != nil {
+			return false, err
+		}
+		plaintext[field] = p
+	}
+	index := emailIndex(plaintext["email"])
+	if !needsRotation && index == storedIndex {
+		return false, nil
+	}
+
+	updated := map[string]string{}
+	for field, value := range plaintext {
+		if !encryption.Default.NeedsRotation(field, stored[field]) {
+			updated[field] = stored[field]
+			continue
+		}
+		ciphertext, err := encryption.Default.Encrypt(field, value)
+		if err != nil {
+			return false, err
+		}
+		updated[field] = ciphertext
+	}
+
+	applied, err := config.Session.Query(
+		`UPDATE users SET email = ?, email_index = ?, firstname = ?, lastname = ?, attributes = ? WHERE id = ?
+		IF email = ? AND firstname = ? AND lastname = ? AND attributes = ?`,
+		updated["email"], index, updated["firstname"], updated["lastname"], updatedAttrs, id,
+		stored["email"], stored["firstname"], stored["lastname"], storedAttrs,
+	).MapScanCAS(map[string]interface{}{})
+	if err != nil {
+		return false, err
+	}
+	if applied {
+		invalidateUserCache(id)
+	}
+	// A row that changed underneath us was rewritten by UpdateUser with the active key already.
+	return applied, nil
+}
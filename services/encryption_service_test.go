@@ -0,0 +1,57 @@
+package services
+
+import (
+	"strings"
+	"testing"
+
+	"go-keycloack/encryption"
+)
+
+func TestReseal(t *testing.T) {
+	withEncryption(t, "k1")
+	old, err := encryption.Default.Seal(auditChangesField, `{"email":{"before":"a","after":"b"}}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	withEncryption(t, "k2")
+	current, err := encryption.Default.Seal(auditChangesField, `{}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		stored  string
+		rotated bool
+		want    string
+	}{
+		{"retired key", old, true, `{"email":{"before":"a","after":"b"}}`},
+		{"plaintext from before encryption", `{"email":{"before":"a","after":"b"}}`, true, `{"email":{"before":"a","after":"b"}}`},
+		{"active key", current, false, ""},
+		{"empty", "", false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sealed, err := reseal(auditChangesField, tt.stored)
+			if err != nil {
+				t.Fatalf("reseal() error = %v", err)
+			}
+			if (sealed != "") != tt.rotated {
+				t.Fatalf("reseal() = %q, want rotated = %v", sealed, tt.rotated)
+			}
+			if !tt.rotated {
+				return
+			}
+			if !strings.HasPrefix(sealed, "enc:v1:k2:") {
+				t.Errorf("reseal() = %q, want it wrapped with k2", sealed)
+			}
+			if plaintext, err := encryption.Default.Decrypt(auditChangesField, sealed); err != nil || plaintext != tt.want {
+				t.Errorf("Decrypt(reseal()) = %q, %v, want %q", plaintext, err, tt.want)
+			}
+		})
+	}
+
+	if _, err := reseal(credentialDataField, old); err == nil {
+		t.Error("reseal() accepted a value sealed for another column")
+	}
+}
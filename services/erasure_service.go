@@ -0,0 +1,436 @@
+package services
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go-keycloack/config"
+	"go-keycloack/models"
+
+	"github.com/gocql/gocql"
+)
+
+// ErrErasureInProgress is returned when an erasure job is already running in this instance.
+var ErrErasureInProgress = errors.New("erasure job already running")
+
+const erasureChain = "erasure"
+
+const erasureJobColumns = "id, user_id, username, keycloak_id, status, completed_steps, requested_by, created_at, updated_at, error, tombstone_hash"
+
+func erasureJobFields(j *models.ErasureJob) []interface{} {
+	return []interface{}{&j.ID, &j.UserID, &j.Username, &j.KeycloakID, &j.Status, &j.CompletedSteps,
+		&j.RequestedBy, &j.CreatedAt, &j.UpdatedAt, &j.Error, &j.TombstoneHash}
+}
+
+// erasureStep is one idempotent stage of the erasure workflow.
+type erasureStep struct {
+	name string
+	run  func(job *models.ErasureJob) error
+}
+
+// erasureSteps run in order. The tombstone is written last so that it is only recorded once
+// every store has been cleared.
+var erasureSteps = []erasureStep{
+	{"login_history", func(job *models.ErasureJob) error { return DeleteLoginHistory(job.UserID) }},
+	{"audit", func(job *models.ErasureJob) error { return DeleteAudit(job.UserID) }},
+	{"preferences", func(job *models.ErasureJob) error { return DeleteAllPreferences(job.UserID) }},
+	{"avatar", func(job *models.ErasureJob) error { return DeleteAvatar(job.UserID) }},
+	{"valkey", eraseValkeyKeys},
+	{"keycloak", func(job *models.ErasureJob) error {
+		if job.KeycloakID == "" {
+			return nil
+		}
+		// Deleting the Keycloak user also ends all of their sessions.
+		return DeleteKeycloakUser(job.KeycloakID)
+	}},
+	{"credentials", func(job *models.ErasureJob) error { return DeleteIssuedCredentials(job.UserID) }},
+	{"issuers", eraseIssuers},
+	{"profile", func(job *models.ErasureJob) error { return DeleteUser(job.UserID) }},
+	{"tombstone", writeErasureTombstone},
+}
+
+var (
+	runningErasuresMu sync.Mutex
+	runningErasures   = map[gocql.UUID]bool{}
+)
+
+// StartErasure creates an erasure job for the user and runs it in the background.
+func StartErasure(user *models.User, requestedBy string) (*models.ErasureJob, error) {
+	keycloakID, err := resolveKeycloakID(user)
+	if err != nil && !errors.Is(err, ErrKeycloakNotFound) {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	job := &models.ErasureJob{
+		ID:             gocql.TimeUUID(),
+		UserID:         user.ID,
+		Username:       user.Username,
+		KeycloakID:     keycloakID,
+		Status:         models.ErasureStatusPending,
+		CompletedSteps: map[string]time.Time{},
+		RequestedBy:    requestedBy,
+		CreatedAt:      now,
+		UpdatedAt:      now,
+	}
+	if err := config.Session.Query(
+		"INSERT INTO erasure_jobs ("+erasureJobColumns+") VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		erasureJobFields(job)...,
+	).Exec(); err != nil {
+		return nil, err
+	}
+
+	go runErasureJob(job.ID)
+	return job, nil
+}
+
+// GetErasureJob returns the erasure job with the given ID.
+func GetErasureJob(id gocql.UUID) (*models.ErasureJob, error) {
+	var job models.ErasureJob
+	if err := config.Session.Query(
+		"SELECT "+erasureJobColumns+" FROM erasure_jobs WHERE id = ?", id,
+	).Scan(erasureJobFields(&job)...); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// ResumeErasure restarts an unfinished erasure job in the background.
+func ResumeErasure(id gocql.UUID) error {
+	runningErasuresMu.Lock()
+	running := runningErasures[id]
+	runningErasuresMu.Unlock()
+	if running {
+		return ErrErasureInProgress
+	}
+	go runErasureJob(id)
+	return nil
+}
+
+// ResumeErasureJobs restarts every erasure job that did not complete, e.g. because the process
+// stopped while it was running. It is called once at startup.
+func ResumeErasureJobs() {
+	iter := config.Session.Query("SELECT id, status FROM erasure_jobs").Iter()
+	var (
+		id     gocql.UUID
+		status string
+	)
+	for iter.Scan(&id, &status) {
+		if status == models.ErasureStatusPending || status == models.ErasureStatusRunning {
+			log.Printf("Resuming erasure job %s", id)
+			go runErasureJob(id)
+		}
+	}
+	if err := iter.Close(); err != nil {
+		log.Printf("Failed to list erasure jobs: %v", err)
+	}
+}
+
+func runErasureJob(id gocql.UUID) {
+	runningErasuresMu.Lock()
+	if runningErasures[id] {
+		runningErasuresMu.Unlock()
+		return
+	}
+	runningErasures[id] = true
+	runningErasuresMu.Unlock()
+	defer func() {
+		runningErasuresMu.Lock()
+		delete(runningErasures, id)
+		runningErasuresMu.Unlock()
+	}()
+
+	job, err := GetErasureJob(id)
+	if err != nil {
+		log.Printf("Erasure job %s could not be loaded: %v", id, err)
+		return
+	}
+	if job.Status == models.ErasureStatusCompleted {
+		return
+	}
+	if job.CompletedSteps == nil {
+		job.CompletedSteps = map[string]time.Time{}
+	}
+	if err := updateErasureStatus(job, models.ErasureStatusRunning, ""); err != nil {
+		log.Printf("Erasure job %s could not be started: %v", id, err)
+		return
+	}
+
+	for _, step := range erasureSteps {
+		if _, done := job.CompletedSteps[step.name]; done {
+			continue
+		}
+		if err := step.run(job); err != nil {
+			log.Printf("Erasure job %s failed at step %s: %v", id, step.name, err)
+			if err := updateErasureStatus(job, models.ErasureStatusFailed, fmt.Sprintf("%s: %v", step.name, err)); err != nil {
+				log.Printf("Erasure job %s status could not be saved: %v", id, err)
+			}
+			return
+		}
+		completedAt := time.Now().UTC()
+		if err := config.Session.Query(
+			"UPDATE erasure_jobs SET completed_steps[?] = ?, updated_at = ? WHERE id = ?",
+			step.name, completedAt, completedAt, id,
+		).Exec(); err != nil {
+			log.Printf("Erasure job %s progress could not be saved: %v", id, err)
+			return
+		}
+		job.CompletedSteps[step.name] = completedAt
+	}
+
+	if err := completeErasureJob(job); err != nil {
+		log.Printf("Erasure job %s status could not be saved: %v", id, err)
+		return
+	}
+	log.Printf("Erasure job %s completed", id)
+}
+
+func updateErasureStatus(job *models.ErasureJob, status, errMsg string) error {
+	now := time.Now().UTC()
+	if err := config.Session.Query(
+		"UPDATE erasure_jobs SET status = ?, error = ?, updated_at = ? WHERE id = ?",
+		status, errMsg, now, job.ID,
+	).Exec(); err != nil {
+		return err
+	}
+	job.Status, job.Error, job.UpdatedAt = status, errMsg, now
+	return nil
+}
+
+// completeErasureJob marks the job completed and clears the username and Keycloak ID it held for
+// the steps, so that the finished job does not itself retain the erased identity.
+func completeErasureJob(job *models.ErasureJob) error {
+	now := time.Now().UTC()
+	if err := config.Session.Query(
+		"UPDATE erasure_jobs SET status = ?, error = ?, username = null, keycloak_id = null, updated_at = ? WHERE id = ?",
+		models.ErasureStatusCompleted, "", now, job.ID,
+	).Exec(); err != nil {
+		return err
+	}
+	job.Status, job.Error, job.UpdatedAt = models.ErasureStatusCompleted, "", now
+	job.Username, job.KeycloakID = "", ""
+	return nil
+}
+
+// erasureValkeyPatterns lists the Valkey keys that may hold state about the user.
+func erasureValkeyPatterns(job *models.ErasureJob) []string {
+	subjects := []string{job.Username}
+	if job.KeycloakID != "" {
+		subjects = append(subjects, job.KeycloakID)
+	}
+	var patterns []string
+	for _, subject := range subjects {
+		subject = escapeGlob(subject)
+		patterns = append(patterns, "rate:"+subject+":*", "quota:"+subject+":*", "quota_override:"+subject, "rate_override:"+subject, "inflight:"+subject+":*")
+	}
+	failKey, blockKey, lockoutKey := loginKeys(models.LoginScopeUsername, job.Username)
+	patterns = append(patterns, escapeGlob(failKey), escapeGlob(blockKey), escapeGlob(lockoutKey))
+	return patterns
+}
+
+func eraseValkeyKeys(job *models.ErasureJob) error {
+	ctx := context.Background()
+	for _, pattern := range erasureValkeyPatterns(job) {
+		if err := deleteValkeyKeys(ctx, pattern); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteValkeyKeys removes every key matching pattern, walking the keyspace with SCAN.
+func deleteValkeyKeys(ctx context.Context, pattern string) error {
+	var cursor uint64
+	for {
+		keys, next, err := config.Valkey.Scan(ctx, cursor, pattern, 500).Result()
+		if err != nil {
+			return err
+		}
+		if len(keys) > 0 {
+			if err := config.Valkey.Del(ctx, keys...).Err(); err != nil {
+				return err
+			}
+		}
+		if next == 0 {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+// escapeGlob escapes the characters that SCAN MATCH treats as glob syntax.
+func escapeGlob(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `*`, `\*`, `?`, `\?`, `[`, `\[`, `]`, `\]`).Replace(s)
+}
+
+// eraseIssuers removes the issuers the user registered, along with their key material. Issuers
+// are owned by the Keycloak ID, so there is nothing to do for users without one.
+func eraseIssuers(job *models.ErasureJob) error {
+	if job.KeycloakID == "" {
+		return nil
+	}
+	issuers, err := ListIssuers(job.KeycloakID)
+	if err != nil {
+		return err
+	}
+	for _, issuer := range issuers {
+		if err := DeleteIssuer(issuer.ID); err != nil && !errors.Is(err, ErrIssuerNotFound) {
+			return err
+		}
+	}
+	return nil
+}
+
+// erasureSubjectHash identifies the erased subject without retaining their username. It is keyed
+// with ERASURE_HASH_KEY so that it cannot be reversed by hashing candidate usernames.
+func erasureSubjectHash(job *models.ErasureJob) string {
+	key := os.Getenv("ERASURE_HASH_KEY")
+	if key == "" {
+		log.Println("ERASURE_HASH_KEY is not set; erasure tombstones use an unkeyed subject hash")
+	}
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(job.UserID.String() + "|" + job.Username))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// tombstoneTime truncates t to the 100ns precision of a timeuuid. The erasure time is stored
+// only as the tombstone's timeuuid key, so it must be hashed at that precision for the hash to
+// be reproducible from the stored row.
+func tombstoneTime(t time.Time) time.Time {
+	return t.UTC().Truncate(100 * time.Nanosecond)
+}
+
+func tombstoneHash(t *models.ErasureTombstone) string {
+	sum := sha256.Sum256([]byte(strings.Join([]string{
+		t.PrevHash,
+		t.UserID.String(),
+		t.SubjectHash,
+		t.ErasedAt.UTC().Format(time.RFC3339Nano),
+		strings.Join(t.Steps, ","),
+	}, "|")))
+	return hex.EncodeToString(sum[:])
+}
+
+// writeErasureTombstone appends a tombstone to the hash chain. The chain head is advanced with a
+// lightweight transaction so that concurrent erasures cannot fork the chain.
+func writeErasureTombstone(job *models.ErasureJob) error {
+	steps := make([]string, 0, len(job.CompletedSteps))
+	for name := range job.CompletedSteps {
+		steps = append(steps, name)
+	}
+	sort.Strings(steps)
+
+	for attempt := 0; attempt < 10; attempt++ {
+		var head string
+		err := config.Session.Query("SELECT hash FROM erasure_chain_head WHERE chain = ?", erasureChain).
+			Consistency(gocql.Quorum).SerialConsistency(gocql.Serial).Scan(&head)
+		if errors.Is(err, gocql.ErrNotFound) {
+			if _, err := config.Session.Query(
+				"INSERT INTO erasure_chain_head (chain, hash) VALUES (?, ?) IF NOT EXISTS", erasureChain, "",
+			).MapScanCAS(map[string]interface{}{}); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		erasedAt := tombstoneTime(time.Now())
+		t := &models.ErasureTombstone{
+			UserID:      job.UserID,
+			SubjectHash: erasureSubjectHash(job),
+			ErasedAt:    erasedAt,
+			Steps:       steps,
+			PrevHash:    head,
+		}
+		t.Hash = tombstoneHash(t)
+		eventID := gocql.UUIDFromTime(erasedAt)
+
+		if err := config.Session.Query(
+			`INSERT INTO erasure_tombstones (chain, erased_at, user_id, subject_hash, steps, prev_hash, hash)
+			VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			erasureChain, eventID, t.UserID, t.SubjectHash, t.Steps, t.PrevHash, t.Hash,
+		).Exec(); err != nil {
+			return err
+		}
+		applied, err := config.Session.Query(
+			"UPDATE erasure_chain_head SET hash = ? WHERE chain = ? IF hash = ?", t.Hash, erasureChain, head,
+		).MapScanCAS(map[string]interface{}{})
+		if err != nil {
+			return err
+		}
+		if applied {
+			job.TombstoneHash = t.Hash
+			return config.Session.Query("UPDATE erasure_jobs SET tombstone_hash = ? WHERE id = ?", t.Hash, job.ID).Exec()
+		}
+		// Another erasure advanced the chain first; drop our entry and link to the new head.
+		if err := config.Session.Query(
+			"DELETE FROM erasure_tombstones WHERE chain = ? AND erased_at = ?", erasureChain, eventID,
+		).Exec(); err != nil {
+			return err
+		}
+	}
+	return errors.New("could not append erasure tombstone: chain head kept changing")
+}
+
+// VerifyErasureChain recomputes every tombstone hash and walks the chain back from its head. It
+// returns the number of verified tombstones, or an error describing the first inconsistency.
+func VerifyErasureChain() (int, error) {
+	var head string
+	err := config.Session.Query("SELECT hash FROM erasure_chain_head WHERE chain = ?", erasureChain).
+		Consistency(gocql.Quorum).SerialConsistency(gocql.Serial).Scan(&head)
+	if errors.Is(err, gocql.ErrNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	var tombstones []*models.ErasureTombstone
+	iter := config.Session.Query(
+		"SELECT erased_at, user_id, subject_hash, steps, prev_hash, hash FROM erasure_tombstones WHERE chain = ?", erasureChain,
+	).Iter()
+	var eventID gocql.UUID
+	t := &models.ErasureTombstone{}
+	for iter.Scan(&eventID, &t.UserID, &t.SubjectHash, &t.Steps, &t.PrevHash, &t.Hash) {
+		t.ErasedAt = eventID.Time().UTC()
+		tombstones = append(tombstones, t)
+		t = &models.ErasureTombstone{}
+	}
+	if err := iter.Close(); err != nil {
+		return 0, err
+	}
+	return verifyTombstones(head, tombstones)
+}
+
+// verifyTombstones checks each tombstone's hash and walks the chain back from head.
+func verifyTombstones(head string, tombstones []*models.ErasureTombstone) (int, error) {
+	byHash := map[string]*models.ErasureTombstone{}
+	for _, t := range tombstones {
+		if tombstoneHash(t) != t.Hash {
+			return 0, fmt.Errorf("tombstone for user %s has been altered", t.UserID)
+		}
+		byHash[t.Hash] = t
+	}
+
+	verified := 0
+	for hash := head; hash != ""; verified++ {
+		t, ok := byHash[hash]
+		if !ok {
+			return verified, fmt.Errorf("tombstone %s is missing from the chain", hash)
+		}
+		hash = t.PrevHash
+	}
+	return verified, nil
+}
@@ -0,0 +1,109 @@
+package services
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"go-keycloack/models"
+
+	"github.com/gocql/gocql"
+)
+
+// storedTombstone returns t as VerifyErasureChain reads it back: the erasure time comes from
+// the timeuuid key the tombstone is stored under.
+func storedTombstone(t models.ErasureTombstone) *models.ErasureTombstone {
+	t.ErasedAt = gocql.UUIDFromTime(t.ErasedAt).Time().UTC()
+	return &t
+}
+
+func buildChain(n int) (string, []*models.ErasureTombstone) {
+	var (
+		head       string
+		tombstones []*models.ErasureTombstone
+	)
+	base := time.Date(2026, 3, 1, 12, 0, 0, 123456789, time.UTC)
+	for i := 0; i < n; i++ {
+		t := models.ErasureTombstone{
+			UserID:      gocql.TimeUUID(),
+			SubjectHash: strings.Repeat("ab", 32),
+			ErasedAt:    tombstoneTime(base.Add(time.Duration(i)*time.Second + 17)),
+			Steps:       []string{"audit", "login_history", "profile"},
+			PrevHash:    head,
+		}
+		t.Hash = tombstoneHash(&t)
+		head = t.Hash
+		tombstones = append(tombstones, storedTombstone(t))
+	}
+	return head, tombstones
+}
+
+func TestVerifyTombstones(t *testing.T) {
+	tests := []struct {
+		name     string
+		tamper   func(head string, ts []*models.ErasureTombstone) (string, []*models.ErasureTombstone)
+		verified int
+		wantErr  string
+	}{
+		{
+			name:     "intact chain",
+			tamper:   func(head string, ts []*models.ErasureTombstone) (string, []*models.ErasureTombstone) { return head, ts },
+			verified: 3,
+		},
+		{
+			name: "empty chain",
+			tamper: func(string, []*models.ErasureTombstone) (string, []*models.ErasureTombstone) {
+				return "", nil
+			},
+			verified: 0,
+		},
+		{
+			name: "altered steps",
+			tamper: func(head string, ts []*models.ErasureTombstone) (string, []*models.ErasureTombstone) {
+				ts[1].Steps = []string{"audit"}
+				return head, ts
+			},
+			wantErr: "has been altered",
+		},
+		{
+			name: "altered erasure time",
+			tamper: func(head string, ts []*models.ErasureTombstone) (string, []*models.ErasureTombstone) {
+				ts[0].ErasedAt = ts[0].ErasedAt.Add(time.Microsecond)
+				return head, ts
+			},
+			wantErr: "has been altered",
+		},
+		{
+			name: "missing link",
+			tamper: func(head string, ts []*models.ErasureTombstone) (string, []*models.ErasureTombstone) {
+				return head, append(ts[:1], ts[2:]...)
+			},
+			verified: 1,
+			wantErr:  "is missing from the chain",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			head, ts := tt.tamper(buildChain(3))
+			verified, err := verifyTombstones(head, ts)
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("verifyTombstones() error = %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("verifyTombstones() error = %v, want %q", err, tt.wantErr)
+			}
+			if verified != tt.verified {
+				t.Errorf("verifyTombstones() verified = %d, want %d", verified, tt.verified)
+			}
+		})
+	}
+}
+
+func TestTombstoneTimeSurvivesTimeUUID(t *testing.T) {
+	for _, ns := range []int{0, 1, 99, 100, 123456789, 999999999} {
+		erasedAt := tombstoneTime(time.Date(2026, 3, 1, 12, 0, 0, ns, time.UTC))
+		if got := gocql.UUIDFromTime(erasedAt).Time().UTC(); !got.Equal(erasedAt) {
+			t.Errorf("nanos %d: timeuuid round trip = %v, want %v", ns, got, erasedAt)
+		}
+	}
+}
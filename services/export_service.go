@@ -0,0 +1,234 @@
+package services
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"time"
+
+	"go-keycloack/models"
+
+	"github.com/gocql/gocql"
+)
+
+// ExportManifestFile describes one file in a data export archive.
+type ExportManifestFile struct {
+	Name    string `json:"name"`
+	Records int    `json:"records"`
+	Bytes   int    `json:"bytes"`
+	SHA256  string `json:"sha256"`
+}
+
+// ExportManifest is written to manifest.json at the root of every data export archive.
+type ExportManifest struct {
+	UserID      string               `json:"user_id"`
+	Username    string               `json:"username"`
+	GeneratedAt time.Time            `json:"generated_at"`
+	Files       []ExportManifestFile `json:"files"`
+	Notes       []string             `json:"notes,omitempty"`
+}
+
+type exportArchive struct {
+	zw       *zip.Writer
+	manifest ExportManifest
+}
+
+func (a *exportArchive) addJSON(name string, records int, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return a.addFile(name, records, data)
+}
+
+func (a *exportArchive) addFile(name string, records int, data []byte) error {
+	w, err := a.zw.Create(name)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+	a.manifest.Files = append(a.manifest.Files, ExportManifestFile{
+		Name:    name,
+		Records: records,
+		Bytes:   len(data),
+		SHA256:  hex.EncodeToString(sum[:]),
+	})
+	return nil
+}
+
+// ExportUserData writes a zip archive of everything held about the user to w: JSON files and a
+// manifest listing each file, its record count and checksum. level is the attribute visibility
+// of the caller, so that users do not receive attributes only admins may see. The archive is
+// written file by file as it is gathered; on error it is left incomplete.
+func ExportUserData(w io.Writer, user *models.User, level string) error {
+	archive := &exportArchive{
+		zw: zip.NewWriter(w),
+		manifest: ExportManifest{
+			UserID:      user.ID.String(),
+			Username:    user.Username,
+			GeneratedAt: time.Now().UTC(),
+		},
+	}
+
+	profile := *user
+	profile.Attributes = VisibleAttributes(user.Attributes, level)
+	if err := archive.addJSON("profile.json", 1, profile); err != nil {
+		return err
+	}
+
+	logins, err := allLoginHistory(user.ID)
+	if err != nil {
+		return err
+	}
+	if err := archive.addJSON("login_history.json", len(logins), logins); err != nil {
+		return err
+	}
+
+	audit, err := allAudit(user, level)
+	if err != nil {
+		return err
+	}
+	if err := archive.addJSON("audit.json", len(audit), audit); err != nil {
+		return err
+	}
+
+	prefs, err := allPreferences(user.ID)
+	if err != nil {
+		return err
+	}
+	if err := archive.addJSON("preferences.json", len(prefs), prefs); err != nil {
+		return err
+	}
+
+	sizes := AvatarSizes()
+	if len(sizes) > 0 {
+		avatar, err := GetAvatar(user.ID, sizes[len(sizes)-1])
+		if err != nil && !errors.Is(err, ErrAvatarNotFound) {
+			return err
+		}
+		if avatar != nil {
+			if err := archive.addFile("avatar.png", 1, avatar.Data); err != nil {
+				return err
+			}
+		}
+	}
+
+	credentials, err := ListIssuedCredentials(user.ID)
+	if err != nil {
+		return err
+	}
+	if err := archive.addJSON("issued_credentials.json", len(credentials), credentials); err != nil {
+		return err
+	}
+
+	// Issuers and the Keycloak account are both keyed by the Keycloak ID, the token subject.
+	keycloakID, err := resolveKeycloakID(user)
+	if errors.Is(err, ErrKeycloakNotFound) {
+		archive.manifest.Notes = append(archive.manifest.Notes, "No Keycloak account exists for this user.")
+	} else if err != nil {
+		return err
+	}
+
+	issuers := []models.Issuer{}
+	if keycloakID != "" {
+		if issuers, err = ListIssuers(keycloakID); err != nil {
+			return err
+		}
+	}
+	if err := archive.addJSON("issuers.json", len(issuers), issuers); err != nil {
+		return err
+	}
+
+	if keycloakID != "" {
+		if err := addKeycloakExport(archive, keycloakID, level); err != nil {
+			return err
+		}
+	}
+
+	if err := archive.addJSON("manifest.json", len(archive.manifest.Files), archive.manifest); err != nil {
+		return err
+	}
+	return archive.zw.Close()
+}
+
+func addKeycloakExport(archive *exportArchive, keycloakID, level string) error {
+	data, err := GetKeycloakUserData(keycloakID)
+	if errors.Is(err, ErrKeycloakNotFound) {
+		archive.manifest.Notes = append(archive.manifest.Notes, "No Keycloak account exists for this user.")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if attrs, ok := data.User["attributes"].(map[string]interface{}); ok {
+		data.User["attributes"] = visibleKeycloakAttributes(attrs, level)
+	}
+
+	files := []struct {
+		name    string
+		records int
+		v       interface{}
+	}{
+		{"keycloak/user.json", 1, data.User},
+		{"keycloak/groups.json", len(data.Groups), data.Groups},
+		{"keycloak/role_mappings.json", 1, data.RoleMappings},
+		{"keycloak/federated_identities.json", len(data.FederatedIdentities), data.FederatedIdentities},
+		{"keycloak/sessions.json", len(data.Sessions), data.Sessions},
+	}
+	for _, f := range files {
+		if err := archive.addJSON(f.name, f.records, f.v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const exportPageSize = 500
+
+func allLoginHistory(userID gocql.UUID) ([]models.LoginAttempt, error) {
+	var (
+		all       []models.LoginAttempt
+		pageState []byte
+	)
+	for {
+		page, next, err := ListLoginHistory(userID, exportPageSize, pageState)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, page...)
+		if len(next) == 0 {
+			return all, nil
+		}
+		pageState = next
+	}
+}
+
+// allAudit returns every audit entry of the user, with the attribute changes a caller at level may
+// not see left out.
+func allAudit(user *models.User, level string) ([]models.AuditEntry, error) {
+	var (
+		all       []models.AuditEntry
+		pageState []byte
+	)
+	for {
+		page, next, err := ListAudit(user.ID, time.Unix(0, 0), time.Now(), exportPageSize, pageState)
+		if err != nil {
+			return nil, err
+		}
+		for i := range page {
+			page[i].Changes = VisibleChanges(page[i].Changes, level)
+		}
+		all = append(all, page...)
+		if len(next) == 0 {
+			return all, nil
+		}
+		pageState = next
+	}
+}
@@ -0,0 +1,260 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go-keycloack/config"
+	"go-keycloack/models"
+
+	"github.com/gocql/gocql"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	ipRulesKey           = "ipfilter:rules"
+	ipRulesChangeChannel = "ipfilter:changed"
+)
+
+var (
+	// ErrInvalidIPRule is wrapped by errors caused by the submitted rule itself.
+	ErrInvalidIPRule = errors.New("invalid IP rule")
+	// ErrIPRuleNotFound is returned for unknown rule IDs.
+	ErrIPRuleNotFound = errors.New("IP rule not found")
+)
+
+// ipFilterMetrics counts blocked requests under "blocked:<rule id>" for deny rules and
+// "not_allowed:<group>" for requests outside a group's allow list.
+var ipFilterMetrics = expvar.NewMap("ip_filter")
+
+// compiledIPRule is a rule with its CIDR parsed for matching.
+type compiledIPRule struct {
+	models.IPRule
+	prefix netip.Prefix
+}
+
+// ipRules is the in-process copy of the rules, replaced whenever they change.
+var ipRules atomic.Pointer[[]compiledIPRule]
+
+// CheckIP decides whether a request from ip may reach path. Deny rules win over allow rules, and
+// a group with any allow rules only admits the listed ranges. The second result names the
+// reason for a block: the deny rule's ID or "not_allowed:<group>".
+func CheckIP(path, ip string) (bool, string) {
+	rules := ipRules.Load()
+	if rules == nil || len(*rules) == 0 {
+		return true, ""
+	}
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return true, ""
+	}
+	addr = addr.Unmap()
+	now := time.Now()
+
+	allowGroups := map[string]bool{}
+	for _, rule := range *rules {
+		if rule.Expired(now) || !inRouteGroup(path, rule.Group) {
+			continue
+		}
+		match := rule.prefix.Contains(addr)
+		switch rule.Action {
+		case models.IPRuleDeny:
+			if match {
+				ipFilterMetrics.Add("blocked:"+rule.ID, 1)
+				return false, rule.ID
+			}
+		case models.IPRuleAllow:
+			group := strings.ToLower(rule.Group)
+			allowGroups[group] = allowGroups[group] || match
+		}
+	}
+	for group, allowed := range allowGroups {
+		if !allowed {
+			ipFilterMetrics.Add("not_allowed:"+group, 1)
+			return false, "not_allowed:" + group
+		}
+	}
+	return true, ""
+}
+
+// inRouteGroup reports whether path is the group prefix or below it. Like Fiber's router, the
+// comparison ignores case.
+func inRouteGroup(path, group string) bool {
+	path = strings.ToLower(path)
+	group = strings.ToLower(strings.TrimSuffix(group, "/"))
+	return group == "" || path == group || strings.HasPrefix(path, group+"/")
+}
+
+// ListIPRules returns every stored rule, including expired ones not yet cleaned up.
+func ListIPRules(ctx context.Context) ([]models.IPRule, error) {
+	values, err := config.Valkey.HGetAll(ctx, ipRulesKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	rules := make([]models.IPRule, 0, len(values))
+	for id, value := range values {
+		var rule models.IPRule
+		if err := json.Unmarshal([]byte(value), &rule); err != nil {
+			log.Printf("Skipping unreadable IP rule %s: %v", id, err)
+			continue
+		}
+		rules = append(rules, rule)
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].CreatedAt.Before(rules[j].CreatedAt) })
+	return rules, nil
+}
+
+// GetIPRule returns a single rule.
+func GetIPRule(ctx context.Context, id string) (*models.IPRule, error) {
+	value, err := config.Valkey.HGet(ctx, ipRulesKey, id).Result()
+	if errors.Is(err, redis.Nil) {
+		return nil, ErrIPRuleNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var rule models.IPRule
+	if err := json.Unmarshal([]byte(value), &rule); err != nil {
+		return nil, err
+	}
+	return &rule, nil
+}
+
+// SaveIPRule validates and stores a rule, assigning an ID to new rules, and tells every instance
+// to reload.
+func SaveIPRule(ctx context.Context, rule *models.IPRule) error {
+	if err := normalizeIPRule(rule); err != nil {
+		return err
+	}
+	if rule.ID == "" {
+		rule.ID = gocql.TimeUUID().String()
+		rule.CreatedAt = time.Now().UTC()
+	}
+	data, err := json.Marshal(rule)
+	if err != nil {
+		return err
+	}
+	if err := config.Valkey.HSet(ctx, ipRulesKey, rule.ID, data).Err(); err != nil {
+		return err
+	}
+	return publishIPRuleChange(ctx)
+}
+
+// DeleteIPRule removes a rule and tells every instance to reload.
+func DeleteIPRule(ctx context.Context, id string) error {
+	n, err := config.Valkey.HDel(ctx, ipRulesKey, id).Result()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrIPRuleNotFound
+	}
+	return publishIPRuleChange(ctx)
+}
+
+func normalizeIPRule(rule *models.IPRule) error {
+	if rule.Action != models.IPRuleAllow && rule.Action != models.IPRuleDeny {
+		return fmt.Errorf("%w: action must be %q or %q", ErrInvalidIPRule, models.IPRuleAllow, models.IPRuleDeny)
+	}
+	prefix, err := parseCIDR(rule.CIDR)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidIPRule, err)
+	}
+	rule.CIDR = prefix.String()
+	if !strings.HasPrefix(rule.Group, "/") {
+		return fmt.Errorf("%w: group must be a path prefix such as /admin", ErrInvalidIPRule)
+	}
+	if rule.Group = strings.ToLower(strings.TrimSuffix(rule.Group, "/")); rule.Group == "" {
+		rule.Group = "/"
+	}
+	if rule.ExpiresAt != nil && !rule.ExpiresAt.After(time.Now()) {
+		return fmt.Errorf("%w: expires_at must be in the future", ErrInvalidIPRule)
+	}
+	return nil
+}
+
+// parseCIDR accepts a CIDR or a single address, which is treated as a /32 or /128.
+func parseCIDR(cidr string) (netip.Prefix, error) {
+	if !strings.Contains(cidr, "/") {
+		addr, err := netip.ParseAddr(cidr)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		addr = addr.Unmap()
+		return netip.PrefixFrom(addr, addr.BitLen()), nil
+	}
+	prefix, err := netip.ParsePrefix(cidr)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	if prefix.Addr().Is4In6() {
+		prefix = netip.PrefixFrom(prefix.Addr().Unmap(), prefix.Bits()-96)
+	}
+	return prefix.Masked(), nil
+}
+
+func publishIPRuleChange(ctx context.Context) error {
+	if err := ReloadIPRules(ctx); err != nil {
+		return err
+	}
+	return config.Valkey.Publish(ctx, ipRulesChangeChannel, "").Err()
+}
+
+// ReloadIPRules replaces the in-process rules with the ones in Valkey and removes expired ones.
+// If Valkey cannot be read, the previous rules stay in force.
+func ReloadIPRules(ctx context.Context) error {
+	rules, err := ListIPRules(ctx)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	compiled := make([]compiledIPRule, 0, len(rules))
+	for _, rule := range rules {
+		if rule.Expired(now) {
+			config.Valkey.HDel(ctx, ipRulesKey, rule.ID)
+			continue
+		}
+		prefix, err := parseCIDR(rule.CIDR)
+		if err != nil {
+			log.Printf("Skipping IP rule %s with invalid CIDR %q", rule.ID, rule.CIDR)
+			continue
+		}
+		compiled = append(compiled, compiledIPRule{IPRule: rule, prefix: prefix})
+	}
+	ipRules.Store(&compiled)
+	return nil
+}
+
+// StartIPFilter loads the rules and keeps them current: other instances announce changes on a
+// Valkey channel, and a periodic reload catches anything missed while disconnected.
+func StartIPFilter(interval time.Duration) {
+	ctx := context.Background()
+	if err := ReloadIPRules(ctx); err != nil {
+		log.Printf("Failed to load IP rules: %v", err)
+	}
+	go func() {
+		pubsub := config.Valkey.Subscribe(ctx, ipRulesChangeChannel)
+		defer pubsub.Close()
+		for range pubsub.Channel() {
+			if err := ReloadIPRules(ctx); err != nil {
+				log.Printf("Failed to reload IP rules: %v", err)
+			}
+		}
+	}()
+	go func() {
+		for range time.Tick(interval) {
+			if err := ReloadIPRules(ctx); err != nil {
+				log.Printf("Failed to reload IP rules: %v", err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,86 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"go-keycloack/models"
+)
+
+// withIPRules installs rules as the in-process IP rules for the duration of the test.
+func withIPRules(t *testing.T, rules ...models.IPRule) {
+	t.Helper()
+	saved := ipRules.Load()
+	compiled := make([]compiledIPRule, 0, len(rules))
+	for _, rule := range rules {
+		prefix, err := parseCIDR(rule.CIDR)
+		if err != nil {
+			t.Fatal(err)
+		}
+		compiled = append(compiled, compiledIPRule{IPRule: rule, prefix: prefix})
+	}
+	ipRules.Store(&compiled)
+	t.Cleanup(func() { ipRules.Store(saved) })
+}
+
+func TestCheckIP(t *testing.T) {
+	expired := time.Now().Add(-time.Minute)
+	withIPRules(t,
+		models.IPRule{ID: "office", Group: "/admin", CIDR: "10.0.0.0/8", Action: models.IPRuleAllow},
+		models.IPRule{ID: "vpn", Group: "/Admin", CIDR: "192.168.1.0/24", Action: models.IPRuleAllow},
+		models.IPRule{ID: "abuser", Group: "/", CIDR: "203.0.113.7", Action: models.IPRuleDeny},
+		models.IPRule{ID: "lifted", Group: "/", CIDR: "198.51.100.0/24", Action: models.IPRuleDeny, ExpiresAt: &expired},
+	)
+	tests := []struct {
+		path    string
+		ip      string
+		allowed bool
+		reason  string
+	}{
+		{"/admin/ip-rules", "10.1.2.3", true, ""},
+		{"/admin/ip-rules", "192.168.1.20", true, ""},
+		{"/admin/ip-rules", "8.8.8.8", false, "not_allowed:/admin"},
+		{"/ADMIN/ip-rules", "8.8.8.8", false, "not_allowed:/admin"},
+		{"/Admin", "8.8.8.8", false, "not_allowed:/admin"},
+		{"/administrator", "8.8.8.8", true, ""},
+		{"/users", "8.8.8.8", true, ""},
+		{"/users", "203.0.113.7", false, "abuser"},
+		{"/Admin/quotas", "::ffff:203.0.113.7", false, "abuser"},
+		{"/users", "198.51.100.1", true, ""},
+		{"/users", "not-an-ip", true, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path+" "+tt.ip, func(t *testing.T) {
+			allowed, reason := CheckIP(tt.path, tt.ip)
+			if allowed != tt.allowed || reason != tt.reason {
+				t.Errorf("CheckIP() = %v, %q, want %v, %q", allowed, reason, tt.allowed, tt.reason)
+			}
+		})
+	}
+}
+
+func TestNormalizeIPRule(t *testing.T) {
+	tests := []struct {
+		rule      models.IPRule
+		wantGroup string
+		wantCIDR  string
+		wantErr   bool
+	}{
+		{models.IPRule{Group: "/Admin/", CIDR: "10.0.0.1/8", Action: models.IPRuleAllow}, "/admin", "10.0.0.0/8", false},
+		{models.IPRule{Group: "/", CIDR: "::ffff:192.0.2.1", Action: models.IPRuleDeny}, "/", "192.0.2.1/32", false},
+		{models.IPRule{Group: "admin", CIDR: "10.0.0.0/8", Action: models.IPRuleAllow}, "", "", true},
+		{models.IPRule{Group: "/admin", CIDR: "10.0.0.0/33", Action: models.IPRuleAllow}, "", "", true},
+		{models.IPRule{Group: "/admin", CIDR: "10.0.0.0/8", Action: "block"}, "", "", true},
+	}
+	for _, tt := range tests {
+		rule := tt.rule
+		err := normalizeIPRule(&rule)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("normalizeIPRule(%+v) error = %v, wantErr %v", tt.rule, err, tt.wantErr)
+			continue
+		}
+		if err == nil && (rule.Group != tt.wantGroup || rule.CIDR != tt.wantCIDR) {
+			t.Errorf("normalizeIPRule(%+v) = %q %q, want %q %q", tt.rule, rule.Group, rule.CIDR, tt.wantGroup, tt.wantCIDR)
+		}
+	}
+}
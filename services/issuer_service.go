@@ -0,0 +1,193 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"slices"
+	"strconv"
+	"time"
+
+	"go-keycloack/config"
+	"go-keycloack/encryption"
+	"go-keycloack/models"
+	"go-keycloack/oid4vc"
+
+	"github.com/gocql/gocql"
+)
+
+const issuerKeyField = "issuer.key"
+
+var (
+	// ErrIssuerNotFound is returned for unknown issuer IDs.
+	ErrIssuerNotFound = errors.New("issuer not found")
+	// ErrIssuerDisabled is returned when a disabled issuer is asked to issue a credential.
+	ErrIssuerDisabled = errors.New("issuer is disabled")
+	// ErrCredentialTypeNotSupported is returned when an issuer is asked for a credential type it
+	// was not registered for.
+	ErrCredentialTypeNotSupported = errors.New("credential type not supported by issuer")
+	// ErrIssuerKeysUnprotected is returned when an issuer is registered without PII encryption
+	// and ISSUER_ALLOW_PLAINTEXT_KEYS is not set.
+	ErrIssuerKeysUnprotected = errors.New("issuer keys cannot be stored without PII encryption")
+)
+
+const issuerColumns = "id, name, did, key_ref, credential_types, owner, status, created_at, updated_at"
+
+func issuerFields(i *models.Issuer) []interface{} {
+	return []interface{}{&i.ID, &i.Name, &i.DID, &i.KeyRef, &i.CredentialTypes, &i.Owner, &i.Status,
+		&i.CreatedAt, &i.UpdatedAt}
+}
+
+// RegisterIssuer has the issuer service generate a key and a DID, and records the new issuer.
+// The key material is sealed with the PII master key. Without one, registration is refused unless
+// ISSUER_ALLOW_PLAINTEXT_KEYS opts in to storing signing keys in plaintext.
+func RegisterIssuer(ctx context.Context, name, owner string, credentialTypes []string, req oid4vc.OnboardIssuerRequest) (*models.Issuer, error) {
+	if encryption.Default == nil && !plaintextIssuerKeysAllowed() {
+		return nil, ErrIssuerKeysUnprotected
+	}
+	onboarding, err := OnboardIssuer(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	key := string(onboarding.IssuerKey)
+	if encryption.Default != nil {
+		if key, err = encryption.Default.Seal(issuerKeyField, key); err != nil {
+			return nil, err
+		}
+	} else {
+		log.Printf("PII_KEYFILE is not set; key material of issuer %q is stored unencrypted", name)
+	}
+
+	now := time.Now().UTC()
+	issuer := &models.Issuer{
+		ID:              gocql.TimeUUID(),
+		Name:            name,
+		DID:             onboarding.IssuerDID,
+		KeyRef:          issuerKeyRef(onboarding.IssuerKey),
+		CredentialTypes: credentialTypes,
+		Owner:           owner,
+		Status:          models.IssuerStatusActive,
+		CreatedAt:       now,
+		UpdatedAt:       now,
+	}
+	if err := config.Session.Query(
+		"INSERT INTO issuers ("+issuerColumns+", key_material) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		append(issuerFields(issuer), key)...,
+	).Exec(); err != nil {
+		return nil, err
+	}
+	return issuer, nil
+}
+
+func plaintextIssuerKeysAllowed() bool {
+	allowed, _ := strconv.ParseBool(config.GetString("ISSUER_ALLOW_PLAINTEXT_KEYS", "false"))
+	return allowed
+}
+
+// issuerKeyRef names an issuer key without revealing it: the key type and its kid for local
+// JWKs, or its ID for keys held by a KMS.
+func issuerKeyRef(raw json.RawMessage) string {
+	var key struct {
+		Type string `json:"type"`
+		ID   string `json:"id"`
+		JWK  struct {
+			Kid string `json:"kid"`
+		} `json:"jwk"`
+	}
+	if json.Unmarshal(raw, &key) != nil || key.Type == "" {
+		return ""
+	}
+	if key.ID != "" {
+		return key.Type + ":" + key.ID
+	}
+	if key.JWK.Kid != "" {
+		return key.Type + ":" + key.JWK.Kid
+	}
+	return key.Type
+}
+
+// ListIssuers returns the issuers owned by owner, or every issuer if owner is empty.
+func ListIssuers(owner string) ([]models.Issuer, error) {
+	query := config.Session.Query("SELECT " + issuerColumns + " FROM issuers")
+	if owner != "" {
+		query = config.Session.Query("SELECT "+issuerColumns+" FROM issuers WHERE owner = ?", owner)
+	}
+	iter := query.Iter()
+	issuers := []models.Issuer{}
+	var issuer models.Issuer
+	for iter.Scan(issuerFields(&issuer)...) {
+		issuers = append(issuers, issuer)
+		issuer = models.Issuer{}
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	return issuers, nil
+}
+
+// GetIssuer returns the issuer with the given ID, including its key material.
+func GetIssuer(id gocql.UUID) (*models.Issuer, error) {
+	var (
+		issuer models.Issuer
+		key    string
+	)
+	err := config.Session.Query(
+		"SELECT "+issuerColumns+", key_material FROM issuers WHERE id = ?", id,
+	).Scan(append(issuerFields(&issuer), &key)...)
+	if errors.Is(err, gocql.ErrNotFound) {
+		return nil, ErrIssuerNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := encryption.Default.Decrypt(issuerKeyField, key)
+	if err != nil {
+		return nil, err
+	}
+	issuer.Key = json.RawMessage(plaintext)
+	return &issuer, nil
+}
+
+// DisableIssuer stops an issuer from issuing further credentials.
+func DisableIssuer(id gocql.UUID) error {
+	applied, err := config.Session.Query(
+		"UPDATE issuers SET status = ?, updated_at = ? WHERE id = ? IF EXISTS",
+		models.IssuerStatusDisabled, time.Now().UTC(), id,
+	).MapScanCAS(map[string]interface{}{})
+	if err != nil {
+		return err
+	}
+	if !applied {
+		return ErrIssuerNotFound
+	}
+	return nil
+}
+
+// DeleteIssuer removes an issuer along with its key material.
+func DeleteIssuer(id gocql.UUID) error {
+	applied, err := config.Session.Query(
+		"DELETE FROM issuers WHERE id = ? IF EXISTS", id,
+	).MapScanCAS(map[string]interface{}{})
+	if err != nil {
+		return err
+	}
+	if !applied {
+		return ErrIssuerNotFound
+	}
+	return nil
+}
+
+// IssueCredentialAs creates a credential offer signed by a registered issuer, which must be
+// active and registered for the requested credential type. Any key or DID in req is replaced.
+func IssueCredentialAs(ctx context.Context, issuer *models.Issuer, req oid4vc.IssuanceRequest) (*oid4vc.CredentialOffer, error) {
+	if issuer.Status != models.IssuerStatusActive {
+		return nil, ErrIssuerDisabled
+	}
+	if len(issuer.CredentialTypes) > 0 && !slices.Contains(issuer.CredentialTypes, req.CredentialConfigurationID) {
+		return nil, ErrCredentialTypeNotSupported
+	}
+	req.IssuerKey = issuer.Key
+	req.IssuerDID = issuer.DID
+	return IssueCredential(ctx, req)
+}
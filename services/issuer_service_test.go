@@ -0,0 +1,28 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"go-keycloack/encryption"
+	"go-keycloack/oid4vc"
+)
+
+func TestRegisterIssuerRefusesPlaintextKeys(t *testing.T) {
+	saved := encryption.Default
+	encryption.Default = nil
+	t.Cleanup(func() { encryption.Default = saved })
+
+	for _, setting := range []string{"", "false", "no"} {
+		t.Setenv("ISSUER_ALLOW_PLAINTEXT_KEYS", setting)
+		_, err := RegisterIssuer(context.Background(), "University", "owner", nil, oid4vc.OnboardIssuerRequest{})
+		if !errors.Is(err, ErrIssuerKeysUnprotected) {
+			t.Errorf("ISSUER_ALLOW_PLAINTEXT_KEYS=%q: RegisterIssuer() error = %v, want ErrIssuerKeysUnprotected", setting, err)
+		}
+	}
+	t.Setenv("ISSUER_ALLOW_PLAINTEXT_KEYS", "true")
+	if !plaintextIssuerKeysAllowed() {
+		t.Error("plaintextIssuerKeysAllowed() = false with ISSUER_ALLOW_PLAINTEXT_KEYS=true")
+	}
+}
@@ -0,0 +1,217 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// ErrKeycloakNotFound is returned when Keycloak answers an admin request with 404.
+var ErrKeycloakNotFound = errors.New("keycloak resource not found")
+
+var keycloakClient = &http.Client{Timeout: 10 * time.Second}
+
+func keycloakBaseURL() string {
+	return strings.TrimSuffix(os.Getenv("KEYCLOAK_BASE_URL"), "/")
+}
+
+// GetKeycloakAdminToken obtains an access token for the configured admin user.
+func GetKeycloakAdminToken() (string, error) {
+	keycloakBaseURL := keycloakBaseURL()
+	realm := os.Getenv("REALM")
+	clientID := os.Getenv("CLIENT_ID")
+	clientSecret := os.Getenv("CLIENT_SECRET")
+	adminUser := os.Getenv("ADMIN_USERNAME")
+	adminPass := os.Getenv("ADMIN_PASSWORD")
+	if keycloakBaseURL == "" || realm == "" || clientID == "" || clientSecret == "" || adminUser == "" || adminPass == "" {
+		return "", fiber.NewError(fiber.StatusInternalServerError, "Missing Keycloak admin credentials")
+	}
+	tokenURL := keycloakBaseURL + "/realms/" + realm + "/protocol/openid-connect/token"
+	data := url.Values{}
+	data.Set("client_id", clientID)
+	data.Set("client_secret", clientSecret)
+	data.Set("grant_type", "password")
+	data.Set("username", adminUser)
+	data.Set("password", adminPass)
+	resp, err := http.Post(tokenURL, "application/x-www-form-urlencoded", bytes.NewBufferString(data.Encode()))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return "", fiber.NewError(fiber.StatusUnauthorized, string(body))
+	}
+	var tokenResp map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
+		return "", err
+	}
+	token, ok := tokenResp["access_token"].(string)
+	if !ok {
+		return "", fiber.NewError(fiber.StatusInternalServerError, "No access_token in response")
+	}
+	return token, nil
+}
+
+// keycloakAdminRequest calls the realm admin API. path is relative to
+// /admin/realms/{realm}. body is sent as JSON when non-nil and the response is
+// decoded into out when non-nil.
+func keycloakAdminRequest(method, path string, body, out interface{}) error {
+	adminToken, err := GetKeycloakAdminToken()
+	if err != nil {
+		return fmt.Errorf("failed to get admin token: %w", err)
+	}
+
+	var reqBody io.Reader
+	if body != nil {
+		payload, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("failed to marshal payload: %w", err)
+		}
+		reqBody = bytes.NewBuffer(payload)
+	}
+
+	req, err := http.NewRequest(method, keycloakBaseURL()+"/admin/realms/"+os.Getenv("REALM")+path, reqBody)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+
+	resp, err := keycloakClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrKeycloakNotFound
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		respBody, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("keycloak request failed: status %d, body: %s", resp.StatusCode, string(respBody))
+	}
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return fmt.Errorf("failed to parse keycloak response: %w", err)
+		}
+	}
+	return nil
+}
+
+// FindKeycloakUserID looks up the Keycloak ID of the user with the given username.
+func FindKeycloakUserID(username string) (string, error) {
+	var users []struct {
+		ID       string `json:"id"`
+		Username string `json:"username"`
+	}
+	if err := keycloakAdminRequest(http.MethodGet, "/users?exact=true&username="+url.QueryEscape(username), nil, &users); err != nil {
+		return "", err
+	}
+	for _, u := range users {
+		if strings.EqualFold(u.Username, username) {
+			return u.ID, nil
+		}
+	}
+	return "", ErrKeycloakNotFound
+}
+
+// SetKeycloakUserEnabled enables or disables a Keycloak user, which controls whether they can log in.
+func SetKeycloakUserEnabled(keycloakID string, enabled bool) error {
+	return keycloakAdminRequest(http.MethodPut, "/users/"+keycloakID, map[string]interface{}{"enabled": enabled}, nil)
+}
+
+// DeleteKeycloakUser removes a user from Keycloak. A user that is already gone is not an error.
+func DeleteKeycloakUser(keycloakID string) error {
+	err := keycloakAdminRequest(http.MethodDelete, "/users/"+keycloakID, nil, nil)
+	if errors.Is(err, ErrKeycloakNotFound) {
+		return nil
+	}
+	return err
+}
+
+// KeycloakUserData is everything Keycloak holds about a user, as returned by the admin API.
+type KeycloakUserData struct {
+	User                map[string]interface{}   `json:"user"`
+	Groups              []map[string]interface{} `json:"groups"`
+	RoleMappings        map[string]interface{}   `json:"role_mappings"`
+	FederatedIdentities []map[string]interface{} `json:"federated_identities"`
+	Sessions            []map[string]interface{} `json:"sessions"`
+}
+
+// GetKeycloakUserData fetches the user's representation, groups, role mappings, federated
+// identities and active sessions from Keycloak.
+func GetKeycloakUserData(keycloakID string) (*KeycloakUserData, error) {
+	data := &KeycloakUserData{}
+	base := "/users/" + keycloakID
+	requests := []struct {
+		path string
+		out  interface{}
+	}{
+		{base, &data.User},
+		{base + "/groups", &data.Groups},
+		{base + "/role-mappings", &data.RoleMappings},
+		{base + "/federated-identity", &data.FederatedIdentities},
+		{base + "/sessions", &data.Sessions},
+	}
+	for _, r := range requests {
+		if err := keycloakAdminRequest(http.MethodGet, r.path, nil, r.out); err != nil {
+			return nil, err
+		}
+	}
+	return data, nil
+}
+
+// keycloakRole is the part of a Keycloak role representation needed to map it to a user.
+type keycloakRole struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// GetKeycloakRealmRoles returns the names of the realm roles mapped directly to the user.
+func GetKeycloakRealmRoles(keycloakID string) ([]string, error) {
+	var roles []keycloakRole
+	if err := keycloakAdminRequest(http.MethodGet, "/users/"+keycloakID+"/role-mappings/realm", nil, &roles); err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(roles))
+	for _, r := range roles {
+		names = append(names, r.Name)
+	}
+	return names, nil
+}
+
+// AddKeycloakRealmRoles maps the named realm roles to the user. Unknown roles fail with
+// ErrKeycloakNotFound before anything is changed.
+func AddKeycloakRealmRoles(keycloakID string, names []string) error {
+	return changeKeycloakRealmRoles(http.MethodPost, keycloakID, names)
+}
+
+// RemoveKeycloakRealmRoles unmaps the named realm roles from the user.
+func RemoveKeycloakRealmRoles(keycloakID string, names []string) error {
+	return changeKeycloakRealmRoles(http.MethodDelete, keycloakID, names)
+}
+
+func changeKeycloakRealmRoles(method, keycloakID string, names []string) error {
+	if len(names) == 0 {
+		return nil
+	}
+	roles := make([]keycloakRole, len(names))
+	for i, name := range names {
+		if err := keycloakAdminRequest(http.MethodGet, "/roles/"+url.PathEscape(name), nil, &roles[i]); err != nil {
+			return err
+		}
+	}
+	return keycloakAdminRequest(method, "/users/"+keycloakID+"/role-mappings/realm", roles, nil)
+}
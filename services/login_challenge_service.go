@@ -0,0 +1,64 @@
+package services
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"go-keycloack/challenge"
+	"go-keycloack/config"
+	"go-keycloack/models"
+)
+
+// loginChallenge is nil unless LOGIN_CHALLENGE enables challenge escalation.
+var loginChallenge challenge.Verifier
+
+// InitLoginChallenge sets up the verifier named by LOGIN_CHALLENGE: "pow" for the built-in
+// proof of work or "captcha" for a hosted CAPTCHA provider. It must run after InitValkey.
+func InitLoginChallenge() {
+	switch mode := config.GetString("LOGIN_CHALLENGE", ""); mode {
+	case "":
+	case "pow":
+		loginChallenge = challenge.NewProofOfWork(config.Valkey,
+			config.GetInt("LOGIN_POW_DIFFICULTY", 20),
+			config.GetDuration("LOGIN_CHALLENGE_TTL", 5*time.Minute),
+		)
+	case "captcha":
+		verifyURL := config.GetString("LOGIN_CAPTCHA_VERIFY_URL", "")
+		secret := config.GetString("LOGIN_CAPTCHA_SECRET", "")
+		if verifyURL == "" || secret == "" {
+			log.Fatalf("LOGIN_CHALLENGE=captcha requires LOGIN_CAPTCHA_VERIFY_URL and LOGIN_CAPTCHA_SECRET")
+		}
+		loginChallenge = challenge.NewHostedCaptcha(
+			config.GetString("LOGIN_CAPTCHA_PROVIDER", "captcha"),
+			config.GetString("LOGIN_CAPTCHA_SITE_KEY", ""),
+			secret, verifyURL,
+		)
+	default:
+		log.Fatalf("Unknown LOGIN_CHALLENGE %q", mode)
+	}
+}
+
+// LoginChallengeEnabled reports whether logins escalate to a challenge after failures.
+func LoginChallengeEnabled() bool {
+	return loginChallenge != nil
+}
+
+// loginChallengeThreshold is the number of recent failures after which logins must solve a
+// challenge. Failures are the counters kept by RecordLoginFailure.
+func loginChallengeThreshold(scope string) int {
+	if scope == models.LoginScopeIP {
+		return config.GetInt("LOGIN_CHALLENGE_IP_THRESHOLD", 20)
+	}
+	return config.GetInt("LOGIN_CHALLENGE_THRESHOLD", 3)
+}
+
+// IssueLoginChallenge returns a new challenge for a client to solve.
+func IssueLoginChallenge(ctx context.Context) (*challenge.Challenge, error) {
+	return loginChallenge.Issue(ctx)
+}
+
+// VerifyLoginChallenge checks a client's answer to a challenge.
+func VerifyLoginChallenge(ctx context.Context, response, ip string) error {
+	return loginChallenge.Verify(ctx, response, ip)
+}
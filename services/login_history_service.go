@@ -0,0 +1,100 @@
+package services
+
+import (
+	"errors"
+	"time"
+
+	"go-keycloack/config"
+	"go-keycloack/models"
+
+	"github.com/gocql/gocql"
+)
+
+// loginCountRetries bounds how often RecordSuccessfulLogin retries when concurrent logins of the
+// same user race on login_count.
+const loginCountRetries = 10
+
+// loginHistoryTTL is how long login attempts are kept before Cassandra expires them.
+func loginHistoryTTL() time.Duration {
+	return config.GetDuration("LOGIN_HISTORY_TTL", 90*24*time.Hour)
+}
+
+// RecordLoginAttempt stores a login attempt in the user's history. History is keyed by user ID
+// so that it follows renames; attempts on usernames we hold no user for are not kept here (the
+// failed-login counters still see them).
+func RecordLoginAttempt(attempt *models.LoginAttempt) error {
+	if attempt.UserID == (gocql.UUID{}) {
+		return nil
+	}
+	if attempt.AttemptedAt.IsZero() {
+		attempt.AttemptedAt = time.Now().UTC()
+	}
+	return config.Session.Query(
+		`INSERT INTO user_login_history (user_id, attempted_at, username, success, ip, user_agent, session_id)
+		VALUES (?, ?, ?, ?, ?, ?, ?) USING TTL ?`,
+		attempt.UserID, gocql.UUIDFromTime(attempt.AttemptedAt), attempt.Username, attempt.Success,
+		attempt.IP, attempt.UserAgent, attempt.SessionID, int(loginHistoryTTL().Seconds()),
+	).Exec()
+}
+
+// ListLoginHistory returns a page of the user's login attempts, newest first.
+func ListLoginHistory(userID gocql.UUID, limit int, pageState []byte) ([]models.LoginAttempt, []byte, error) {
+	iter := config.Session.Query(
+		`SELECT attempted_at, username, success, ip, user_agent, session_id FROM user_login_history WHERE user_id = ?`,
+		userID,
+	).PageSize(limit).PageState(pageState).Iter()
+
+	attempts := make([]models.LoginAttempt, 0, limit)
+	var (
+		a           models.LoginAttempt
+		attemptedAt gocql.UUID
+	)
+	for iter.Scan(&attemptedAt, &a.Username, &a.Success, &a.IP, &a.UserAgent, &a.SessionID) {
+		a.UserID = userID
+		a.AttemptedAt = attemptedAt.Time().UTC()
+		attempts = append(attempts, a)
+		a = models.LoginAttempt{}
+	}
+	nextPage := iter.PageState()
+	if err := iter.Close(); err != nil {
+		return nil, nil, err
+	}
+	return attempts, nextPage, nil
+}
+
+// DeleteLoginHistory removes every login attempt recorded for the user.
+func DeleteLoginHistory(userID gocql.UUID) error {
+	return config.Session.Query("DELETE FROM user_login_history WHERE user_id = ?", userID).Exec()
+}
+
+// RecordSuccessfulLogin updates the user's last_login_at and login_count. The count is read from
+// Cassandra and written conditionally, retrying on conflict, so concurrent logins are all counted.
+func RecordSuccessfulLogin(user *models.User, at time.Time) error {
+	var current int
+	if err := config.Session.Query("SELECT login_count FROM users WHERE id = ?", user.ID).Scan(&current); err != nil {
+		return err
+	}
+	for range loginCountRetries {
+		// login_count is never written as 0, so 0 is a null column
+		var expected interface{}
+		if current != 0 {
+			expected = current
+		}
+		previous := map[string]interface{}{}
+		applied, err := config.Session.Query(
+			"UPDATE users SET last_login_at = ?, login_count = ? WHERE id = ? IF login_count = ?",
+			at, current+1, user.ID, expected,
+		).MapScanCAS(previous)
+		if err != nil {
+			return err
+		}
+		if applied {
+			invalidateUserCache(user.ID)
+			user.LastLoginAt = &at
+			user.LoginCount = current + 1
+			return nil
+		}
+		current, _ = previous["login_count"].(int)
+	}
+	return errors.New("login_count kept changing concurrently")
+}
@@ -0,0 +1,389 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go-keycloack/config"
+	"go-keycloack/models"
+	"go-keycloack/ratelimit"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// recordLoginFailureScript counts a failed login and blocks further attempts, atomically.
+// Below the failure limit the block is an exponential backoff; at the limit the counter is reset
+// and a lockout starts whose length doubles with each lockout in LOGIN_LOCKOUT_RESET.
+//
+// KEYS[1] failure counter, KEYS[2] block marker, KEYS[3] lockout counter
+// ARGV: window_ms, max_failures, backoff_base_ms, backoff_max_ms, lockout_ms, lockout_max_ms, lockout_reset_ms
+// Returns {failures, block_ms, locked}.
+var recordLoginFailureScript = redis.NewScript(`
+local window = tonumber(ARGV[1])
+local max_failures = tonumber(ARGV[2])
+local backoff_base = tonumber(ARGV[3])
+local backoff_max = tonumber(ARGV[4])
+local lockout = tonumber(ARGV[5])
+local lockout_max = tonumber(ARGV[6])
+local lockout_reset = tonumber(ARGV[7])
+
+local failures = redis.call('INCR', KEYS[1])
+redis.call('PEXPIRE', KEYS[1], window)
+
+local block = 0
+local locked = 0
+if max_failures > 0 and failures >= max_failures then
+  local lockouts = redis.call('INCR', KEYS[3])
+  redis.call('PEXPIRE', KEYS[3], lockout_reset)
+  block = math.min(lockout * 2 ^ (lockouts - 1), lockout_max)
+  locked = 1
+  redis.call('DEL', KEYS[1])
+elseif backoff_base > 0 then
+  block = math.min(backoff_base * 2 ^ (failures - 1), backoff_max)
+end
+
+if block > 0 and redis.call('PTTL', KEYS[2]) < block then
+  redis.call('SET', KEYS[2], locked == 1 and 'locked' or 'backoff', 'PX', math.floor(block))
+end
+return {failures, math.floor(block), locked}
+`)
+
+// loginProtection holds the brute-force limits for one scope.
+type loginProtection struct {
+	MaxFailures  int
+	Window       time.Duration
+	BackoffBase  time.Duration
+	BackoffMax   time.Duration
+	Lockout      time.Duration
+	LockoutMax   time.Duration
+	LockoutReset time.Duration
+}
+
+func loginProtectionSettings(scope string) loginProtection {
+	p := loginProtection{
+		MaxFailures:  config.GetInt("LOGIN_MAX_FAILURES", 5),
+		Window:       config.GetDuration("LOGIN_FAILURE_WINDOW", 15*time.Minute),
+		BackoffBase:  config.GetDuration("LOGIN_BACKOFF_BASE", time.Second),
+		BackoffMax:   config.GetDuration("LOGIN_BACKOFF_MAX", 30*time.Second),
+		Lockout:      config.GetDuration("LOGIN_LOCKOUT_DURATION", 15*time.Minute),
+		LockoutMax:   config.GetDuration("LOGIN_LOCKOUT_MAX", 24*time.Hour),
+		LockoutReset: config.GetDuration("LOGIN_LOCKOUT_RESET", 24*time.Hour),
+	}
+	if scope == models.LoginScopeIP {
+		// Many users can share an address, so it is not slowed down after every failure and
+		// is only locked out after far more of them
+		p.MaxFailures = config.GetInt("LOGIN_MAX_IP_FAILURES", 50)
+		p.BackoffBase = 0
+	} else if LoginChallengeEnabled() {
+		// Accounts are challenged instead of locked, so that an attacker cannot lock them out
+		p.MaxFailures = 0
+	}
+	return p
+}
+
+// loginKeys returns the failure counter, block marker and lockout counter for a username or IP.
+func loginKeys(scope, value string) (failures, block, lockouts string) {
+	if scope == models.LoginScopeUsername {
+		value = strings.ToLower(value)
+	}
+	return "login_fail:" + scope + ":" + value,
+		"login_block:" + scope + ":" + value,
+		"login_lockouts:" + scope + ":" + value
+}
+
+// LoginCheck is what must happen before a login attempt may go ahead.
+type LoginCheck struct {
+	// Wait is how long the caller must wait before trying again, or zero.
+	Wait time.Duration
+	// ChallengeRequired is set once the username or IP has failed often enough that the attempt
+	// must carry a solved challenge.
+	ChallengeRequired bool
+}
+
+// ErrLoginCheckUnavailable is returned by CheckLogin when Valkey cannot be reached and logins must
+// not go ahead unchecked.
+var ErrLoginCheckUnavailable = errors.New("login protection unavailable")
+
+// CheckLogin reports whether a login with username from ip is blocked or must solve a challenge
+// first. Existing and unknown usernames are treated alike. While Valkey is unreachable the
+// attempt is checked against the in-process counters if RATE_LIMIT_FAILURE_MODE is "local", let
+// through if it is "open", and refused with ErrLoginCheckUnavailable if it is "closed".
+func CheckLogin(ctx context.Context, username, ip string) (LoginCheck, error) {
+	check, err := checkLogin(ctx, username, ip)
+	if err == nil {
+		return check, nil
+	}
+	switch loginFailureMode() {
+	case ratelimit.FailureModeLocal:
+		return localLogins.check(username, ip), nil
+	case ratelimit.FailureModeOpen:
+		log.Printf("Login protection unavailable, letting %s through: %v", username, err)
+		return LoginCheck{}, nil
+	}
+	return LoginCheck{}, fmt.Errorf("%w: %v", ErrLoginCheckUnavailable, err)
+}
+
+func loginFailureMode() string {
+	return config.GetString("RATE_LIMIT_FAILURE_MODE", ratelimit.FailureModeLocal)
+}
+
+func checkLogin(ctx context.Context, username, ip string) (LoginCheck, error) {
+	userFail, userBlock, _ := loginKeys(models.LoginScopeUsername, username)
+	ipFail, ipBlock, _ := loginKeys(models.LoginScopeIP, ip)
+	pipe := config.Valkey.Pipeline()
+	userTTL := pipe.PTTL(ctx, userBlock)
+	ipTTL := pipe.PTTL(ctx, ipBlock)
+	failures := pipe.MGet(ctx, userFail, ipFail)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return LoginCheck{}, err
+	}
+	// PTTL reports -2 for missing keys
+	check := LoginCheck{Wait: max(userTTL.Val(), ipTTL.Val(), 0)}
+	if LoginChallengeEnabled() {
+		values := failures.Val()
+		check.ChallengeRequired = counterAtLeast(values[0], loginChallengeThreshold(models.LoginScopeUsername)) ||
+			counterAtLeast(values[1], loginChallengeThreshold(models.LoginScopeIP))
+	}
+	return check, nil
+}
+
+func counterAtLeast(value interface{}, threshold int) bool {
+	s, _ := value.(string)
+	n, err := strconv.Atoi(s)
+	return err == nil && n >= threshold
+}
+
+// RecordLoginFailure counts a failed login against the username and the IP and returns how
+// long the next attempt is blocked for. Lockouts are reported to the registered hooks. In the
+// local failure mode, failures that cannot be counted in Valkey are counted in process.
+func RecordLoginFailure(ctx context.Context, username, ip string) (time.Duration, error) {
+	var wait time.Duration
+	for _, target := range []struct{ scope, value string }{
+		{models.LoginScopeUsername, username},
+		{models.LoginScopeIP, ip},
+	} {
+		failures, block, locked, err := recordLoginFailure(ctx, target.scope, target.value)
+		if err != nil {
+			if loginFailureMode() != ratelimit.FailureModeLocal {
+				return wait, err
+			}
+			failures, block, locked = localLogins.record(target.scope, target.value)
+		}
+		wait = max(wait, block)
+		if locked {
+			now := time.Now().UTC()
+			notifyLoginLockout(models.LoginLockout{
+				Scope:       target.scope,
+				Username:    username,
+				IP:          ip,
+				Failures:    failures,
+				LockedAt:    now,
+				LockedUntil: now.Add(block),
+			})
+		}
+	}
+	return wait, nil
+}
+
+func recordLoginFailure(ctx context.Context, scope, value string) (int, time.Duration, bool, error) {
+	p := loginProtectionSettings(scope)
+	failKey, blockKey, lockoutKey := loginKeys(scope, value)
+	raw, err := recordLoginFailureScript.Run(ctx, config.Valkey,
+		[]string{failKey, blockKey, lockoutKey},
+		p.Window.Milliseconds(), p.MaxFailures, p.BackoffBase.Milliseconds(), p.BackoffMax.Milliseconds(),
+		p.Lockout.Milliseconds(), p.LockoutMax.Milliseconds(), p.LockoutReset.Milliseconds(),
+	).Int64Slice()
+	if err != nil {
+		return 0, 0, false, err
+	}
+	if len(raw) != 3 {
+		return 0, 0, false, fmt.Errorf("unexpected login failure script result %v", raw)
+	}
+	return int(raw[0]), time.Duration(raw[1]) * time.Millisecond, raw[2] == 1, nil
+}
+
+// ResetLoginFailures clears the failure counters and any lockout of a username. It runs after a
+// successful login and when an admin unlocks an account. IP counters are left to expire so that
+// one valid account cannot be used to wipe the failures of a password-spraying address.
+func ResetLoginFailures(ctx context.Context, username string) error {
+	failKey, blockKey, lockoutKey := loginKeys(models.LoginScopeUsername, username)
+	localLogins.reset(failKey, blockKey, lockoutKey)
+	return config.Valkey.Del(ctx, failKey, blockKey, lockoutKey).Err()
+}
+
+// ResetLoginFailuresForIP clears the failure counters and any lockout of an address.
+func ResetLoginFailuresForIP(ctx context.Context, ip string) error {
+	failKey, blockKey, lockoutKey := loginKeys(models.LoginScopeIP, ip)
+	localLogins.reset(failKey, blockKey, lockoutKey)
+	return config.Valkey.Del(ctx, failKey, blockKey, lockoutKey).Err()
+}
+
+// localLoginCounters is the in-process counterpart of the failure counters, block markers and
+// lockout counters kept in Valkey, used in the local failure mode while Valkey is unreachable.
+// Like ratelimit.LocalLimiter it counts per instance, and what it counted is not carried over
+// to Valkey once it is back.
+type localLoginCounters struct {
+	mu      sync.Mutex
+	entries map[string]localLoginEntry
+	pruned  time.Time
+}
+
+type localLoginEntry struct {
+	count   int
+	expires time.Time
+}
+
+var localLogins = newLocalLoginCounters()
+
+func newLocalLoginCounters() *localLoginCounters {
+	return &localLoginCounters{entries: map[string]localLoginEntry{}}
+}
+
+// live returns the entry for key, or a zero entry if it is missing or has expired.
+func (l *localLoginCounters) live(key string, now time.Time) localLoginEntry {
+	e, ok := l.entries[key]
+	if !ok || !now.Before(e.expires) {
+		return localLoginEntry{}
+	}
+	return e
+}
+
+func (l *localLoginCounters) ttl(key string, now time.Time) time.Duration {
+	e := l.live(key, now)
+	if e.expires.IsZero() {
+		return 0
+	}
+	return e.expires.Sub(now)
+}
+
+// check is the local counterpart of checkLogin.
+func (l *localLoginCounters) check(username, ip string) LoginCheck {
+	userFail, userBlock, _ := loginKeys(models.LoginScopeUsername, username)
+	ipFail, ipBlock, _ := loginKeys(models.LoginScopeIP, ip)
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	check := LoginCheck{Wait: max(l.ttl(userBlock, now), l.ttl(ipBlock, now))}
+	if LoginChallengeEnabled() {
+		check.ChallengeRequired = l.live(userFail, now).count >= loginChallengeThreshold(models.LoginScopeUsername) ||
+			l.live(ipFail, now).count >= loginChallengeThreshold(models.LoginScopeIP)
+	}
+	return check
+}
+
+// record is the local counterpart of recordLoginFailureScript.
+func (l *localLoginCounters) record(scope, value string) (int, time.Duration, bool) {
+	p := loginProtectionSettings(scope)
+	failKey, blockKey, lockoutKey := loginKeys(scope, value)
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.prune(now)
+
+	fail := l.live(failKey, now)
+	fail.count++
+	fail.expires = now.Add(p.Window)
+	l.entries[failKey] = fail
+
+	var block time.Duration
+	locked := false
+	if p.MaxFailures > 0 && fail.count >= p.MaxFailures {
+		lockouts := l.live(lockoutKey, now)
+		lockouts.count++
+		lockouts.expires = now.Add(p.LockoutReset)
+		l.entries[lockoutKey] = lockouts
+		block = doubling(p.Lockout, lockouts.count, p.LockoutMax)
+		locked = true
+		delete(l.entries, failKey)
+	} else if p.BackoffBase > 0 {
+		block = doubling(p.BackoffBase, fail.count, p.BackoffMax)
+	}
+
+	if block > 0 && l.ttl(blockKey, now) < block {
+		l.entries[blockKey] = localLoginEntry{expires: now.Add(block)}
+	}
+	return fail.count, block, locked
+}
+
+// doubling returns base doubled n-1 times, capped at limit.
+func doubling(base time.Duration, n int, limit time.Duration) time.Duration {
+	return time.Duration(math.Min(float64(base)*math.Pow(2, float64(n-1)), float64(limit)))
+}
+
+func (l *localLoginCounters) reset(keys ...string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, key := range keys {
+		delete(l.entries, key)
+	}
+}
+
+// prune drops expired entries, at most once a minute.
+func (l *localLoginCounters) prune(now time.Time) {
+	if now.Sub(l.pruned) < time.Minute {
+		return
+	}
+	l.pruned = now
+	for key, e := range l.entries {
+		if !now.Before(e.expires) {
+			delete(l.entries, key)
+		}
+	}
+}
+
+var (
+	lockoutHooksMu sync.RWMutex
+	lockoutHooks   []func(models.LoginLockout)
+)
+
+// OnLoginLockout registers a hook that is called, in its own goroutine, whenever a username or
+// IP is locked out.
+func OnLoginLockout(hook func(models.LoginLockout)) {
+	lockoutHooksMu.Lock()
+	defer lockoutHooksMu.Unlock()
+	lockoutHooks = append(lockoutHooks, hook)
+}
+
+func notifyLoginLockout(event models.LoginLockout) {
+	log.Printf("Login lockout (%s) for username %q from %s after %d failures, until %s",
+		event.Scope, event.Username, event.IP, event.Failures, event.LockedUntil.Format(time.RFC3339))
+	lockoutHooksMu.RLock()
+	defer lockoutHooksMu.RUnlock()
+	for _, hook := range lockoutHooks {
+		go hook(event)
+	}
+}
+
+// StartLockoutWebhook posts every lockout as JSON to LOGIN_LOCKOUT_WEBHOOK_URL, if set.
+func StartLockoutWebhook() {
+	url := config.GetString("LOGIN_LOCKOUT_WEBHOOK_URL", "")
+	if url == "" {
+		return
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	OnLoginLockout(func(event models.LoginLockout) {
+		body, err := json.Marshal(event)
+		if err != nil {
+			return
+		}
+		resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+		if err != nil {
+			log.Printf("Lockout webhook failed: %v", err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			log.Printf("Lockout webhook returned %s", resp.Status)
+		}
+	})
+}
@@ -0,0 +1,97 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"go-keycloack/config"
+	"go-keycloack/models"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// withValkey points config.Valkey at an in-memory Valkey for the duration of the test.
+func withValkey(t *testing.T) *miniredis.Miniredis {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	saved := config.Valkey
+	config.Valkey = redis.NewClient(&redis.Options{Addr: mr.Addr(), MaxRetries: -1})
+	t.Cleanup(func() {
+		config.Valkey.Close()
+		config.Valkey = saved
+	})
+	return mr
+}
+
+func TestCheckLogin(t *testing.T) {
+	tests := []struct {
+		name     string
+		mode     string
+		blocked  bool
+		down     bool
+		wantWait bool
+		wantErr  error
+	}{
+		{"no failures", "", false, false, false, nil},
+		{"blocked username", "", true, false, true, nil},
+		{"Valkey down, local mode", "local", false, true, false, nil},
+		{"Valkey down, closed mode", "closed", false, true, false, ErrLoginCheckUnavailable},
+		{"Valkey down, open mode", "open", false, true, false, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("RATE_LIMIT_FAILURE_MODE", tt.mode)
+			t.Setenv("LOGIN_CHALLENGE", "")
+			localLogins = newLocalLoginCounters()
+			mr := withValkey(t)
+			if tt.blocked {
+				_, block, _ := loginKeys(models.LoginScopeUsername, "Alice")
+				mr.Set(block, "backoff")
+				mr.SetTTL(block, time.Minute)
+			}
+			if tt.down {
+				mr.Close()
+			}
+			check, err := CheckLogin(context.Background(), "alice", "192.0.2.1")
+			if !errors.Is(err, tt.wantErr) || (tt.wantErr == nil && err != nil) {
+				t.Fatalf("CheckLogin() error = %v, want %v", err, tt.wantErr)
+			}
+			if (check.Wait > 0) != tt.wantWait {
+				t.Errorf("CheckLogin() wait = %v, want a wait: %v", check.Wait, tt.wantWait)
+			}
+		})
+	}
+}
+
+func TestLocalLoginFallback(t *testing.T) {
+	t.Setenv("RATE_LIMIT_FAILURE_MODE", "local")
+	t.Setenv("LOGIN_CHALLENGE", "")
+	t.Setenv("LOGIN_MAX_FAILURES", "3")
+	localLogins = newLocalLoginCounters()
+	withValkey(t).Close()
+	ctx := context.Background()
+
+	wait, err := RecordLoginFailure(ctx, "Alice", "192.0.2.1")
+	if err != nil || wait != time.Second {
+		t.Fatalf("RecordLoginFailure() = %v, %v, want 1s backoff", wait, err)
+	}
+	if check, err := CheckLogin(ctx, "alice", "198.51.100.1"); err != nil || check.Wait <= 0 {
+		t.Fatalf("CheckLogin() = %+v, %v, want the username blocked", check, err)
+	}
+	if check, err := CheckLogin(ctx, "bob", "198.51.100.1"); err != nil || check.Wait != 0 {
+		t.Fatalf("CheckLogin() for another user = %+v, %v, want no wait", check, err)
+	}
+
+	RecordLoginFailure(ctx, "alice", "192.0.2.1")
+	if wait, _ := RecordLoginFailure(ctx, "alice", "192.0.2.1"); wait != 15*time.Minute {
+		t.Fatalf("third failure wait = %v, want the 15m lockout", wait)
+	}
+
+	ResetLoginFailures(ctx, "alice")
+	if check, err := CheckLogin(ctx, "alice", "198.51.100.1"); err != nil || check.Wait != 0 {
+		t.Fatalf("CheckLogin() after reset = %+v, %v, want no wait", check, err)
+	}
+}
@@ -0,0 +1,325 @@
+package services
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"go-keycloack/config"
+	"go-keycloack/models"
+
+	"github.com/gocql/gocql"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// ErrPreferenceValidation is wrapped by errors caused by the submitted preferences themselves.
+var ErrPreferenceValidation = errors.New("invalid preferences")
+
+// MaxPreferenceClockSkew is how far into the future a client-supplied write timestamp may be.
+const MaxPreferenceClockSkew = time.Minute
+
+var namespacePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]{0,63}$`)
+
+// preferenceNamespaceConfig limits what may be stored in one namespace.
+type preferenceNamespaceConfig struct {
+	MaxKeys       int             `json:"max_keys"`
+	MaxValueBytes int             `json:"max_value_bytes"`
+	MaxTotalBytes int             `json:"max_total_bytes"`
+	Schema        json.RawMessage `json:"schema"`
+
+	compiled *jsonschema.Schema
+}
+
+// preferencesConfig is the format of PREFERENCES_CONFIG_FILE.
+type preferencesConfig struct {
+	AllowUnknownNamespaces bool                                  `json:"allow_unknown_namespaces"`
+	Defaults               preferenceNamespaceConfig             `json:"defaults"`
+	Namespaces             map[string]*preferenceNamespaceConfig `json:"namespaces"`
+}
+
+var preferences = preferencesConfig{
+	AllowUnknownNamespaces: true,
+	Defaults:               preferenceNamespaceConfig{MaxKeys: 100, MaxValueBytes: 4 << 10, MaxTotalBytes: 64 << 10},
+}
+
+// LoadPreferencesConfig reads namespace limits and JSON Schemas from PREFERENCES_CONFIG_FILE.
+// Without a file, any namespace is accepted with the default limits.
+func LoadPreferencesConfig() {
+	path := config.GetString("PREFERENCES_CONFIG_FILE", "")
+	if path == "" {
+		return
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatalf("Failed to read preferences config: %v", err)
+	}
+	cfg := preferences
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		log.Fatalf("Failed to parse preferences config: %v", err)
+	}
+	for name, ns := range cfg.Namespaces {
+		if !namespacePattern.MatchString(name) {
+			log.Fatalf("Invalid preferences namespace %q", name)
+		}
+		if ns.MaxKeys == 0 {
+			ns.MaxKeys = cfg.Defaults.MaxKeys
+		}
+		if ns.MaxValueBytes == 0 {
+			ns.MaxValueBytes = cfg.Defaults.MaxValueBytes
+		}
+		if ns.MaxTotalBytes == 0 {
+			ns.MaxTotalBytes = cfg.Defaults.MaxTotalBytes
+		}
+		if len(ns.Schema) > 0 {
+			compiler := jsonschema.NewCompiler()
+			url := "preferences/" + name + ".json"
+			if err := compiler.AddResource(url, bytes.NewReader(ns.Schema)); err != nil {
+				log.Fatalf("Invalid JSON Schema for preferences namespace %q: %v", name, err)
+			}
+			if ns.compiled, err = compiler.Compile(url); err != nil {
+				log.Fatalf("Invalid JSON Schema for preferences namespace %q: %v", name, err)
+			}
+		}
+	}
+	preferences = cfg
+	log.Printf("Loaded preferences config with %d namespaces", len(cfg.Namespaces))
+}
+
+func namespaceConfig(namespace string) (*preferenceNamespaceConfig, error) {
+	if !namespacePattern.MatchString(namespace) {
+		return nil, fmt.Errorf("%w: invalid namespace name", ErrPreferenceValidation)
+	}
+	if ns, ok := preferences.Namespaces[namespace]; ok {
+		return ns, nil
+	}
+	if !preferences.AllowUnknownNamespaces {
+		return nil, fmt.Errorf("%w: unknown namespace %q", ErrPreferenceValidation, namespace)
+	}
+	return &preferences.Defaults, nil
+}
+
+// validatePreferences checks the complete namespace document against its limits and schema.
+func validatePreferences(ns *preferenceNamespaceConfig, values map[string]json.RawMessage) error {
+	if len(values) > ns.MaxKeys {
+		return fmt.Errorf("%w: at most %d keys are allowed", ErrPreferenceValidation, ns.MaxKeys)
+	}
+	total := 0
+	for key, value := range values {
+		if key == "" || len(key) > 128 {
+			return fmt.Errorf("%w: keys must be 1 to 128 characters", ErrPreferenceValidation)
+		}
+		if len(value) > ns.MaxValueBytes {
+			return fmt.Errorf("%w: value of %q exceeds %d bytes", ErrPreferenceValidation, key, ns.MaxValueBytes)
+		}
+		total += len(value)
+	}
+	if total > ns.MaxTotalBytes {
+		return fmt.Errorf("%w: namespace exceeds %d bytes", ErrPreferenceValidation, ns.MaxTotalBytes)
+	}
+	if ns.compiled != nil {
+		var doc interface{}
+		raw, _ := json.Marshal(values)
+		if err := json.Unmarshal(raw, &doc); err != nil {
+			return err
+		}
+		if err := ns.compiled.Validate(doc); err != nil {
+			return fmt.Errorf("%w: %v", ErrPreferenceValidation, err)
+		}
+	}
+	return nil
+}
+
+// GetPreferences returns the user's preferences in a namespace.
+func GetPreferences(userID gocql.UUID, namespace string) (*models.PreferenceNamespace, error) {
+	if _, err := namespaceConfig(namespace); err != nil {
+		return nil, err
+	}
+	return loadPreferences(userID, namespace)
+}
+
+func newPreferenceNamespace(namespace string) *models.PreferenceNamespace {
+	return &models.PreferenceNamespace{
+		Namespace: namespace,
+		Values:    map[string]json.RawMessage{},
+		UpdatedAt: map[string]time.Time{},
+	}
+}
+
+func loadPreferences(userID gocql.UUID, namespace string) (*models.PreferenceNamespace, error) {
+	result := newPreferenceNamespace(namespace)
+	iter := config.Session.Query(
+		"SELECT key, value, WRITETIME(value) FROM user_preferences WHERE user_id = ? AND namespace = ?",
+		userID, namespace,
+	).Iter()
+	var (
+		key, value string
+		writeTime  int64
+	)
+	for iter.Scan(&key, &value, &writeTime) {
+		result.Values[key] = json.RawMessage(value)
+		result.UpdatedAt[key] = time.UnixMicro(writeTime).UTC()
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// ListPreferenceNamespaces returns the namespaces in which the user has stored preferences.
+func ListPreferenceNamespaces(userID gocql.UUID) ([]string, error) {
+	iter := config.Session.Query("SELECT namespace FROM user_preference_namespaces WHERE user_id = ?", userID).Iter()
+	namespaces := []string{}
+	var namespace string
+	for iter.Scan(&namespace) {
+		namespaces = append(namespaces, namespace)
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	return namespaces, nil
+}
+
+// SetPreferences writes preferences at the given timestamp. With replace, keys not in values are
+// removed; otherwise values are merged and a null value removes its key. Every cell is written
+// with the timestamp, so concurrent writers resolve last-write-wins by Cassandra cell time and a
+// write carrying an older timestamp never overwrites a newer one.
+func SetPreferences(userID gocql.UUID, namespace string, values map[string]json.RawMessage, replace bool, at time.Time) (*models.PreferenceNamespace, error) {
+	ns, err := namespaceConfig(namespace)
+	if err != nil {
+		return nil, err
+	}
+	current, err := GetPreferences(userID, namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	merged := map[string]json.RawMessage{}
+	if !replace {
+		for key, value := range current.Values {
+			merged[key] = value
+		}
+	}
+	for key, value := range values {
+		if isJSONNull(value) {
+			delete(merged, key)
+			continue
+		}
+		if !json.Valid(value) {
+			return nil, fmt.Errorf("%w: value of %q is not valid JSON", ErrPreferenceValidation, key)
+		}
+		merged[key] = value
+	}
+	if err := validatePreferences(ns, merged); err != nil {
+		return nil, err
+	}
+
+	ts := at.UnixMicro()
+	batch := config.Session.NewBatch(gocql.UnloggedBatch)
+	if replace {
+		// The delete is one microsecond older so that it does not shadow the inserts below.
+		batch.Query("DELETE FROM user_preferences USING TIMESTAMP ? WHERE user_id = ? AND namespace = ?", ts-1, userID, namespace)
+	}
+	for key := range current.Values {
+		if _, ok := merged[key]; !ok && !replace {
+			batch.Query("DELETE FROM user_preferences USING TIMESTAMP ? WHERE user_id = ? AND namespace = ? AND key = ?", ts, userID, namespace, key)
+		}
+	}
+	for key, value := range merged {
+		if !replace && bytes.Equal(current.Values[key], value) {
+			continue
+		}
+		batch.Query("INSERT INTO user_preferences (user_id, namespace, key, value) VALUES (?, ?, ?, ?) USING TIMESTAMP ?",
+			userID, namespace, key, string(value), ts)
+	}
+	if err := config.Session.ExecuteBatch(batch); err != nil {
+		return nil, err
+	}
+	// The index entry carries the same timestamp as the values, so that it lives exactly as long
+	// as a namespace delete leaves them in place.
+	if err := config.Session.Query(
+		"INSERT INTO user_preference_namespaces (user_id, namespace) VALUES (?, ?) USING TIMESTAMP ?", userID, namespace, ts,
+	).Exec(); err != nil {
+		return nil, err
+	}
+	return GetPreferences(userID, namespace)
+}
+
+// DeletePreference removes one key from a namespace at the given timestamp.
+func DeletePreference(userID gocql.UUID, namespace, key string, at time.Time) error {
+	if _, err := namespaceConfig(namespace); err != nil {
+		return err
+	}
+	return config.Session.Query(
+		"DELETE FROM user_preferences USING TIMESTAMP ? WHERE user_id = ? AND namespace = ? AND key = ?",
+		at.UnixMicro(), userID, namespace, key,
+	).Exec()
+}
+
+// DeletePreferenceNamespace removes every preference in a namespace at the given timestamp.
+func DeletePreferenceNamespace(userID gocql.UUID, namespace string, at time.Time) error {
+	if _, err := namespaceConfig(namespace); err != nil {
+		return err
+	}
+	if err := config.Session.Query(
+		"DELETE FROM user_preferences USING TIMESTAMP ? WHERE user_id = ? AND namespace = ?",
+		at.UnixMicro(), userID, namespace,
+	).Exec(); err != nil {
+		return err
+	}
+	return config.Session.Query(
+		"DELETE FROM user_preference_namespaces USING TIMESTAMP ? WHERE user_id = ? AND namespace = ?",
+		at.UnixMicro(), userID, namespace,
+	).Exec()
+}
+
+// DeleteAllPreferences removes every preference of the user. It is used when the user is purged or
+// erased, so it deletes whole partitions rather than trusting the namespace index, and does so
+// ahead of the clock skew allowed to clients so that no queued write can outlive it.
+func DeleteAllPreferences(userID gocql.UUID) error {
+	ts := time.Now().Add(MaxPreferenceClockSkew).UnixMicro()
+	if err := config.Session.Query(
+		"DELETE FROM user_preferences USING TIMESTAMP ? WHERE user_id = ?", ts, userID,
+	).Exec(); err != nil {
+		return err
+	}
+	return config.Session.Query(
+		"DELETE FROM user_preference_namespaces USING TIMESTAMP ? WHERE user_id = ?", ts, userID,
+	).Exec()
+}
+
+// allPreferences returns every preference namespace of the user, for data exports. It reads the
+// user's partition rather than the namespace index, so nothing stored is left out.
+func allPreferences(userID gocql.UUID) ([]*models.PreferenceNamespace, error) {
+	iter := config.Session.Query(
+		"SELECT namespace, key, value, WRITETIME(value) FROM user_preferences WHERE user_id = ?", userID,
+	).PageSize(exportPageSize).Iter()
+	all := []*models.PreferenceNamespace{}
+	var (
+		current               *models.PreferenceNamespace
+		namespace, key, value string
+		writeTime             int64
+	)
+	// Rows are clustered by namespace, so each namespace arrives in one run
+	for iter.Scan(&namespace, &key, &value, &writeTime) {
+		if current == nil || current.Namespace != namespace {
+			current = newPreferenceNamespace(namespace)
+			all = append(all, current)
+		}
+		current.Values[key] = json.RawMessage(value)
+		current.UpdatedAt[key] = time.UnixMicro(writeTime).UTC()
+	}
+	if err := iter.Close(); err != nil {
+		return nil, err
+	}
+	return all, nil
+}
+
+func isJSONNull(value json.RawMessage) bool {
+	return strings.TrimSpace(string(value)) == "null"
+}
@@ -0,0 +1,282 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"time"
+
+	"go-keycloack/config"
+	"go-keycloack/models"
+	"go-keycloack/utils"
+
+	"github.com/redis/go-redis/v9"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	// ErrQuotasDisabled is returned when no QUOTA_TIERS_FILE is configured.
+	ErrQuotasDisabled = errors.New("quotas are not configured")
+	// ErrInvalidQuotaOverride is wrapped by errors caused by the submitted override itself.
+	ErrInvalidQuotaOverride = errors.New("invalid quota override")
+)
+
+// quotaConfig is the format of QUOTA_TIERS_FILE. Tiers are matched in order; callers without a
+// token get AnonymousTier and callers matching no tier get DefaultTier.
+type quotaConfig struct {
+	AnonymousTier string             `yaml:"anonymous_tier"`
+	DefaultTier   string             `yaml:"default_tier"`
+	Tiers         []models.QuotaTier `yaml:"tiers"`
+}
+
+var quotas *quotaConfig
+
+// LoadQuotaTiers reads QUOTA_TIERS_FILE (YAML or JSON). Without a file, quotas are not enforced.
+func LoadQuotaTiers() {
+	path := config.GetString("QUOTA_TIERS_FILE", "")
+	if path == "" {
+		return
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatalf("Failed to read quota tiers: %v", err)
+	}
+	var cfg quotaConfig
+	if err := yaml.Unmarshal(data, &cfg); err != nil {
+		log.Fatalf("Failed to parse quota tiers: %v", err)
+	}
+	for _, name := range []string{cfg.AnonymousTier, cfg.DefaultTier} {
+		if _, ok := cfg.tier(name); !ok {
+			log.Fatalf("Quota tier %q is not defined", name)
+		}
+	}
+	for _, tier := range cfg.Tiers {
+		if tier.PerMinute < 0 || tier.Burst < 0 || tier.Daily < 0 || tier.Monthly < 0 {
+			log.Fatalf("Quota tier %q has a negative limit", tier.Name)
+		}
+	}
+	quotas = &cfg
+}
+
+// QuotasEnabled reports whether quota tiers are configured.
+func QuotasEnabled() bool {
+	return quotas != nil
+}
+
+func (cfg *quotaConfig) tier(name string) (models.QuotaTier, bool) {
+	for _, tier := range cfg.Tiers {
+		if tier.Name == name {
+			return tier, true
+		}
+	}
+	return models.QuotaTier{}, false
+}
+
+// QuotaTierFor picks the tier for a token from its roles and azp client ID. Nil claims are
+// anonymous.
+func QuotaTierFor(claims map[string]interface{}) models.QuotaTier {
+	if claims == nil {
+		tier, _ := quotas.tier(quotas.AnonymousTier)
+		return tier
+	}
+	roles := utils.Roles(claims)
+	clientID, _ := claims["azp"].(string)
+	for _, tier := range quotas.Tiers {
+		if clientID != "" && slices.Contains(tier.Clients, clientID) {
+			return tier
+		}
+		for _, role := range roles {
+			if slices.Contains(tier.Roles, role) {
+				return tier
+			}
+		}
+	}
+	return DefaultQuotaTier()
+}
+
+// DefaultQuotaTier is the tier of authenticated callers that match no other tier.
+func DefaultQuotaTier() models.QuotaTier {
+	tier, _ := quotas.tier(quotas.DefaultTier)
+	return tier
+}
+
+// EffectiveQuota applies the subject's override, if any, to its tier.
+func EffectiveQuota(ctx context.Context, subject string, tier models.QuotaTier) (models.QuotaTier, *models.QuotaOverride, error) {
+	override, err := GetQuotaOverride(ctx, subject)
+	if err != nil || override == nil {
+		return tier, nil, err
+	}
+	if override.Tier != "" {
+		if t, ok := quotas.tier(override.Tier); ok {
+			tier = t
+		}
+	}
+	if override.PerMinute != nil {
+		tier.PerMinute = *override.PerMinute
+	}
+	if override.Burst != nil {
+		tier.Burst = *override.Burst
+	}
+	if override.Daily != nil {
+		tier.Daily = *override.Daily
+	}
+	if override.Monthly != nil {
+		tier.Monthly = *override.Monthly
+	}
+	return tier, override, nil
+}
+
+// consumeQuotaScript counts one request against the daily and monthly budgets unless either is
+// spent. Keys carry the period in their name and expire after it ends.
+// KEYS: daily, monthly. ARGV: daily_limit, monthly_limit, daily_expire_at, monthly_expire_at.
+// Returns {allowed, daily_used, monthly_used}.
+var consumeQuotaScript = redis.NewScript(`
+local daily = tonumber(redis.call('GET', KEYS[1]) or '0')
+local monthly = tonumber(redis.call('GET', KEYS[2]) or '0')
+local daily_limit = tonumber(ARGV[1])
+local monthly_limit = tonumber(ARGV[2])
+if (daily_limit > 0 and daily >= daily_limit) or (monthly_limit > 0 and monthly >= monthly_limit) then
+  return {0, daily, monthly}
+end
+daily = redis.call('INCR', KEYS[1])
+redis.call('EXPIREAT', KEYS[1], ARGV[3])
+monthly = redis.call('INCR', KEYS[2])
+redis.call('EXPIREAT', KEYS[2], ARGV[4])
+return {1, daily, monthly}
+`)
+
+// quotaPeriods returns the budget keys for now and when their periods end. Periods follow the
+// UTC calendar.
+func quotaPeriods(subject string, now time.Time) (dailyKey, monthlyKey string, dayEnd, monthEnd time.Time) {
+	now = now.UTC()
+	dayStart := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	return "quota:" + subject + ":d:" + dayStart.Format("20060102"),
+		"quota:" + subject + ":m:" + monthStart.Format("200601"),
+		dayStart.AddDate(0, 0, 1),
+		monthStart.AddDate(0, 1, 0)
+}
+
+// QuotaRateKey is the Valkey key of the subject's per-minute rate limit.
+func QuotaRateKey(subject string) string {
+	return "quota:" + subject + ":rate"
+}
+
+// ConsumeQuota counts a request against the subject's budgets. When it is rejected, the returned
+// time is when the exhausted budget resets.
+func ConsumeQuota(ctx context.Context, subject string, tier models.QuotaTier) (bool, time.Time, error) {
+	if tier.Daily == 0 && tier.Monthly == 0 {
+		return true, time.Time{}, nil
+	}
+	dailyKey, monthlyKey, dayEnd, monthEnd := quotaPeriods(subject, time.Now())
+	// Keep the counters a day past the period so usage can still be read around the boundary
+	raw, err := consumeQuotaScript.Run(ctx, config.Valkey, []string{dailyKey, monthlyKey},
+		tier.Daily, tier.Monthly, dayEnd.Add(24*time.Hour).Unix(), monthEnd.Add(24*time.Hour).Unix(),
+	).Int64Slice()
+	if err != nil {
+		return false, time.Time{}, err
+	}
+	if len(raw) != 3 {
+		return false, time.Time{}, fmt.Errorf("unexpected quota script result %v", raw)
+	}
+	if raw[0] == 1 {
+		return true, time.Time{}, nil
+	}
+	if tier.Monthly > 0 && raw[2] >= tier.Monthly {
+		return false, monthEnd, nil
+	}
+	return false, dayEnd, nil
+}
+
+// GetQuotaUsage reports the subject's budgets and what is left of them.
+func GetQuotaUsage(ctx context.Context, subject string, tier models.QuotaTier, override *models.QuotaOverride) (*models.QuotaUsage, error) {
+	dailyKey, monthlyKey, dayEnd, monthEnd := quotaPeriods(subject, time.Now())
+	values, err := config.Valkey.MGet(ctx, dailyKey, monthlyKey).Result()
+	if err != nil {
+		return nil, err
+	}
+	return &models.QuotaUsage{
+		Subject:   subject,
+		Tier:      tier.Name,
+		PerMinute: tier.PerMinute,
+		Burst:     tier.Burst,
+		Daily:     quotaBudget(tier.Daily, values[0], dayEnd),
+		Monthly:   quotaBudget(tier.Monthly, values[1], monthEnd),
+		Override:  override,
+	}, nil
+}
+
+func quotaBudget(limit int64, value interface{}, resetsAt time.Time) models.QuotaBudget {
+	var used int64
+	if s, ok := value.(string); ok {
+		fmt.Sscan(s, &used)
+	}
+	budget := models.QuotaBudget{Limit: limit, Used: used, ResetsAt: resetsAt}
+	if limit > 0 {
+		budget.Remaining = max(limit-used, 0)
+	}
+	return budget
+}
+
+func quotaOverrideKey(subject string) string {
+	return "quota_override:" + subject
+}
+
+// GetQuotaOverride returns the subject's override, or nil if it has none.
+func GetQuotaOverride(ctx context.Context, subject string) (*models.QuotaOverride, error) {
+	data, err := config.Valkey.Get(ctx, quotaOverrideKey(subject)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var override models.QuotaOverride
+	if err := json.Unmarshal(data, &override); err != nil {
+		return nil, err
+	}
+	return &override, nil
+}
+
+// SetQuotaOverride stores an override for the subject. It applies on every instance at once and
+// disappears at ExpiresAt, if set.
+func SetQuotaOverride(ctx context.Context, subject string, override *models.QuotaOverride) error {
+	if !QuotasEnabled() {
+		return ErrQuotasDisabled
+	}
+	if override.Tier != "" {
+		if _, ok := quotas.tier(override.Tier); !ok {
+			return fmt.Errorf("%w: unknown tier %q", ErrInvalidQuotaOverride, override.Tier)
+		}
+	}
+	for _, v := range []*int{override.PerMinute, override.Burst} {
+		if v != nil && *v < 0 {
+			return fmt.Errorf("%w: limits must not be negative", ErrInvalidQuotaOverride)
+		}
+	}
+	for _, v := range []*int64{override.Daily, override.Monthly} {
+		if v != nil && *v < 0 {
+			return fmt.Errorf("%w: budgets must not be negative", ErrInvalidQuotaOverride)
+		}
+	}
+	var ttl time.Duration
+	if override.ExpiresAt != nil {
+		if ttl = time.Until(*override.ExpiresAt); ttl <= 0 {
+			return fmt.Errorf("%w: expires_at must be in the future", ErrInvalidQuotaOverride)
+		}
+	}
+	data, err := json.Marshal(override)
+	if err != nil {
+		return err
+	}
+	return config.Valkey.Set(ctx, quotaOverrideKey(subject), data, ttl).Err()
+}
+
+// DeleteQuotaOverride removes the subject's override.
+func DeleteQuotaOverride(ctx context.Context, subject string) error {
+	return config.Valkey.Del(ctx, quotaOverrideKey(subject)).Err()
+}
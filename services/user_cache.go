@@ -0,0 +1,226 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"go-keycloack/config"
+	"go-keycloack/models"
+
+	"github.com/gocql/gocql"
+	"github.com/redis/go-redis/v9"
+	"golang.org/x/sync/singleflight"
+)
+
+// The user cache sits in front of the users table. Rows are cached in their stored (encrypted)
+// form in Valkey and in a short-lived in-process layer; writes invalidate both, and the
+// invalidation is broadcast over Valkey pub/sub so other instances drop their local copies.
+
+const (
+	userCacheInvalidateChannel = "user-cache:invalidate"
+	notFoundMarker             = "__not_found__"
+)
+
+var (
+	userCacheMetrics = expvar.NewMap("user_cache")
+	userCacheFlight  singleflight.Group
+	userLocalCache   = &localCache{entries: map[string]localCacheEntry{}}
+)
+
+func userCacheTTL() time.Duration {
+	return config.GetDuration("USER_CACHE_TTL", 5*time.Minute)
+}
+
+func usernameCacheTTL() time.Duration {
+	return config.GetDuration("USER_CACHE_USERNAME_TTL", 10*time.Minute)
+}
+
+func negativeCacheTTL() time.Duration {
+	return config.GetDuration("USER_CACHE_NEGATIVE_TTL", 30*time.Second)
+}
+
+func localCacheTTL() time.Duration {
+	return config.GetDuration("USER_CACHE_LOCAL_TTL", 5*time.Second)
+}
+
+func userCacheKey(id gocql.UUID) string {
+	return "user:id:" + id.String()
+}
+
+func usernameCacheKey(username string) string {
+	return "user:username:" + username
+}
+
+type localCacheEntry struct {
+	value     string
+	expiresAt time.Time
+}
+
+// localCache is the in-process layer in front of Valkey.
+type localCache struct {
+	mu      sync.Mutex
+	entries map[string]localCacheEntry
+}
+
+func (l *localCache) get(key string) (string, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	e, ok := l.entries[key]
+	if !ok || time.Now().After(e.expiresAt) {
+		delete(l.entries, key)
+		return "", false
+	}
+	return e.value, true
+}
+
+func (l *localCache) set(key, value string, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	l.mu.Lock()
+	l.entries[key] = localCacheEntry{value: value, expiresAt: time.Now().Add(ttl)}
+	l.mu.Unlock()
+}
+
+func (l *localCache) delete(keys ...string) {
+	l.mu.Lock()
+	for _, key := range keys {
+		delete(l.entries, key)
+	}
+	l.mu.Unlock()
+}
+
+// cachedLookup returns the cached value for key, loading and caching it on a miss. Concurrent
+// misses for the same key share one load. A load returning gocql.ErrNotFound is cached as a
+// negative result.
+func cachedLookup(key string, ttl time.Duration, load func() (string, error)) (string, error) {
+	if value, ok := userLocalCache.get(key); ok {
+		userCacheMetrics.Add("hits_local", 1)
+		return cachedValue(value)
+	}
+
+	v, err, _ := userCacheFlight.Do(key, func() (interface{}, error) {
+		ctx := context.Background()
+		value, err := config.Valkey.Get(ctx, key).Result()
+		if err == nil {
+			userCacheMetrics.Add("hits_valkey", 1)
+			userLocalCache.set(key, value, localCacheTTL())
+			return value, nil
+		}
+		if !errors.Is(err, redis.Nil) {
+			userCacheMetrics.Add("errors", 1)
+		}
+
+		userCacheMetrics.Add("misses", 1)
+		value, err = load()
+		if errors.Is(err, gocql.ErrNotFound) {
+			value, ttl = notFoundMarker, negativeCacheTTL()
+		} else if err != nil {
+			return "", err
+		}
+		if err := config.Valkey.Set(ctx, key, value, ttl).Err(); err != nil {
+			userCacheMetrics.Add("errors", 1)
+		}
+		userLocalCache.set(key, value, minDuration(ttl, localCacheTTL()))
+		return value, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return cachedValue(v.(string))
+}
+
+func cachedValue(value string) (string, error) {
+	if value == notFoundMarker {
+		userCacheMetrics.Add("negative_hits", 1)
+		return "", gocql.ErrNotFound
+	}
+	return value, nil
+}
+
+func minDuration(a, b time.Duration) time.Duration {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// cachedStoredUser returns the user row, in its stored form, through the cache.
+func cachedStoredUser(id gocql.UUID) (*models.User, error) {
+	value, err := cachedLookup(userCacheKey(id), userCacheTTL(), func() (string, error) {
+		u, err := loadStoredUser(id)
+		if err != nil {
+			return "", err
+		}
+		data, err := json.Marshal(u)
+		return string(data), err
+	})
+	if err != nil {
+		return nil, err
+	}
+	var u models.User
+	if err := json.Unmarshal([]byte(value), &u); err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// cachedUserID resolves a username to a user ID through the cache.
+func cachedUserID(username string) (gocql.UUID, error) {
+	value, err := cachedLookup(usernameCacheKey(username), usernameCacheTTL(), func() (string, error) {
+		id, err := loadUserID(username)
+		if err != nil {
+			return "", err
+		}
+		return id.String(), nil
+	})
+	if err != nil {
+		return gocql.UUID{}, err
+	}
+	return gocql.ParseUUID(value)
+}
+
+// invalidateUserCache drops the user's row and the given username mappings from every instance.
+func invalidateUserCache(id gocql.UUID, usernames ...string) {
+	keys := []string{}
+	if id != (gocql.UUID{}) {
+		keys = append(keys, userCacheKey(id))
+	}
+	for _, username := range usernames {
+		if username != "" {
+			keys = append(keys, usernameCacheKey(username))
+		}
+	}
+	if len(keys) == 0 {
+		return
+	}
+	userCacheMetrics.Add("invalidations", 1)
+	userLocalCache.delete(keys...)
+
+	ctx := context.Background()
+	if err := config.Valkey.Del(ctx, keys...).Err(); err != nil {
+		userCacheMetrics.Add("errors", 1)
+		log.Printf("Failed to invalidate user cache keys %v: %v", keys, err)
+	}
+	if err := config.Valkey.Publish(ctx, userCacheInvalidateChannel, strings.Join(keys, "\n")).Err(); err != nil {
+		userCacheMetrics.Add("errors", 1)
+	}
+}
+
+// StartUserCacheInvalidation subscribes to invalidations published by other instances and drops
+// the affected entries from the in-process cache.
+func StartUserCacheInvalidation() {
+	go func() {
+		pubsub := config.Valkey.Subscribe(context.Background(), userCacheInvalidateChannel)
+		defer pubsub.Close()
+		for msg := range pubsub.Channel() {
+			userLocalCache.delete(strings.Split(msg.Payload, "\n")...)
+		}
+	}()
+}
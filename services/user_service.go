@@ -1,65 +1,390 @@
 package services
 
 import (
+	"errors"
+	"log"
+	"strings"
+	"time"
+
 	"go-keycloack/config"
+	"go-keycloack/encryption"
 	"go-keycloack/models"
 
 	"github.com/gocql/gocql"
 )
 
+const userColumns = "id, username, email, firstname, lastname, attributes, keycloak_id, last_login_at, login_count, deleted_at, deleted_by"
+
+// userFields returns the scan destinations matching userColumns.
+func userFields(u *models.User) []interface{} {
+	return []interface{}{&u.ID, &u.Username, &u.Email, &u.FirstName, &u.LastName, &u.Attributes, &u.KeycloakID, &u.LastLoginAt, &u.LoginCount, &u.DeletedAt, &u.DeletedBy}
+}
+
+// piiFields maps the user columns that may be encrypted to their struct fields.
+func piiFields(u *models.User) map[string]*string {
+	return map[string]*string{"email": &u.Email, "firstname": &u.FirstName, "lastname": &u.LastName}
+}
+
+// decryptUser replaces the stored form of the user's PII fields with their plaintext.
+func decryptUser(u *models.User) error {
+	for field, value := range piiFields(u) {
+		plaintext, err := encryption.Default.Decrypt(field, *value)
+		if err != nil {
+			return err
+		}
+		*value = plaintext
+	}
+	attrs, err := decryptAttributes(u.Attributes)
+	if err != nil {
+		return err
+	}
+	u.Attributes = attrs
+	return nil
+}
+
+// encryptedUser returns a copy of the user with PII fields in their stored form.
+func encryptedUser(u *models.User) (*models.User, error) {
+	stored := *u
+	for field, value := range piiFields(&stored) {
+		ciphertext, err := encryption.Default.Encrypt(field, *value)
+		if err != nil {
+			return nil, err
+		}
+		*value = ciphertext
+	}
+	attrs, err := encryptAttributes(u.Attributes)
+	if err != nil {
+		return nil, err
+	}
+	stored.Attributes = attrs
+	return &stored, nil
+}
+
+// emailIndex is the lookup key stored alongside the email: a keyed blind index when the email is
+// encrypted, otherwise the normalised email itself.
+func emailIndex(email string) string {
+	if encryption.Default.Encrypts("email") {
+		return encryption.Default.BlindIndex("email", email)
+	}
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// GetUserByID returns the user with the given ID. Soft-deleted users are reported as gocql.ErrNotFound.
 func GetUserByID(id gocql.UUID) (*models.User, error) {
+	u, err := GetUserByIDIncludingDeleted(id)
+	if err != nil {
+		return nil, err
+	}
+	if u.IsDeleted() {
+		return nil, gocql.ErrNotFound
+	}
+	return u, nil
+}
+
+// GetUserByIDIncludingDeleted returns the user with the given ID even if it has been soft deleted.
+func GetUserByIDIncludingDeleted(id gocql.UUID) (*models.User, error) {
+	u, err := cachedStoredUser(id)
+	if err != nil {
+		return nil, err
+	}
+	if err := decryptUser(u); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// loadStoredUser reads the user row from Cassandra without decrypting it.
+func loadStoredUser(id gocql.UUID) (*models.User, error) {
 	var u models.User
 	err := config.Session.Query(
-		"SELECT id, username, email, firstname, lastname FROM users WHERE id = ?",
+		"SELECT "+userColumns+" FROM users WHERE id = ?",
 		id,
-	).Consistency(gocql.One).Scan(&u.ID, &u.Username, &u.Email, &u.FirstName, &u.LastName)
+	).Consistency(gocql.One).Scan(userFields(&u)...)
 	if err != nil {
 		return nil, err
 	}
 	return &u, nil
 }
 
+// GetUserByUsername returns the user with the given username. Soft-deleted users are reported as gocql.ErrNotFound.
 func GetUserByUsername(username string) (*models.User, error) {
-	var u models.User
+	u, err := GetUserByUsernameIncludingDeleted(username)
+	if err != nil {
+		return nil, err
+	}
+	if u.IsDeleted() {
+		return nil, gocql.ErrNotFound
+	}
+	return u, nil
+}
+
+// GetUserByUsernameIncludingDeleted returns the user with the given username even if it has been soft deleted.
+func GetUserByUsernameIncludingDeleted(username string) (*models.User, error) {
+	id, err := cachedUserID(username)
+	if err != nil {
+		return nil, err
+	}
+	u, err := GetUserByIDIncludingDeleted(id)
+	if err == nil && u.Username != username {
+		// The cached mapping predates a rename; drop it and resolve again from Cassandra.
+		invalidateUserCache(gocql.UUID{}, username)
+		if id, err = loadUserID(username); err != nil {
+			return nil, err
+		}
+		return GetUserByIDIncludingDeleted(id)
+	}
+	return u, err
+}
+
+// loadUserID resolves a username to a user ID in Cassandra.
+func loadUserID(username string) (gocql.UUID, error) {
+	var id gocql.UUID
 	err := config.Session.Query(
-		"SELECT id, username, email, firstname, lastname FROM users WHERE username = ?",
+		"SELECT id FROM users WHERE username = ?",
 		username,
-	).Consistency(gocql.One).Scan(&u.ID, &u.Username, &u.Email, &u.FirstName, &u.LastName)
+	).Consistency(gocql.One).Scan(&id)
+	return id, err
+}
+
+// GetUserByEmail returns the user with the given email, looked up through the email index so that
+// it works when emails are encrypted. Soft-deleted users are reported as gocql.ErrNotFound.
+func GetUserByEmail(email string) (*models.User, error) {
+	var u models.User
+	err := config.Session.Query(
+		"SELECT "+userColumns+" FROM users WHERE email_index = ?",
+		emailIndex(email),
+	).Consistency(gocql.One).Scan(userFields(&u)...)
 	if err != nil {
 		return nil, err
 	}
+	if err := decryptUser(&u); err != nil {
+		return nil, err
+	}
+	if u.IsDeleted() {
+		return nil, gocql.ErrNotFound
+	}
 	return &u, nil
 }
 
 func CreateUser(user *models.User) error {
 	user.ID = gocql.TimeUUID()
-	return config.Session.Query(
-		"INSERT INTO users (id, username, email, firstname, lastname) VALUES (?, ?, ?, ?, ?)",
-		user.ID, user.Username, user.Email, user.FirstName, user.LastName,
-	).Exec()
+	stored, err := encryptedUser(user)
+	if err != nil {
+		return err
+	}
+	if err := config.Session.Query(
+		"INSERT INTO users (id, username, email, email_index, firstname, lastname, attributes, keycloak_id) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		user.ID, stored.Username, stored.Email, emailIndex(user.Email), stored.FirstName, stored.LastName, stored.Attributes, user.KeycloakID,
+	).Exec(); err != nil {
+		return err
+	}
+	invalidateUserCache(user.ID, user.Username)
+	return nil
 }
 
 func UpdateUser(id gocql.UUID, user *models.User) error {
-	return config.Session.Query(
-		"UPDATE users SET username = ?, email = ?, firstname = ?, lastname = ? WHERE id = ?",
-		user.Username, user.Email, user.FirstName, user.LastName, id,
-	).Exec()
+	stored, err := encryptedUser(user)
+	if err != nil {
+		return err
+	}
+	if err := config.Session.Query(
+		"UPDATE users SET username = ?, email = ?, email_index = ?, firstname = ?, lastname = ?, attributes = ? WHERE id = ?",
+		stored.Username, stored.Email, emailIndex(user.Email), stored.FirstName, stored.LastName, stored.Attributes, id,
+	).Exec(); err != nil {
+		return err
+	}
+	invalidateUserCache(id, user.Username)
+	return nil
 }
 
+// DeleteUser permanently removes the user row. Use SoftDeleteUser for user-facing deletes.
 func DeleteUser(id gocql.UUID) error {
-	return config.Session.Query("DELETE FROM users WHERE id = ?", id).Exec()
+	if err := config.Session.Query("DELETE FROM users WHERE id = ?", id).Exec(); err != nil {
+		return err
+	}
+	invalidateUserCache(id)
+	return nil
+}
+
+// SoftDeleteUser marks the user as deleted and disables their Keycloak account so they can no
+// longer log in. The row is kept until PurgeDeletedUsers removes it after the retention period.
+func SoftDeleteUser(user *models.User, deletedBy string) error {
+	if err := setKeycloakEnabled(user, false); err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	if err := config.Session.Query(
+		"UPDATE users SET deleted_at = ?, deleted_by = ? WHERE id = ?",
+		now, deletedBy, user.ID,
+	).Exec(); err != nil {
+		return err
+	}
+	invalidateUserCache(user.ID)
+	user.DeletedAt = &now
+	user.DeletedBy = deletedBy
+	return nil
+}
+
+// RestoreUser clears the soft-delete marker and re-enables the Keycloak account.
+func RestoreUser(user *models.User) error {
+	if err := config.Session.Query("DELETE deleted_at, deleted_by FROM users WHERE id = ?", user.ID).Exec(); err != nil {
+		return err
+	}
+	invalidateUserCache(user.ID)
+	user.DeletedAt = nil
+	user.DeletedBy = ""
+	return setKeycloakEnabled(user, true)
+}
+
+// setKeycloakEnabled toggles the user's Keycloak account, resolving and remembering its ID if needed.
+// Users that do not exist in Keycloak are skipped.
+func setKeycloakEnabled(user *models.User, enabled bool) error {
+	keycloakID, err := resolveKeycloakID(user)
+	if errors.Is(err, ErrKeycloakNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return SetKeycloakUserEnabled(keycloakID, enabled)
+}
+
+// GetUserRoles returns the realm roles mapped directly to the user in Keycloak.
+func GetUserRoles(user *models.User) ([]string, error) {
+	keycloakID, err := resolveKeycloakID(user)
+	if err != nil {
+		return nil, err
+	}
+	return GetKeycloakRealmRoles(keycloakID)
 }
 
-// GetAllUsers fetches all users from the database
+// UpdateUserRoles adds and removes realm role mappings in Keycloak and returns the user's roles
+// before and after the change.
+func UpdateUserRoles(user *models.User, add, remove []string) (before, after []string, err error) {
+	keycloakID, err := resolveKeycloakID(user)
+	if err != nil {
+		return nil, nil, err
+	}
+	if before, err = GetKeycloakRealmRoles(keycloakID); err != nil {
+		return nil, nil, err
+	}
+	if err := AddKeycloakRealmRoles(keycloakID, add); err != nil {
+		return nil, nil, err
+	}
+	if err := RemoveKeycloakRealmRoles(keycloakID, remove); err != nil {
+		return nil, nil, err
+	}
+	if after, err = GetKeycloakRealmRoles(keycloakID); err != nil {
+		return nil, nil, err
+	}
+	return before, after, nil
+}
+
+// resolveKeycloakID returns the user's Keycloak ID, looking it up by username for rows created
+// before the ID was stored.
+func resolveKeycloakID(user *models.User) (string, error) {
+	if user.KeycloakID != "" {
+		return user.KeycloakID, nil
+	}
+	keycloakID, err := FindKeycloakUserID(user.Username)
+	if err != nil {
+		return "", err
+	}
+	user.KeycloakID = keycloakID
+	if err := config.Session.Query("UPDATE users SET keycloak_id = ? WHERE id = ?", keycloakID, user.ID).Exec(); err != nil {
+		log.Printf("Failed to store keycloak_id for user %s: %v", user.ID, err)
+	}
+	invalidateUserCache(user.ID)
+	return keycloakID, nil
+}
+
+// GetAllUsers fetches all users from the database, excluding soft-deleted ones
 func GetAllUsers() ([]models.User, error) {
 	var users []models.User
-	iter := config.Session.Query("SELECT id, username, email, firstname, lastname FROM users").Iter()
+	iter := config.Session.Query("SELECT " + userColumns + " FROM users").Iter()
 	var u models.User
-	for iter.Scan(&u.ID, &u.Username, &u.Email, &u.FirstName, &u.LastName) {
-		users = append(users, u)
+	for iter.Scan(userFields(&u)...) {
+		if !u.IsDeleted() {
+			if err := decryptUser(&u); err != nil {
+				iter.Close()
+				return nil, err
+			}
+			users = append(users, u)
+		}
+		u = models.User{}
 	}
 	if err := iter.Close(); err != nil {
 		return nil, err
 	}
 	return users, nil
 }
+
+// PurgeDeletedUsers permanently removes users that were soft deleted more than retention ago,
+// from both Keycloak and Cassandra. It returns the number of users purged.
+func PurgeDeletedUsers(retention time.Duration) (int, error) {
+	cutoff := time.Now().Add(-retention)
+	var expired []models.User
+	iter := config.Session.Query("SELECT " + userColumns + " FROM users").Iter()
+	var u models.User
+	for iter.Scan(userFields(&u)...) {
+		if u.IsDeleted() && u.DeletedAt.Before(cutoff) {
+			if err := decryptUser(&u); err != nil {
+				log.Printf("Purge of user %s skipped: %v", u.ID, err)
+			} else {
+				expired = append(expired, u)
+			}
+		}
+		u = models.User{}
+	}
+	if err := iter.Close(); err != nil {
+		return 0, err
+	}
+
+	purged := 0
+	for i := range expired {
+		user := &expired[i]
+		keycloakID, err := resolveKeycloakID(user)
+		if err != nil && !errors.Is(err, ErrKeycloakNotFound) {
+			log.Printf("Purge of user %s skipped: %v", user.ID, err)
+			continue
+		}
+		if keycloakID != "" {
+			if err := DeleteKeycloakUser(keycloakID); err != nil {
+				log.Printf("Purge of user %s skipped: failed to delete from Keycloak: %v", user.ID, err)
+				continue
+			}
+		}
+		if err := DeleteAllPreferences(user.ID); err != nil {
+			log.Printf("Purge of user %s skipped: failed to delete preferences: %v", user.ID, err)
+			continue
+		}
+		if err := DeleteAvatar(user.ID); err != nil {
+			log.Printf("Purge of user %s skipped: failed to delete avatar: %v", user.ID, err)
+			continue
+		}
+		if err := DeleteUser(user.ID); err != nil {
+			log.Printf("Purge of user %s failed: %v", user.ID, err)
+			continue
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+// StartUserPurge runs PurgeDeletedUsers every interval in the background.
+func StartUserPurge(interval, retention time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			purged, err := PurgeDeletedUsers(retention)
+			if err != nil {
+				log.Printf("User purge failed: %v", err)
+				continue
+			}
+			if purged > 0 {
+				log.Printf("Purged %d soft-deleted users", purged)
+			}
+		}
+	}()
+}
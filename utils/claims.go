@@ -0,0 +1,84 @@
+package utils
+
+import (
+	"os"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// ClaimsLocalKey is the fiber.Ctx local under which the auth middleware stores the token claims.
+const ClaimsLocalKey = "claims"
+
+// Claims returns the token claims stored by the auth middleware, or nil for unauthenticated requests.
+func Claims(c *fiber.Ctx) map[string]interface{} {
+	claims, _ := c.Locals(ClaimsLocalKey).(map[string]interface{})
+	return claims
+}
+
+// Subject returns the "sub" claim of the current token.
+func Subject(c *fiber.Ctx) string {
+	sub, _ := Claims(c)["sub"].(string)
+	return sub
+}
+
+// Username returns the "preferred_username" claim of the current token.
+func Username(c *fiber.Ctx) string {
+	username, _ := Claims(c)["preferred_username"].(string)
+	return username
+}
+
+// Actor identifies the caller for bookkeeping, preferring the username over the subject.
+func Actor(c *fiber.Ctx) string {
+	if username := Username(c); username != "" {
+		return username
+	}
+	return Subject(c)
+}
+
+// Roles returns the realm roles and the roles granted to this API's client in the token.
+func Roles(claims map[string]interface{}) []string {
+	var roles []string
+	if realmAccess, ok := claims["realm_access"].(map[string]interface{}); ok {
+		roles = append(roles, stringSlice(realmAccess["roles"])...)
+	}
+	if resourceAccess, ok := claims["resource_access"].(map[string]interface{}); ok {
+		if client, ok := resourceAccess[os.Getenv("CLIENT_ID")].(map[string]interface{}); ok {
+			roles = append(roles, stringSlice(client["roles"])...)
+		}
+	}
+	return roles
+}
+
+// HasRole reports whether the current token carries the given realm or client role.
+func HasRole(c *fiber.Ctx, role string) bool {
+	for _, r := range Roles(Claims(c)) {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// AdminRole is the role that grants access to administrative endpoints.
+func AdminRole() string {
+	if role := os.Getenv("ADMIN_ROLE"); role != "" {
+		return role
+	}
+	return "admin"
+}
+
+// IsAdmin reports whether the current token carries the admin role.
+func IsAdmin(c *fiber.Ctx) bool {
+	return HasRole(c, AdminRole())
+}
+
+func stringSlice(v interface{}) []string {
+	items, _ := v.([]interface{})
+	out := make([]string, 0, len(items))
+	for _, item := range items {
+		if s, ok := item.(string); ok {
+			out = append(out, s)
+		}
+	}
+	return out
+}
@@ -0,0 +1,16 @@
+package utils
+
+import "github.com/gofiber/fiber/v2"
+
+// ClientIPLocalKey is the fiber.Ctx local under which the client IP middleware stores the
+// resolved address.
+const ClientIPLocalKey = "client_ip"
+
+// ClientIP returns the client address resolved from trusted proxy headers, or the peer address
+// when the client IP middleware did not run.
+func ClientIP(c *fiber.Ctx) string {
+	if ip, ok := c.Locals(ClientIPLocalKey).(string); ok && ip != "" {
+		return ip
+	}
+	return c.IP()
+}
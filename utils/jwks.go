@@ -0,0 +1,175 @@
+package utils
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrKeysUnavailable is returned when a token's signing key is not cached and the key set
+// cannot be fetched.
+var ErrKeysUnavailable = errors.New("signing keys unavailable")
+
+// JWKS caches the public keys of a JSON Web Key Set. Keys are refetched after ttl, or sooner when
+// a token names an unknown key (for example after Keycloak rotated its keys), but at most once
+// per minRefresh so that tokens with made-up key IDs cannot hammer the issuer.
+type JWKS struct {
+	url        string
+	ttl        time.Duration
+	minRefresh time.Duration
+	client     *http.Client
+
+	mu        sync.Mutex
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+	triedAt   time.Time
+}
+
+func NewJWKS(url string, ttl time.Duration) *JWKS {
+	return &JWKS{
+		url:        url,
+		ttl:        ttl,
+		minRefresh: 30 * time.Second,
+		client:     &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+// Key returns the public key with the given key ID.
+func (j *JWKS) Key(kid string) (crypto.PublicKey, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	key, ok := j.keys[kid]
+	stale := time.Since(j.fetchedAt) > j.ttl
+	if (ok && !stale) || time.Since(j.triedAt) < j.minRefresh {
+		if !ok {
+			return nil, j.missing(kid)
+		}
+		return key, nil
+	}
+
+	j.triedAt = time.Now()
+	keys, err := j.fetch()
+	if err != nil {
+		if ok {
+			// Keep using the cached key while the issuer is unreachable
+			return key, nil
+		}
+		return nil, fmt.Errorf("%w: %v", ErrKeysUnavailable, err)
+	}
+	j.keys = keys
+	j.fetchedAt = j.triedAt
+	if key, ok = keys[kid]; !ok {
+		return nil, j.missing(kid)
+	}
+	return key, nil
+}
+
+func (j *JWKS) missing(kid string) error {
+	if j.keys == nil {
+		return ErrKeysUnavailable
+	}
+	return fmt.Errorf("unknown signing key %q", kid)
+}
+
+func (j *JWKS) fetch() (map[string]crypto.PublicKey, error) {
+	resp, err := j.client.Get(j.url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("JWKS endpoint returned %s", resp.Status)
+	}
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, err
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			// Skip key types we do not verify with rather than failing the whole set
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+	return keys, nil
+}
+
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, errors.New("RSA exponent too large")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("EC point is not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
@@ -1,14 +1,68 @@
 package utils
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"math/big"
+	"os"
 	"strings"
+	"sync"
+	"time"
+
+	"go-keycloack/config"
 
 	"github.com/gofiber/fiber/v2"
 )
 
+// ErrInvalidToken is returned by VerifyJWT for tokens that are malformed, badly signed, expired
+// or issued by someone else.
+var ErrInvalidToken = errors.New("invalid token")
+
+// ErrBadSignature is wrapped by VerifyJWT errors for tokens that are malformed, use an unsupported
+// algorithm or are not signed with a realm key, that is tokens the realm never issued, as opposed
+// to genuine tokens that are expired or meant for another client. It wraps ErrInvalidToken.
+var ErrBadSignature = fmt.Errorf("%w: bad signature", ErrInvalidToken)
+
+// clockSkew is how far exp and nbf may be off to allow for drift between Keycloak and this host.
+const clockSkew = 30 * time.Second
+
+var (
+	realmKeysOnce sync.Once
+	realmKeys     *JWKS
+)
+
+// realmIssuer is the iss claim expected in tokens, JWT_ISSUER or the realm URL.
+func realmIssuer() string {
+	if issuer := os.Getenv("JWT_ISSUER"); issuer != "" {
+		return issuer
+	}
+	return strings.TrimSuffix(os.Getenv("KEYCLOAK_BASE_URL"), "/") + "/realms/" + os.Getenv("REALM")
+}
+
+// tokenAudience is the client tokens must be meant for, JWT_AUDIENCE or CLIENT_ID. Tokens are not
+// checked for an audience when neither is set.
+func tokenAudience() string {
+	return config.GetString("JWT_AUDIENCE", os.Getenv("CLIENT_ID"))
+}
+
+func realmJWKS() *JWKS {
+	realmKeysOnce.Do(func() {
+		url := os.Getenv("JWKS_URL")
+		if url == "" {
+			url = strings.TrimSuffix(os.Getenv("KEYCLOAK_BASE_URL"), "/") + "/realms/" + os.Getenv("REALM") + "/protocol/openid-connect/certs"
+		}
+		realmKeys = NewJWKS(url, config.GetDuration("JWKS_CACHE_TTL", 10*time.Minute))
+	})
+	return realmKeys
+}
+
 // ExtractAndValidateBearerToken extracts the Bearer token from the Authorization header and validates its format.
 // Returns the token string if valid, or a Fiber error response if invalid.
 func ExtractAndValidateBearerToken(c *fiber.Ctx) (string, error) {
@@ -27,7 +81,9 @@ func ExtractAndValidateBearerToken(c *fiber.Ctx) (string, error) {
 	return tokenParts[1], nil
 }
 
-// ParseJWT parses a JWT token string and returns its claims as a map.
+// ParseJWT parses a JWT token string and returns its claims as a map. The signature is not
+// checked, so it is only fit for tokens received straight from Keycloak; use VerifyJWT for tokens
+// presented by clients.
 func ParseJWT(token string) (map[string]interface{}, error) {
 	parts := strings.Split(token, ".")
 	if len(parts) != 3 {
@@ -43,3 +99,122 @@ func ParseJWT(token string) (map[string]interface{}, error) {
 	}
 	return claims, nil
 }
+
+// VerifyJWT checks the token's signature against the realm's published keys, and its expiry,
+// issuer and audience, and returns its claims. Errors wrap ErrInvalidToken, and also
+// ErrBadSignature when the token was not issued by the realm at all, except ErrKeysUnavailable
+// when the keys could not be fetched and the token can be neither accepted nor rejected.
+func VerifyJWT(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("%w: malformed", ErrBadSignature)
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(raw, &header) != nil {
+		return nil, fmt.Errorf("%w: malformed header", ErrBadSignature)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed signature", ErrBadSignature)
+	}
+
+	key, err := realmJWKS().Key(header.Kid)
+	if errors.Is(err, ErrKeysUnavailable) {
+		return nil, err
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadSignature, err)
+	}
+	if err := verifySignature(header.Alg, key, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadSignature, err)
+	}
+
+	claims, err := ParseJWT(token)
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed payload", ErrBadSignature)
+	}
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok || now.After(time.Unix(int64(exp), 0).Add(clockSkew)) {
+		return nil, fmt.Errorf("%w: expired", ErrInvalidToken)
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(clockSkew).Before(time.Unix(int64(nbf), 0)) {
+		return nil, fmt.Errorf("%w: not yet valid", ErrInvalidToken)
+	}
+	if iss, _ := claims["iss"].(string); iss != realmIssuer() {
+		return nil, fmt.Errorf("%w: unexpected issuer %q", ErrInvalidToken, iss)
+	}
+	if audience := tokenAudience(); audience != "" && !hasAudience(claims, audience) {
+		return nil, fmt.Errorf("%w: not meant for %q", ErrInvalidToken, audience)
+	}
+	return claims, nil
+}
+
+// hasAudience reports whether the token is meant for the client: it is listed in aud, which may
+// be a string or an array, or is the azp the token was issued to. Keycloak access tokens often
+// carry only azp for the requesting client.
+func hasAudience(claims map[string]interface{}, audience string) bool {
+	if azp, _ := claims["azp"].(string); azp == audience {
+		return true
+	}
+	switch aud := claims["aud"].(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, a := range aud {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// verifySignature checks an RS*, PS* or ES* signature. Symmetric algorithms and "none" are
+// rejected outright, whatever the key.
+func verifySignature(alg string, key crypto.PublicKey, signed string, signature []byte) error {
+	var hash crypto.Hash
+	switch alg[min(2, len(alg)):] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	h := hash.New()
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	switch {
+	case strings.HasPrefix(alg, "RS") || strings.HasPrefix(alg, "PS"):
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("key does not match algorithm %q", alg)
+		}
+		if alg[0] == 'P' {
+			return rsa.VerifyPSS(pub, hash, digest, signature, nil)
+		}
+		return rsa.VerifyPKCS1v15(pub, hash, digest, signature)
+	case strings.HasPrefix(alg, "ES"):
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok || len(signature)%2 != 0 {
+			return fmt.Errorf("key does not match algorithm %q", alg)
+		}
+		// JWS encodes ECDSA signatures as r||s rather than ASN.1
+		r := new(big.Int).SetBytes(signature[:len(signature)/2])
+		s := new(big.Int).SetBytes(signature[len(signature)/2:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return errors.New("signature mismatch")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported algorithm %q", alg)
+	}
+}
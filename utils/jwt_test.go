@@ -0,0 +1,197 @@
+package utils
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testIssuer = "https://keycloak.test/realms/test"
+
+var (
+	rsaKey *rsa.PrivateKey
+	ecKey  *ecdsa.PrivateKey
+)
+
+// TestMain serves a JWKS with rsaKey and ecKey and points VerifyJWT at it.
+func TestMain(m *testing.M) {
+	var err error
+	if rsaKey, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+		panic(err)
+	}
+	if ecKey, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+		panic(err)
+	}
+	encKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		panic(err)
+	}
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{
+			{"kid": "rsa", "kty": "RSA", "use": "sig", "n": b64(rsaKey.N.Bytes()), "e": b64(big.NewInt(int64(rsaKey.E)).Bytes())},
+			{"kid": "ec", "kty": "EC", "crv": "P-256", "x": b64(ecKey.X.FillBytes(make([]byte, 32))), "y": b64(ecKey.Y.FillBytes(make([]byte, 32)))},
+			{"kid": "enc", "kty": "RSA", "use": "enc", "n": b64(encKey.N.Bytes()), "e": b64(big.NewInt(int64(encKey.E)).Bytes())},
+		}})
+	}))
+	os.Setenv("JWKS_URL", jwks.URL)
+	os.Setenv("JWT_ISSUER", testIssuer)
+	os.Setenv("CLIENT_ID", "api")
+	code := m.Run()
+	jwks.Close()
+	os.Exit(code)
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// sign returns a token over claims with the given header, signed by key with alg.
+func sign(t *testing.T, alg, kid string, key interface{}, claims map[string]interface{}) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := b64(header) + "." + b64(payload)
+	digest := sha256.Sum256([]byte(signed))
+
+	var (
+		sig []byte
+		err error
+	)
+	switch alg {
+	case "RS256":
+		sig, err = rsa.SignPKCS1v15(rand.Reader, key.(*rsa.PrivateKey), crypto.SHA256, digest[:])
+	case "PS256":
+		sig, err = rsa.SignPSS(rand.Reader, key.(*rsa.PrivateKey), crypto.SHA256, digest[:], nil)
+	case "ES256":
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, key.(*ecdsa.PrivateKey), digest[:])
+		if err == nil {
+			sig = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+		}
+	case "HS256":
+		mac := hmac.New(sha256.New, key.([]byte))
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + b64(sig)
+}
+
+// claimsWith returns valid claims for the test realm, changed by edit.
+func claimsWith(edit func(c map[string]interface{})) map[string]interface{} {
+	claims := map[string]interface{}{
+		"sub": "user-1",
+		"iss": testIssuer,
+		"azp": "api",
+		"exp": time.Now().Add(time.Minute).Unix(),
+	}
+	if edit != nil {
+		edit(claims)
+	}
+	return claims
+}
+
+func TestVerifyJWT(t *testing.T) {
+	forger, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid := sign(t, "RS256", "rsa", rsaKey, claimsWith(nil))
+	parts := strings.Split(valid, ".")
+	admin, _ := json.Marshal(claimsWith(func(c map[string]interface{}) { c["sub"] = "admin" }))
+	tampered := parts[0] + "." + b64(admin) + "." + parts[2]
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr error
+	}{
+		{"RS256", valid, nil},
+		{"PS256", sign(t, "PS256", "rsa", rsaKey, claimsWith(nil)), nil},
+		{"ES256", sign(t, "ES256", "ec", ecKey, claimsWith(nil)), nil},
+		{"audience in aud string", sign(t, "RS256", "rsa", rsaKey, claimsWith(func(c map[string]interface{}) {
+			delete(c, "azp")
+			c["aud"] = "api"
+		})), nil},
+		{"audience in aud array", sign(t, "RS256", "rsa", rsaKey, claimsWith(func(c map[string]interface{}) {
+			c["azp"] = "frontend"
+			c["aud"] = []string{"account", "api"}
+		})), nil},
+		{"within clock skew", sign(t, "RS256", "rsa", rsaKey, claimsWith(func(c map[string]interface{}) {
+			c["exp"] = time.Now().Add(-10 * time.Second).Unix()
+		})), nil},
+
+		{"forged signature", sign(t, "RS256", "rsa", forger, claimsWith(nil)), ErrBadSignature},
+		{"tampered payload", tampered, ErrBadSignature},
+		{"alg none", b64([]byte(`{"alg":"none","kid":"rsa"}`)) + "." + b64([]byte(`{"sub":"admin"}`)) + ".", ErrBadSignature},
+		{"HS256 with the public key", sign(t, "HS256", "rsa", rsaKey.N.Bytes(), claimsWith(nil)), ErrBadSignature},
+		{"key of another type", sign(t, "RS256", "ec", rsaKey, claimsWith(nil)), ErrBadSignature},
+		{"encryption key", sign(t, "RS256", "enc", rsaKey, claimsWith(nil)), ErrBadSignature},
+		{"unknown kid", sign(t, "RS256", "other", rsaKey, claimsWith(nil)), ErrBadSignature},
+		{"two segments", "abc.def", ErrBadSignature},
+		{"header not JSON", b64([]byte("nope")) + ".e30.c2ln", ErrBadSignature},
+
+		{"expired", sign(t, "RS256", "rsa", rsaKey, claimsWith(func(c map[string]interface{}) {
+			c["exp"] = time.Now().Add(-time.Hour).Unix()
+		})), ErrInvalidToken},
+		{"no expiry", sign(t, "RS256", "rsa", rsaKey, claimsWith(func(c map[string]interface{}) {
+			delete(c, "exp")
+		})), ErrInvalidToken},
+		{"not yet valid", sign(t, "RS256", "rsa", rsaKey, claimsWith(func(c map[string]interface{}) {
+			c["nbf"] = time.Now().Add(time.Hour).Unix()
+		})), ErrInvalidToken},
+		{"other issuer", sign(t, "RS256", "rsa", rsaKey, claimsWith(func(c map[string]interface{}) {
+			c["iss"] = "https://keycloak.test/realms/other"
+		})), ErrInvalidToken},
+		{"other audience", sign(t, "RS256", "rsa", rsaKey, claimsWith(func(c map[string]interface{}) {
+			c["azp"] = "frontend"
+			c["aud"] = "account"
+		})), ErrInvalidToken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, err := VerifyJWT(tt.token)
+			if tt.wantErr == nil {
+				if err != nil {
+					t.Fatalf("VerifyJWT() error = %v", err)
+				}
+				if claims["sub"] != "user-1" {
+					t.Errorf("VerifyJWT() claims = %v", claims)
+				}
+				return
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("VerifyJWT() error = %v, want %v", err, tt.wantErr)
+			}
+			if !errors.Is(err, ErrInvalidToken) {
+				t.Errorf("VerifyJWT() error = %v does not wrap ErrInvalidToken", err)
+			}
+			if tt.wantErr == ErrInvalidToken && errors.Is(err, ErrBadSignature) {
+				t.Errorf("VerifyJWT() error = %v counts a genuine token as forged", err)
+			}
+		})
+	}
+}
+
+func TestJWKSUnavailable(t *testing.T) {
+	jwks := NewJWKS("http://127.0.0.1:1/certs", time.Minute)
+	if _, err := jwks.Key("rsa"); !errors.Is(err, ErrKeysUnavailable) {
+		t.Errorf("Key() error = %v, want ErrKeysUnavailable", err)
+	}
+}
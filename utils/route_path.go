@@ -0,0 +1,17 @@
+package utils
+
+import "strings"
+
+// RoutePath normalises a request path the way Fiber's default router compares it: case-insensitive
+// and ignoring a trailing slash. Anything keyed or matched on the path should use this form so
+// that "/Users/" and "/users" are treated as the same route.
+func RoutePath(path string) string {
+	path = strings.ToLower(path)
+	if len(path) > 1 {
+		path = strings.TrimRight(path, "/")
+		if path == "" {
+			path = "/"
+		}
+	}
+	return path
+}
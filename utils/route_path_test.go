@@ -0,0 +1,22 @@
+package utils
+
+import "testing"
+
+func TestRoutePath(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"/", "/"},
+		{"//", "/"},
+		{"/login", "/login"},
+		{"/login/", "/login"},
+		{"/Users/ABC/", "/users/abc"},
+		{"/admin//", "/admin"},
+	}
+	for _, tt := range tests {
+		if got := RoutePath(tt.path); got != tt.want {
+			t.Errorf("RoutePath(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
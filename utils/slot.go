@@ -0,0 +1,17 @@
+package utils
+
+import "github.com/gofiber/fiber/v2"
+
+// SlotHoldLocalKey is the fiber.Ctx local under which LimitConcurrency offers to keep its slot
+// past the handler's return.
+const SlotHoldLocalKey = "slot_hold"
+
+// HoldSlot keeps the request's concurrency slot, if it holds one, after the handler returns, for
+// responses that are streamed afterwards. The returned func releases the slot and must be called
+// once the response is written.
+func HoldSlot(c *fiber.Ctx) func() {
+	if hold, ok := c.Locals(SlotHoldLocalKey).(func() func()); ok {
+		return hold()
+	}
+	return func() {}
+}